@@ -0,0 +1,133 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+)
+
+var (
+	// ErrBadAuthMethod server used a authentication method different
+	// from the one client provided
+	ErrBadAuthMethod = errors.New("bad authentication method ")
+
+	// ErrAuthFailed server rejected the authentication exchange
+	ErrAuthFailed = errors.New("authentication failed ")
+)
+
+// Authenticator provides MQTT 5 enhanced authentication, it is used
+// in the connect handshake and re-authentication of a live connection
+//
+// The exchange is: client sends authentication data returned by InitialData
+// with the authentication method, server responds with CodeContinueAuth,
+// client calls Challenge with server data and sends the result back,
+// until server responds with CodeSuccess (in ConnAckPacket or AuthPacket)
+type Authenticator interface {
+	// Method is the name of authentication method, e.g. "SCRAM-SHA-256"
+	Method() string
+
+	// InitialData returns the authentication data sent with ConnPacket
+	// or the AuthPacket starting a re-authentication
+	InitialData() ([]byte, error)
+
+	// Challenge handles the authentication data sent by server
+	// when code is CodeContinueAuth, the returned data will be sent to server
+	// when code is CodeSuccess, the authentication exchange is completed
+	// with server final data (the returned data is ignored),
+	// if an error returned, the authentication is considered failed
+	// and the connection will be closed
+	Challenge(code ReasonCode, data []byte) ([]byte, error)
+}
+
+// AuthPacket is sent from Client to Server or Server to Client as part of
+// an extended authentication exchange, such as challenge / response
+// authentication (MQTT 5 only)
+type AuthPacket struct {
+	BasePacket
+	Code  ReasonCode
+	Props *AuthProps
+}
+
+// Type AuthPacket's type is CtrlAuth
+func (a *AuthPacket) Type() CtrlType {
+	return CtrlAuth
+}
+
+// WriteTo encode AuthPacket into buffer
+func (a *AuthPacket) WriteTo(w BufferWriter) error {
+	if w == nil || a == nil {
+		return nil
+	}
+
+	// fixed header
+	w.WriteByte(CtrlAuth << 4)
+	if a.Code == CodeSuccess && a.Props == nil {
+		// reason code and properties can be omitted
+		return w.WriteByte(0x00)
+	}
+
+	props := encodeProps(a.Props.props())
+	// remaining length
+	writeRemainLength(1+len(props), w)
+	w.WriteByte(a.Code)
+	_, err := w.Write(props)
+	return err
+}
+
+// AuthProps defines authentication packet properties (MQTT 5)
+type AuthProps struct {
+	// AuthMethod the name of the authentication method
+	AuthMethod string
+
+	// AuthData contains authentication data
+	AuthData []byte
+
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (a *AuthProps) props() []byte {
+	if a == nil {
+		return nil
+	}
+
+	var result []byte
+	if a.AuthMethod != "" {
+		result = appendPropString(result, propKeyAuthMethod, a.AuthMethod)
+	}
+
+	if a.AuthData != nil {
+		result = appendPropData(result, propKeyAuthData, a.AuthData)
+	}
+
+	return appendReasonProps(result, a.ReasonString, a.UserProps)
+}
+
+func (a *AuthProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeyAuthMethod]; ok {
+		a.AuthMethod = propString(v)
+	}
+
+	if v, ok := props[propKeyAuthData]; ok {
+		a.AuthData = propData(v)
+	}
+
+	a.ReasonString, a.UserProps = decodeReasonProps(props)
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthPacket_Bytes(t *testing.T) {
+	testBytes(&AuthPacket{BasePacket: BasePacket{ProtoVersion: V5}},
+		[]byte{CtrlAuth << 4, 0x00}, t)
+
+	testBytes(&AuthPacket{
+		BasePacket: BasePacket{ProtoVersion: V5},
+		Code:       CodeContinueAuth,
+		Props:      &AuthProps{AuthMethod: "m", AuthData: []byte{1}},
+	}, []byte{
+		CtrlAuth << 4, 10, // fixed header
+		CodeContinueAuth,             // reason code
+		8,                            // properties length
+		propKeyAuthMethod, 0, 1, 'm', // auth method
+		propKeyAuthData, 0, 1, 1, // auth data
+	}, t)
+}
+
+func TestAuthPacket_Decode(t *testing.T) {
+	p := &AuthPacket{
+		BasePacket: BasePacket{ProtoVersion: V5},
+		Code:       CodeReAuth,
+		Props:      &AuthProps{AuthMethod: "m", AuthData: []byte("data"), ReasonString: "foo"},
+	}
+	buf := &bytes.Buffer{}
+	p.WriteTo(buf)
+
+	if _, err := DecodeOnePacket(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Log("decoded auth packet in V311, should not happen")
+		t.Fail()
+	}
+
+	pkt, err := DecodeOnePacketWithVersion(V5, buf)
+	if err != nil || !reflect.DeepEqual(p, pkt) {
+		t.Log(pkt, err)
+		t.Fail()
+	}
+}
+
+// testAuthenticator append "+" to the server challenge
+type testAuthenticator struct {
+	challenges [][]byte
+}
+
+func (a *testAuthenticator) Method() string {
+	return "TEST"
+}
+
+func (a *testAuthenticator) InitialData() ([]byte, error) {
+	return []byte("client-first"), nil
+}
+
+func (a *testAuthenticator) Challenge(code ReasonCode, data []byte) ([]byte, error) {
+	a.challenges = append(a.challenges, data)
+	if code == CodeSuccess && string(data) != "server-final" {
+		return nil, ErrAuthFailed
+	}
+	return append(data, '+'), nil
+}
+
+func TestEnhancedAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	// a server runs one round of challenge
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		pkt, err := DecodeOnePacketWithVersion(V5, conn)
+		if err != nil {
+			return
+		}
+		connPkt := pkt.(*ConnPacket)
+		if connPkt.Props == nil || connPkt.Props.AuthMethod != "TEST" ||
+			string(connPkt.Props.AuthData) != "client-first" {
+			testWritePacket(conn, &ConnAckPacket{
+				BasePacket: connPkt.BasePacket,
+				Code:       CodeBadAuthenticationMethod,
+			})
+			return
+		}
+
+		testWritePacket(conn, &AuthPacket{
+			BasePacket: connPkt.BasePacket,
+			Code:       CodeContinueAuth,
+			Props:      &AuthProps{AuthMethod: "TEST", AuthData: []byte("server-first")},
+		})
+
+		if pkt, err = DecodeOnePacketWithVersion(V5, conn); err != nil {
+			return
+		}
+		code := CodeSuccess
+		if authPkt, ok := pkt.(*AuthPacket); !ok ||
+			string(authPkt.Props.AuthData) != "server-first+" {
+			code = CodeNotAuthorized
+		}
+
+		testWritePacket(conn, &ConnAckPacket{
+			BasePacket: connPkt.BasePacket,
+			Code:       code,
+			Props:      &ConnAckProps{AuthMethod: "TEST", AuthData: []byte("server-final")},
+		})
+
+		// wait for client close
+		DecodeOnePacketWithVersion(V5, conn)
+	}()
+
+	a := &testAuthenticator{}
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithVersion(V5, false),
+		WithAuthenticator(a),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Second, time.Second, 1),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	c.Connect(func(server string, code ConnAckCode, err error) {
+		if err != nil || code != CodeSuccess {
+			t.Log("connect failed, code =", code, "err =", err)
+			t.Fail()
+		}
+		c.Destroy(true)
+	})
+	c.Wait()
+
+	if len(a.challenges) != 2 ||
+		string(a.challenges[0]) != "server-first" ||
+		string(a.challenges[1]) != "server-final" {
+		t.Log("unexpected challenges", a.challenges)
+		t.Fail()
+	}
+}
+
+// testWritePacket encode the packet and write it to the connection
+func testWritePacket(conn io.Writer, pkt Packet) error {
+	buf := &bytes.Buffer{}
+	if err := pkt.WriteTo(buf); err != nil {
+		return err
+	}
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
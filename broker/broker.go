@@ -0,0 +1,347 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lib "github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrBrokerClosed is returned by Serve after the broker closed
+	ErrBrokerClosed = errors.New("broker closed ")
+
+	// ErrUnsupportedNetwork only "tcp" and "unix" network are supported
+	ErrUnsupportedNetwork = errors.New("unsupported network ")
+)
+
+// AuthFunc verifies the identity in the connect packet,
+// return false to refuse the connection
+type AuthFunc func(clientID, username, password string) bool
+
+// Option is the broker option
+type Option func(*Broker) error
+
+// WithAuth set the function to authenticate clients,
+// all clients are accepted if not set
+func WithAuth(f AuthFunc) Option {
+	return func(b *Broker) error {
+		b.auth = f
+		return nil
+	}
+}
+
+// WithConnectTimeout set the max time to wait for connect packet
+// after the connection accepted, default is 10s
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(b *Broker) error {
+		if timeout > 0 {
+			b.connectTimeout = timeout
+		}
+		return nil
+	}
+}
+
+// WithStrictDecode enables strict decoding of packets received,
+// connections sent malformed packets will be closed
+func WithStrictDecode(strict bool) Option {
+	return func(b *Broker) error {
+		b.strictDecode = strict
+		return nil
+	}
+}
+
+// WithMaxPacketSize set the max size of packets received, connections
+// sent packets exceed the limit will be closed, 0 means no limit
+func WithMaxPacketSize(size int) Option {
+	return func(b *Broker) error {
+		if size < 0 {
+			size = 0
+		}
+		b.maxPacketSize = size
+		return nil
+	}
+}
+
+// New create a broker with options, start serving with
+// Serve, ListenAndServe or ServeConn
+func New(options ...Option) (*Broker, error) {
+	b := &Broker{
+		connectTimeout: 10 * time.Second,
+		sessions:       make(map[string]*session),
+		subs:           newSubNode(),
+		retained:       make(map[string]*lib.PublishPacket),
+		listeners:      make(map[net.Listener]struct{}),
+		conns:          make(map[*conn]struct{}),
+	}
+
+	for _, o := range options {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Broker is an in-process MQTT broker supports MQTT 3.1.1 and MQTT 5,
+// with QoS 0, 1 and 2 flows, retained messages, wills and wildcard
+// subscriptions, sessions are kept in memory only
+type Broker struct {
+	auth           AuthFunc
+	connectTimeout time.Duration
+	strictDecode   bool
+	maxPacketSize  int
+	idCounter      uint64
+
+	lock     sync.RWMutex                  // guards fields below
+	sessions map[string]*session           // client id -> session
+	subs     *subNode                      // topic filter -> session
+	retained map[string]*lib.PublishPacket // topic name -> retained message
+
+	connLock  sync.Mutex // guards fields below
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+}
+
+// ListenAndServe listen on network address and serve clients,
+// network can be "tcp" or "unix"
+func (b *Broker) ListenAndServe(network, addr string) error {
+	if network != "tcp" && network != "unix" {
+		return ErrUnsupportedNetwork
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(l)
+}
+
+// Serve clients accepted by the listener until the broker closed
+// or the listener failed, the listener is closed when returned
+func (b *Broker) Serve(l net.Listener) error {
+	b.connLock.Lock()
+	if b.closed {
+		b.connLock.Unlock()
+		l.Close()
+		return ErrBrokerClosed
+	}
+	b.listeners[l] = struct{}{}
+	b.connLock.Unlock()
+
+	defer func() {
+		b.connLock.Lock()
+		delete(b.listeners, l)
+		b.connLock.Unlock()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if b.isClosed() {
+				return ErrBrokerClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go b.ServeConn(nc)
+	}
+}
+
+// ServeConn serve one client connection until it's closed,
+// can be used to serve connections from other transports
+func (b *Broker) ServeConn(nc net.Conn) {
+	c := newConn(b, nc)
+
+	b.connLock.Lock()
+	if b.closed {
+		b.connLock.Unlock()
+		nc.Close()
+		return
+	}
+	b.conns[c] = struct{}{}
+	b.connLock.Unlock()
+
+	defer func() {
+		b.connLock.Lock()
+		delete(b.conns, c)
+		b.connLock.Unlock()
+		c.close()
+	}()
+
+	c.serve()
+}
+
+// Close all listeners and client connections
+func (b *Broker) Close() error {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+
+	b.closed = true
+	for l := range b.listeners {
+		l.Close()
+	}
+
+	for c := range b.conns {
+		c.close()
+	}
+	return nil
+}
+
+func (b *Broker) isClosed() bool {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	return b.closed
+}
+
+// newClientID generate client id for clients connected with empty one
+func (b *Broker) newClientID() string {
+	return "libmqtt-" + strconv.FormatUint(atomic.AddUint64(&b.idCounter, 1), 10)
+}
+
+// attach the connection to the session of client, existing connection
+// of the same client will be taken over
+func (b *Broker) attach(c *conn, clientID string, clean bool) (s *session, present bool) {
+	b.lock.Lock()
+	s, present = b.sessions[clientID]
+	var old *conn
+	if present && (clean || s.clean) {
+		// discard previous session
+		old = s.attach(nil)
+		b.removeSession(s)
+		present = false
+	}
+
+	if !present {
+		s = newSession(clientID, clean)
+		b.sessions[clientID] = s
+	}
+
+	if prev := s.attach(c); prev != nil {
+		old = prev
+	}
+	b.lock.Unlock()
+
+	if old != nil {
+		old.takeOver()
+	}
+	return s, present
+}
+
+// detach the connection from session, clean session will be removed
+func (b *Broker) detach(s *session, c *conn) {
+	if !s.detach(c) || !s.clean {
+		return
+	}
+
+	b.lock.Lock()
+	if b.sessions[s.clientID] == s {
+		b.removeSession(s)
+	}
+	b.lock.Unlock()
+}
+
+// removeSession remove session and its subscriptions, must hold b.lock
+func (b *Broker) removeSession(s *session) {
+	for filter := range s.subscriptions() {
+		b.subs.remove(s, filter)
+	}
+	delete(b.sessions, s.clientID)
+}
+
+// subscribe add subscription of session, retained messages matched
+// are returned according to the retain handling option
+func (b *Broker) subscribe(s *session, t *subscription) []*lib.PublishPacket {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	isNew := b.subs.add(s, t)
+	s.addSub(t)
+
+	if t.RetainHandling == 2 || (t.RetainHandling == 1 && !isNew) {
+		return nil
+	}
+
+	var msgs []*lib.PublishPacket
+	for name, p := range b.retained {
+		if topicMatch(t.Name, name) {
+			msgs = append(msgs, p)
+		}
+	}
+	return msgs
+}
+
+// unSubscribe remove subscription of session
+func (b *Broker) unSubscribe(s *session, filter string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s.removeSub(filter)
+	return b.subs.remove(s, filter)
+}
+
+// publish the message to all matched subscriptions,
+// retained message will be stored or cleared
+func (b *Broker) publish(p *lib.PublishPacket, from *session) {
+	if p.IsRetain {
+		b.lock.Lock()
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p
+		}
+		b.lock.Unlock()
+	}
+
+	// overlapping subscriptions of one session are delivered once
+	// with the max QoS and identifiers of all the subscriptions
+	targets := make(map[*session]*subscription)
+	subIDs := make(map[*session][]int)
+	b.lock.RLock()
+	b.subs.match(strings.Split(p.TopicName, "/"), strings.HasPrefix(p.TopicName, "$"),
+		func(s *session, t *subscription) {
+			if t.NoLocal && s == from {
+				return
+			}
+
+			if prev, ok := targets[s]; !ok || prev.Qos < t.Qos {
+				targets[s] = t
+			}
+			if t.id != 0 {
+				subIDs[s] = append(subIDs[s], t.id)
+			}
+		})
+	b.lock.RUnlock()
+
+	for s, t := range targets {
+		s.deliver(p, t.Qos, t.RetainAsPublished && p.IsRetain, subIDs[s])
+	}
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	lib "github.com/goiiot/libmqtt"
+)
+
+func testBroker(t *testing.T, options ...Option) (*Broker, string) {
+	b, err := New(options...)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	go b.Serve(l)
+
+	return b, l.Addr().String()
+}
+
+func testClient(t *testing.T, addr string, handles map[string]lib.TopicHandler,
+	options ...lib.Option) (lib.Client, lib.ConnAckCode) {
+	c, err := lib.NewClient(append([]lib.Option{
+		lib.WithServer(addr),
+		lib.WithKeepalive(10, 1.2),
+		lib.WithDialTimeout(5),
+		lib.WithRouter(lib.NewStandardRouter()),
+		lib.WithBackoffStrategy(time.Second, time.Second, 1),
+	}, options...)...)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for topic, h := range handles {
+		c.Handle(topic, h)
+	}
+
+	connected := make(chan lib.ConnAckCode, 1)
+	c.Connect(func(server string, code lib.ConnAckCode, err error) {
+		connected <- code
+	})
+
+	select {
+	case code := <-connected:
+		return c, code
+	case <-time.After(5 * time.Second):
+		t.Log("connect timeout")
+		t.FailNow()
+	}
+	return nil, 0
+}
+
+type testMsg struct {
+	topic   string
+	qos     lib.QosLevel
+	payload string
+}
+
+func testRecv(t *testing.T, msgC chan testMsg, expected testMsg) {
+	select {
+	case m := <-msgC:
+		if m != expected {
+			t.Log("unexpected message =", m, "expected =", expected)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("message not received, expected =", expected)
+		t.FailNow()
+	}
+}
+
+func testHandler(msgC chan testMsg) lib.TopicHandler {
+	return func(topic string, qos lib.QosLevel, msg []byte) {
+		msgC <- testMsg{topic: topic, qos: qos, payload: string(msg)}
+	}
+}
+
+func TestBroker_PubSub(t *testing.T) {
+	for _, version := range []lib.ProtocolLevel{lib.V311, lib.V5} {
+		b, addr := testBroker(t)
+
+		msgC := make(chan testMsg, 10)
+		sub, _ := testClient(t, addr, map[string]lib.TopicHandler{"foo/+": testHandler(msgC)},
+			lib.WithVersion(version, false))
+		pub, _ := testClient(t, addr, nil, lib.WithVersion(version, false))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		token := sub.SubscribeContext(ctx,
+			&lib.Topic{Name: "foo/+", Qos: lib.Qos1}, &lib.Topic{Name: "foo/#/bar"})
+		if err := token.Wait(ctx); err != nil {
+			t.Log("subscribe failed, err =", err)
+			t.FailNow()
+		}
+		if codes := token.Codes(); len(codes) != 2 || codes[0] != lib.Qos1 || codes[1] < lib.SubFail {
+			t.Log("unexpected subscribe codes =", codes)
+			t.Fail()
+		}
+
+		for _, qos := range []lib.QosLevel{lib.Qos0, lib.Qos1, lib.Qos2} {
+			token = pub.PublishContext(ctx, &lib.PublishPacket{
+				TopicName: "foo/bar",
+				Qos:       qos,
+				Payload:   []byte("data"),
+			})
+			if err := token.Wait(ctx); err != nil {
+				t.Log("publish failed, err =", err)
+				t.Fail()
+			}
+
+			granted := qos
+			if granted > lib.Qos1 {
+				granted = lib.Qos1
+			}
+			testRecv(t, msgC, testMsg{topic: "foo/bar", qos: granted, payload: "data"})
+		}
+
+		cancel()
+		sub.Destroy(true)
+		pub.Destroy(true)
+		b.Close()
+	}
+}
+
+func TestBroker_Retained(t *testing.T) {
+	b, addr := testBroker(t)
+	defer b.Close()
+
+	pub, _ := testClient(t, addr, nil)
+	defer pub.Destroy(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, topic := range []string{"retain/foo", "retain/bar"} {
+		token := pub.PublishContext(ctx, &lib.PublishPacket{
+			TopicName: topic,
+			Qos:       lib.Qos1,
+			IsRetain:  true,
+			Payload:   []byte(topic),
+		})
+		if err := token.Wait(ctx); err != nil {
+			t.Log("publish failed, err =", err)
+			t.FailNow()
+		}
+	}
+
+	// clear retained message
+	if err := pub.PublishContext(ctx, &lib.PublishPacket{
+		TopicName: "retain/bar",
+		Qos:       lib.Qos1,
+		IsRetain:  true,
+	}).Wait(ctx); err != nil {
+		t.Log("publish failed, err =", err)
+		t.FailNow()
+	}
+
+	msgC := make(chan testMsg, 10)
+	sub, _ := testClient(t, addr, map[string]lib.TopicHandler{"retain/#": testHandler(msgC)})
+	defer sub.Destroy(true)
+
+	sub.Subscribe(&lib.Topic{Name: "retain/#", Qos: lib.Qos1})
+	testRecv(t, msgC, testMsg{topic: "retain/foo", qos: lib.Qos1, payload: "retain/foo"})
+
+	select {
+	case m := <-msgC:
+		t.Log("unexpected retained message =", m)
+		t.Fail()
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroker_Will(t *testing.T) {
+	b, addr := testBroker(t)
+	defer b.Close()
+
+	msgC := make(chan testMsg, 10)
+	sub, _ := testClient(t, addr, map[string]lib.TopicHandler{"will": testHandler(msgC)})
+	defer sub.Destroy(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sub.SubscribeContext(ctx, &lib.Topic{Name: "will", Qos: lib.Qos1}).Wait(ctx); err != nil {
+		t.Log("subscribe failed, err =", err)
+		t.FailNow()
+	}
+
+	c, _ := testClient(t, addr, nil, lib.WithWill("will", lib.Qos1, false, []byte("bye")))
+	// close without disconnect packet
+	c.Destroy(true)
+
+	testRecv(t, msgC, testMsg{topic: "will", qos: lib.Qos1, payload: "bye"})
+}
+
+func TestBroker_Auth(t *testing.T) {
+	b, addr := testBroker(t, WithAuth(func(clientID, username, password string) bool {
+		return username == "foo" && password == "bar"
+	}))
+	defer b.Close()
+
+	c, code := testClient(t, addr, nil, lib.WithIdentity("foo", "baz"))
+	c.Destroy(true)
+	if code != lib.ConnBadIdentity {
+		t.Log("unexpected connack code =", code)
+		t.Fail()
+	}
+
+	c, code = testClient(t, addr, nil, lib.WithIdentity("foo", "bar"))
+	c.Destroy(true)
+	if code != lib.ConnAccepted {
+		t.Log("unexpected connack code =", code)
+		t.Fail()
+	}
+}
+
+func TestBroker_Session(t *testing.T) {
+	b, addr := testBroker(t)
+	defer b.Close()
+
+	msgC := make(chan testMsg, 10)
+	handles := map[string]lib.TopicHandler{"session": testHandler(msgC)}
+	options := []lib.Option{lib.WithClientID("session"), lib.WithCleanSession(false)}
+
+	sub, _ := testClient(t, addr, handles, options...)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sub.SubscribeContext(ctx, &lib.Topic{Name: "session", Qos: lib.Qos1}).Wait(ctx); err != nil {
+		t.Log("subscribe failed, err =", err)
+		t.FailNow()
+	}
+	sub.Destroy(false)
+	time.Sleep(100 * time.Millisecond)
+
+	// queued for offline session
+	pub, _ := testClient(t, addr, nil)
+	defer pub.Destroy(true)
+	if err := pub.PublishContext(ctx, &lib.PublishPacket{
+		TopicName: "session",
+		Qos:       lib.Qos1,
+		Payload:   []byte("offline"),
+	}).Wait(ctx); err != nil {
+		t.Log("publish failed, err =", err)
+		t.FailNow()
+	}
+
+	sub, _ = testClient(t, addr, handles, options...)
+	defer sub.Destroy(true)
+	testRecv(t, msgC, testMsg{topic: "session", qos: lib.Qos1, payload: "offline"})
+}
+
+func TestBroker_ConnAckFirst(t *testing.T) {
+	b, err := New()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	nc, client := net.Pipe()
+	defer client.Close()
+	c := newConn(b, nc)
+	s := newSession("connack", false)
+	s.attach(c)
+	c.s = s
+
+	// delivered before CONNACK sent
+	go s.deliver(&lib.PublishPacket{TopicName: "connack", Qos: lib.Qos1}, lib.Qos1, false, nil)
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		c.write(&lib.ConnAckPacket{Code: lib.ConnAccepted})
+		s.resume(c)
+	}()
+
+	for _, expected := range []lib.CtrlType{lib.CtrlConnAck, lib.CtrlPublish} {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		pkt, err := lib.DecodeOnePacket(client)
+		if err != nil || pkt.Type() != expected {
+			t.Log("unexpected packet =", pkt, "err =", err, "expected type =", expected)
+			t.FailNow()
+		}
+	}
+}
+
+func TestBroker_DeliverProps(t *testing.T) {
+	b, err := New()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	nc, client := net.Pipe()
+	defer client.Close()
+	c := newConn(b, nc)
+	c.version = lib.V5
+	s, _ := b.attach(c, "props", true)
+	c.s = s
+	s.resume(c)
+
+	b.subscribe(s, &subscription{Topic: &lib.Topic{Name: "a/+", Qos: lib.Qos1}, id: 5})
+	b.subscribe(s, &subscription{Topic: &lib.Topic{Name: "a/#"}, id: 7})
+	go b.publish(&lib.PublishPacket{
+		TopicName: "a/b",
+		Qos:       lib.Qos1,
+		Props:     &lib.PublishProps{TopicAlias: 3, SubIDs: []int{9}, ContentType: "text/plain"},
+	}, nil)
+
+	// session not locked while writing
+	time.Sleep(10 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		s.subscriptions()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Log("session locked by blocked write")
+		t.FailNow()
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	pkt, err := lib.DecodeOnePacketWithVersion(lib.V5, client)
+	p, ok := pkt.(*lib.PublishPacket)
+	if !ok || p.Qos != lib.Qos1 || p.Props == nil {
+		t.Log("unexpected packet =", pkt, "err =", err)
+		t.FailNow()
+	}
+
+	ids := p.Props.SubIDs
+	if p.Props.TopicAlias != 0 || p.Props.ContentType != "text/plain" || len(ids) != 2 ||
+		!(ids[0] == 5 && ids[1] == 7 || ids[0] == 7 && ids[1] == 5) {
+		t.Log("unexpected props =", p.Props)
+		t.Fail()
+	}
+}
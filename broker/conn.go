@@ -0,0 +1,327 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	lib "github.com/goiiot/libmqtt"
+)
+
+var (
+	errBadTopic         = errors.New("invalid topic ")
+	errUnexpectedPacket = errors.New("unexpected packet ")
+)
+
+// conn is one client connection to broker
+type conn struct {
+	b         *Broker
+	nc        net.Conn
+	r         *bufio.Reader
+	decoder   *lib.Decoder
+	w         *bufio.Writer
+	writeLock sync.Mutex // lock for w
+	closeOnce sync.Once
+	version   lib.ProtocolLevel
+	s         *session
+	will      *lib.PublishPacket
+}
+
+func newConn(b *Broker, nc net.Conn) *conn {
+	return &conn{
+		b:       b,
+		nc:      nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		version: lib.V311,
+		decoder: &lib.Decoder{
+			Strict:        b.strictDecode,
+			MaxPacketSize: b.maxPacketSize,
+		},
+	}
+}
+
+// serve the client until connection closed
+func (c *conn) serve() {
+	c.nc.SetReadDeadline(time.Now().Add(c.b.connectTimeout))
+	pkt, err := c.decoder.Decode(c.r)
+	if err != nil {
+		return
+	}
+
+	connPkt, ok := pkt.(*lib.ConnPacket)
+	if !ok || !c.connect(connPkt) {
+		return
+	}
+
+	graceful := false
+	defer func() {
+		c.close()
+		c.b.detach(c.s, c)
+		if !graceful && c.will != nil {
+			c.b.publish(c.will, c.s)
+		}
+	}()
+
+	// close the connection if no packet received in one and a half keepalive
+	keepalive := time.Duration(connPkt.Keepalive) * time.Second * 3 / 2
+	for {
+		if keepalive > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(keepalive))
+		} else {
+			c.nc.SetReadDeadline(time.Time{})
+		}
+
+		pkt, err := c.decoder.Decode(c.r)
+		if err != nil {
+			return
+		}
+
+		if pkt.Type() == lib.CtrlDisConn {
+			graceful = true
+			return
+		}
+
+		if err := c.handle(pkt); err != nil {
+			return
+		}
+	}
+}
+
+// connect tend to the connect packet, return false if refused
+func (c *conn) connect(p *lib.ConnPacket) bool {
+	if v := p.Version(); v != lib.V311 && v != lib.V5 {
+		c.write(&lib.ConnAckPacket{Code: lib.ConnBadProtocol})
+		return false
+	}
+	c.version = p.Version()
+	c.decoder.Version = c.version
+
+	clientID := p.ClientID
+	var props *lib.ConnAckProps
+	if clientID == "" {
+		if !p.CleanSession && c.version == lib.V311 {
+			c.refuse(lib.ConnIDRejected, lib.CodeClientIDNotValid)
+			return false
+		}
+
+		clientID = c.b.newClientID()
+		if c.version == lib.V5 {
+			props = &lib.ConnAckProps{AssignedClientID: clientID}
+		}
+	}
+
+	if c.version == lib.V5 && c.b.maxPacketSize > 0 {
+		// tell client the packet size limit
+		if props == nil {
+			props = &lib.ConnAckProps{}
+		}
+		props.MaxPacketSize = uint32(c.b.maxPacketSize)
+	}
+
+	if c.b.auth != nil && !c.b.auth(clientID, p.Username, p.Password) {
+		c.refuse(lib.ConnBadIdentity, lib.CodeBadUserPass)
+		return false
+	}
+
+	if p.IsWill {
+		if !isTopicNameValid(p.WillTopic) || p.WillQos > lib.Qos2 {
+			c.refuse(lib.ConnServerUnavailable, lib.CodeTopicNameInvalid)
+			return false
+		}
+
+		c.will = &lib.PublishPacket{
+			Qos:       p.WillQos,
+			IsRetain:  p.WillRetain,
+			TopicName: p.WillTopic,
+			Payload:   p.WillMessage,
+		}
+	}
+
+	// messages are not delivered to this connection until resumed,
+	// so that CONNACK is always the first packet sent
+	s, present := c.b.attach(c, clientID, p.CleanSession)
+	c.s = s
+	c.write(&lib.ConnAckPacket{Present: present, Code: lib.ConnAccepted, Props: props})
+
+	// resend messages not acknowledged in the previous connection
+	s.resume(c)
+	return true
+}
+
+// refuse the connection with code according to protocol version
+func (c *conn) refuse(v311Code lib.ConnAckCode, v5Code lib.ReasonCode) {
+	code := v311Code
+	if c.version == lib.V5 {
+		code = v5Code
+	}
+	c.write(&lib.ConnAckPacket{Code: code})
+}
+
+// handle packets after connected
+func (c *conn) handle(pkt lib.Packet) error {
+	switch p := pkt.(type) {
+	case *lib.PublishPacket:
+		if !isTopicNameValid(p.TopicName) || p.Qos > lib.Qos2 {
+			return errBadTopic
+		}
+
+		switch p.Qos {
+		case lib.Qos0:
+			c.b.publish(p, c.s)
+		case lib.Qos1:
+			c.b.publish(p, c.s)
+			return c.write(&lib.PubAckPacket{PacketID: p.PacketID})
+		case lib.Qos2:
+			if c.s.receive(p.PacketID) {
+				c.b.publish(p, c.s)
+			}
+			return c.write(&lib.PubRecvPacket{PacketID: p.PacketID})
+		}
+	case *lib.PubRelPacket:
+		c.s.release(p.PacketID)
+		return c.write(&lib.PubCompPacket{PacketID: p.PacketID})
+	case *lib.PubAckPacket:
+		c.s.acked(p.PacketID)
+	case *lib.PubRecvPacket:
+		if rel := c.s.received(p.PacketID, p.Code); rel != nil {
+			return c.write(rel)
+		}
+	case *lib.PubCompPacket:
+		c.s.acked(p.PacketID)
+	case *lib.SubscribePacket:
+		return c.subscribe(p)
+	case *lib.UnSubPacket:
+		return c.unSubscribe(p)
+	default:
+		if pkt == lib.PingReqPacket {
+			return c.write(lib.PingRespPacket)
+		}
+		return errUnexpectedPacket
+	}
+	return nil
+}
+
+func (c *conn) subscribe(p *lib.SubscribePacket) error {
+	type retainedMsg struct {
+		p   *lib.PublishPacket
+		qos lib.QosLevel
+	}
+
+	subID := 0
+	if c.version == lib.V5 && p.Props != nil {
+		subID = p.Props.SubID
+	}
+
+	var retained []retainedMsg
+	codes := make([]lib.SubAckCode, len(p.Topics))
+	for i, t := range p.Topics {
+		if !isTopicFilterValid(t.Name) {
+			codes[i] = lib.SubFail
+			if c.version == lib.V5 {
+				codes[i] = lib.CodeTopicFilterInvalid
+			}
+			continue
+		}
+
+		topic := *t
+		if topic.Qos > lib.Qos2 {
+			topic.Qos = lib.Qos2
+		}
+		codes[i] = topic.Qos
+
+		for _, m := range c.b.subscribe(c.s, &subscription{Topic: &topic, id: subID}) {
+			retained = append(retained, retainedMsg{p: m, qos: topic.Qos})
+		}
+	}
+
+	if err := c.write(&lib.SubAckPacket{PacketID: p.PacketID, Codes: codes}); err != nil {
+		return err
+	}
+
+	// retained messages are sent with retain flag set
+	var subIDs []int
+	if subID != 0 {
+		subIDs = []int{subID}
+	}
+	for _, m := range retained {
+		c.s.deliver(m.p, m.qos, true, subIDs)
+	}
+	return nil
+}
+
+func (c *conn) unSubscribe(p *lib.UnSubPacket) error {
+	codes := make([]lib.ReasonCode, len(p.TopicNames))
+	for i, name := range p.TopicNames {
+		if !c.b.unSubscribe(c.s, name) {
+			codes[i] = lib.CodeNoSubscriptionExisted
+		}
+	}
+
+	return c.write(&lib.UnSubAckPacket{PacketID: p.PacketID, Codes: codes})
+}
+
+// write packet with the protocol version of this connection
+func (c *conn) write(pkt lib.Packet) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.setVersion(pkt)
+	if err := pkt.WriteTo(c.w); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *conn) setVersion(pkt lib.Packet) {
+	switch p := pkt.(type) {
+	case *lib.ConnAckPacket:
+		p.ProtoVersion = c.version
+	case *lib.PublishPacket:
+		p.ProtoVersion = c.version
+	case *lib.PubAckPacket:
+		p.ProtoVersion = c.version
+	case *lib.PubRecvPacket:
+		p.ProtoVersion = c.version
+	case *lib.PubRelPacket:
+		p.ProtoVersion = c.version
+	case *lib.PubCompPacket:
+		p.ProtoVersion = c.version
+	case *lib.SubAckPacket:
+		p.ProtoVersion = c.version
+	case *lib.UnSubAckPacket:
+		p.ProtoVersion = c.version
+	}
+}
+
+// takeOver close the connection for a new connection of the same client
+func (c *conn) takeOver() {
+	if c.version == lib.V5 {
+		c.write(lib.NewDisConnPacket(lib.CodeSessionTakenOver, nil))
+	}
+	c.close()
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		c.nc.Close()
+	})
+}
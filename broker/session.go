@@ -0,0 +1,277 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"math"
+	"sync"
+
+	lib "github.com/goiiot/libmqtt"
+)
+
+// session is the state of one client, kept across connections
+// when the client connected without clean session
+type session struct {
+	clientID string
+	clean    bool
+
+	lock     sync.Mutex               // guards fields below
+	conn     *conn                    // current connection, nil if offline
+	ready    bool                     // conn acknowledged, and messages resent
+	subs     map[string]*subscription // topic filter -> subscription
+	lastID   uint16                   // last packet id allocated
+	inflight map[uint16]*inflightMsg  // packet id -> outgoing message
+	order    []uint16                 // packet ids in the order allocated
+	recvQos2 map[uint16]struct{}      // QoS 2 packet ids not released
+}
+
+// inflightMsg is the outgoing QoS 1 and QoS 2 message not acknowledged
+type inflightMsg struct {
+	pkt  lib.Packet // *PublishPacket or *PubRelPacket
+	sent bool
+}
+
+func newSession(clientID string, clean bool) *session {
+	return &session{
+		clientID: clientID,
+		clean:    clean,
+		subs:     make(map[string]*subscription),
+		inflight: make(map[uint16]*inflightMsg),
+		recvQos2: make(map[uint16]struct{}),
+	}
+}
+
+// attach the connection to session, return the previous connection
+func (s *session) attach(c *conn) *conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.conn
+	s.conn = c
+	s.ready = false
+	return old
+}
+
+// detach the connection from session, return false if it's not the
+// current connection of the session
+func (s *session) detach(c *conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != c {
+		return false
+	}
+	s.conn = nil
+	s.ready = false
+	return true
+}
+
+func (s *session) addSub(t *subscription) {
+	s.lock.Lock()
+	s.subs[t.Name] = t
+	s.lock.Unlock()
+}
+
+func (s *session) removeSub(filter string) {
+	s.lock.Lock()
+	delete(s.subs, filter)
+	s.lock.Unlock()
+}
+
+// subscriptions returns a copy of all subscriptions
+func (s *session) subscriptions() map[string]*subscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	subs := make(map[string]*subscription, len(s.subs))
+	for k, v := range s.subs {
+		subs[k] = v
+	}
+	return subs
+}
+
+// deliver message to client with granted QoS and identifiers of the
+// subscriptions matched, QoS 1 and QoS 2 messages are queued when the
+// client is offline or not ready
+func (s *session) deliver(p *lib.PublishPacket, qos lib.QosLevel, retain bool, subIDs []int) {
+	if p.Qos < qos {
+		qos = p.Qos
+	}
+
+	out := &lib.PublishPacket{
+		Qos:       qos,
+		IsRetain:  retain,
+		TopicName: p.TopicName,
+		Payload:   p.Payload,
+		Props:     deliverProps(p.Props, subIDs),
+	}
+
+	s.lock.Lock()
+	if qos > lib.Qos0 {
+		id, ok := s.nextID()
+		if !ok {
+			// too many messages in flight, dropped
+			s.lock.Unlock()
+			return
+		}
+
+		out.PacketID = id
+		s.inflight[id] = &inflightMsg{pkt: out, sent: s.ready}
+		s.order = append(s.order, id)
+	}
+
+	var c *conn
+	if s.ready {
+		c = s.conn
+	}
+	s.lock.Unlock()
+
+	// write without lock, slow client won't block the publisher
+	// longer than its own write
+	if c != nil {
+		c.write(out)
+	}
+}
+
+// deliverProps returns the properties of message delivered to subscriber,
+// topic alias and subscription identifiers of publisher are not forwarded
+func deliverProps(props *lib.PublishProps, subIDs []int) *lib.PublishProps {
+	if props == nil && len(subIDs) == 0 {
+		return nil
+	}
+
+	out := &lib.PublishProps{}
+	if props != nil {
+		*out = *props
+	}
+	out.TopicAlias = 0
+	out.SubIDs = subIDs
+	return out
+}
+
+// resume resend in-flight messages to the new connection in order after
+// CONNACK sent, messages sent before are marked as duplicated, then the
+// connection is ready for new messages
+func (s *session) resume(c *conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != c {
+		// taken over
+		return
+	}
+
+	for _, id := range s.order {
+		m := s.inflight[id]
+		if p, ok := m.pkt.(*lib.PublishPacket); ok && m.sent {
+			p.IsDup = true
+		}
+
+		m.sent = true
+		if c.write(m.pkt) != nil {
+			return
+		}
+	}
+	s.ready = true
+}
+
+// acked remove the in-flight message acknowledged by PUBACK or PUBCOMP
+func (s *session) acked(id uint16) {
+	s.lock.Lock()
+	s.remove(id)
+	s.lock.Unlock()
+}
+
+// received tend to PUBREC, return the PUBREL to send
+func (s *session) received(id uint16, code lib.ReasonCode) *lib.PubRelPacket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.inflight[id]
+	if !ok {
+		return nil
+	}
+
+	switch p := m.pkt.(type) {
+	case *lib.PublishPacket:
+		if p.Qos != lib.Qos2 {
+			return nil
+		}
+
+		if code >= 0x80 {
+			// refused by client
+			s.remove(id)
+			return nil
+		}
+
+		rel := &lib.PubRelPacket{PacketID: id}
+		m.pkt = rel
+		return rel
+	case *lib.PubRelPacket:
+		return p
+	}
+	return nil
+}
+
+// receive marks the incoming QoS 2 message, return false if duplicated
+func (s *session) receive(id uint16) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.recvQos2[id]; ok {
+		return false
+	}
+	s.recvQos2[id] = struct{}{}
+	return true
+}
+
+// release the incoming QoS 2 message
+func (s *session) release(id uint16) {
+	s.lock.Lock()
+	delete(s.recvQos2, id)
+	s.lock.Unlock()
+}
+
+// nextID allocate packet id for outgoing message, must hold s.lock
+func (s *session) nextID() (uint16, bool) {
+	for i := 0; i < math.MaxUint16; i++ {
+		s.lastID++
+		if s.lastID == 0 {
+			s.lastID = 1
+		}
+
+		if _, used := s.inflight[s.lastID]; !used {
+			return s.lastID, true
+		}
+	}
+	return 0, false
+}
+
+// remove the in-flight message, must hold s.lock
+func (s *session) remove(id uint16) {
+	if _, ok := s.inflight[id]; !ok {
+		return
+	}
+
+	delete(s.inflight, id)
+	for i, v := range s.order {
+		if v == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
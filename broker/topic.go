@@ -0,0 +1,159 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"strings"
+
+	lib "github.com/goiiot/libmqtt"
+)
+
+// subscription is the topic filter subscribed by session
+type subscription struct {
+	*lib.Topic
+	id int // subscription identifier (MQTT 5), 0 means none
+}
+
+// subNode is the node of subscription trie, one node for one topic level
+type subNode struct {
+	children map[string]*subNode
+	subs     map[*session]*subscription
+}
+
+func newSubNode() *subNode {
+	return &subNode{
+		children: make(map[string]*subNode),
+		subs:     make(map[*session]*subscription),
+	}
+}
+
+// add subscription of the session, return false if it's already subscribed
+func (n *subNode) add(s *session, t *subscription) bool {
+	node := n
+	for _, level := range strings.Split(t.Name, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newSubNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	_, existed := node.subs[s]
+	node.subs[s] = t
+	return !existed
+}
+
+// remove subscription of the session, return false if not subscribed
+func (n *subNode) remove(s *session, filter string) bool {
+	return n.removeLevels(s, strings.Split(filter, "/"))
+}
+
+func (n *subNode) removeLevels(s *session, levels []string) bool {
+	if len(levels) == 0 {
+		_, existed := n.subs[s]
+		delete(n.subs, s)
+		return existed
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return false
+	}
+
+	removed := child.removeLevels(s, levels[1:])
+	if len(child.subs) == 0 && len(child.children) == 0 {
+		// prune empty node
+		delete(n.children, levels[0])
+	}
+	return removed
+}
+
+// match the rest topic levels, call f with subscriptions of all filters
+// matched, wildcards never match the first level of topics start with `$`
+func (n *subNode) match(levels []string, isSysTopic bool, f func(*session, *subscription)) {
+	// `#` matches the parent level and all the child levels
+	if c, ok := n.children["#"]; ok && !isSysTopic {
+		for s, t := range c.subs {
+			f(s, t)
+		}
+	}
+
+	if len(levels) == 0 {
+		for s, t := range n.subs {
+			f(s, t)
+		}
+		return
+	}
+
+	if c, ok := n.children["+"]; ok && !isSysTopic {
+		c.match(levels[1:], false, f)
+	}
+
+	if c, ok := n.children[levels[0]]; ok {
+		c.match(levels[1:], false, f)
+	}
+}
+
+// topicMatch reports whether the topic name is matched by the filter
+func topicMatch(filter, topic string) bool {
+	fLevels := strings.Split(filter, "/")
+	tLevels := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (fLevels[0] == "+" || fLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range fLevels {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(tLevels):
+			return false
+		case level != "+" && level != tLevels[i]:
+			return false
+		}
+	}
+	return len(fLevels) == len(tLevels)
+}
+
+// isTopicFilterValid checks the wildcards usage in topic filter,
+// `#` must be the last level and wildcards must occupy an entire level
+func isTopicFilterValid(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case level == "+":
+		case strings.ContainsAny(level, "#+"):
+			return false
+		}
+	}
+	return true
+}
+
+// isTopicNameValid checks the topic name of publish packet,
+// which must not be empty or contain wildcards
+func isTopicNameValid(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "#+")
+}
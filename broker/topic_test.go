@@ -0,0 +1,66 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package broker
+
+import (
+	"strings"
+	"testing"
+
+	lib "github.com/goiiot/libmqtt"
+)
+
+func TestTopicMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"foo/bar", "foo/bar", true},
+		{"foo/+", "foo/bar", true},
+		{"foo/+", "foo/bar/baz", false},
+		{"foo/#", "foo", true},
+		{"foo/#", "foo/bar/baz", true},
+		{"+/+", "/foo", true},
+		{"#", "$SYS/foo", false},
+		{"$SYS/#", "$SYS/foo", true},
+	}
+
+	root := newSubNode()
+	s := newSession("test", true)
+	for _, c := range cases {
+		if topicMatch(c.filter, c.topic) != c.match {
+			t.Log("filter =", c.filter, "topic =", c.topic, "expected match =", c.match)
+			t.Fail()
+		}
+
+		root.add(s, &subscription{Topic: &lib.Topic{Name: c.filter}})
+		matched := false
+		root.match(strings.Split(c.topic, "/"), c.topic[0] == '$', func(*session, *subscription) {
+			matched = true
+		})
+		root.remove(s, c.filter)
+
+		if matched != c.match {
+			t.Log("trie filter =", c.filter, "topic =", c.topic, "expected match =", c.match)
+			t.Fail()
+		}
+	}
+
+	if len(root.children) != 0 {
+		t.Log("empty nodes not pruned")
+		t.Fail()
+	}
+}
@@ -19,12 +19,17 @@ package libmqtt
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"io/ioutil"
 	"math"
 	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -32,6 +37,18 @@ import (
 var (
 	// ErrTimeOut connection timeout error
 	ErrTimeOut = errors.New("connection timeout ")
+
+	// ErrUnsupportedVersion unsupported MQTT protocol version
+	ErrUnsupportedVersion = errors.New("unsupported protocol version ")
+
+	// ErrBadCACert no valid certificate found in CA certificate
+	ErrBadCACert = errors.New("bad ca cert ")
+
+	// ErrUnsupportedScheme unsupported server url scheme
+	ErrUnsupportedScheme = errors.New("unsupported server scheme ")
+
+	// ErrSessionDiscarded server discarded the session before the packet completed
+	ErrSessionDiscarded = errors.New("session discarded by server ")
 )
 
 // Option is client option for connection options
@@ -82,6 +99,9 @@ func WithKeepalive(keepalive uint16, factor float64) Option {
 // maxDelay defines the upper bound of backoff delay
 // factor is applied to the backoff after each retry.
 // e.g. FirstDelay = 1s and Factor = 2, then the SecondDelay is 2s, the ThirdDelay is 4s
+//
+// factor <= 1 means no reconnect (kept for compatibility), it's a shortcut
+// of WithReconnectPolicy with BackoffPolicy without jitter
 func WithBackoffStrategy(firstDelay, maxDelay time.Duration, factor float64) Option {
 	return func(c *client) error {
 		if firstDelay < time.Millisecond {
@@ -96,9 +116,15 @@ func WithBackoffStrategy(firstDelay, maxDelay time.Duration, factor float64) Opt
 			factor = 1
 		}
 
-		c.options.firstDelay = firstDelay
-		c.options.maxDelay = maxDelay
-		c.options.backoffFactor = factor
+		p := &BackoffPolicy{
+			FirstDelay: firstDelay,
+			MaxDelay:   maxDelay,
+			Factor:     factor,
+		}
+		if factor <= 1 {
+			p.MaxAttempts = -1
+		}
+		c.options.reconnect = p
 		return nil
 	}
 }
@@ -124,8 +150,10 @@ func WithWill(topic string, qos QosLevel, retain bool, payload []byte) Option {
 }
 
 // WithServer adds servers as client server
-// Just use "ip:port" or "domain.name:port"
-// However, only TCP connection supported for now
+// Just use "ip:port" or "domain.name:port" for TCP connection,
+// or use url like "tcp://ip:port", "ws://domain.name:port/path"
+// and "wss://domain.name:port/path" to select transport,
+// WebSocket connections use the "mqtt" subprotocol with binary frames
 func WithServer(servers ...string) Option {
 	return func(c *client) error {
 		c.options.servers = servers
@@ -133,28 +161,153 @@ func WithServer(servers ...string) Option {
 	}
 }
 
-// WithTLS for client tls certification
+// WithTLS for client tls certification, caCert is used to verify
+// server certificate, certFile and keyFile are the client certificate
 func WithTLS(certFile, keyFile string, caCert string, serverNameOverride string, skipVerify bool) Option {
 	return func(c *client) error {
-		b, err := ioutil.ReadFile(caCert)
+		caPEM, err := ioutil.ReadFile(caCert)
 		if err != nil {
 			return err
 		}
-		cp := x509.NewCertPool()
-		if !cp.AppendCertsFromPEM(b) {
+
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
 			return err
 		}
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+		keyPEM, err := ioutil.ReadFile(keyFile)
 		if err != nil {
 			return err
 		}
 
-		c.options.tlsConfig = &tls.Config{
-			Certificates:       []tls.Certificate{cert},
+		return WithTLSPEM(certPEM, keyPEM, caPEM, serverNameOverride, skipVerify)(c)
+	}
+}
+
+// WithTLSPEM for client tls certification with PEM encoded data,
+// caPEM is used to verify server certificate (system roots if empty),
+// certPEM and keyPEM are the client certificate (optional)
+func WithTLSPEM(certPEM, keyPEM, caPEM []byte, serverNameOverride string, skipVerify bool) Option {
+	return func(c *client) error {
+		config := &tls.Config{
 			InsecureSkipVerify: skipVerify,
-			ClientCAs:          cp,
 			ServerName:         serverNameOverride,
 		}
+
+		if len(caPEM) > 0 {
+			cp := x509.NewCertPool()
+			if !cp.AppendCertsFromPEM(caPEM) {
+				return ErrBadCACert
+			}
+			config.RootCAs = cp
+		}
+
+		if len(certPEM) > 0 || len(keyPEM) > 0 {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+
+		c.options.tlsConfig = config
+		return nil
+	}
+}
+
+// WithTLSConfig for client tls with the config (e.g. ALPN, cipher suites),
+// the config is cloned, it should not be modified after passed in
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *client) error {
+		if config != nil {
+			c.options.tlsConfig = config.Clone()
+		}
+		return nil
+	}
+}
+
+// CertLoader loads the client certificate
+type CertLoader func() (*tls.Certificate, error)
+
+// WithTLSCertLoader set the function loads client certificate for
+// every new connection (including reconnects), so that rotated
+// certificates are used on the next connect, it replaces the
+// certificates of tls config, tls should be enabled with WithTLS,
+// WithTLSPEM, WithTLSConfig or wss scheme
+func WithTLSCertLoader(load CertLoader) Option {
+	return func(c *client) error {
+		c.options.certLoader = load
+		return nil
+	}
+}
+
+// WithVersion set the MQTT protocol version used to connect to server,
+// only V311 and V5 are supported, default is V311
+// if compromise is true, client will fallback to V311 when server
+// refused the connection for the protocol version
+func WithVersion(version ProtocolLevel, compromise bool) Option {
+	return func(c *client) error {
+		if version != V311 && version != V5 {
+			return ErrUnsupportedVersion
+		}
+
+		c.options.protoVersion = version
+		c.options.protoCompromise = compromise
+		return nil
+	}
+}
+
+// WithConnProps set the properties sent in the connect packet (MQTT 5 only)
+func WithConnProps(props *ConnProps) Option {
+	return func(c *client) error {
+		c.options.connProps = props
+		return nil
+	}
+}
+
+// WithWillProps set the properties of will message (MQTT 5 only)
+func WithWillProps(props *WillProps) Option {
+	return func(c *client) error {
+		c.options.willProps = props
+		return nil
+	}
+}
+
+// WithWebSocketHeader set the custom http header used in WebSocket handshake
+func WithWebSocketHeader(header http.Header) Option {
+	return func(c *client) error {
+		c.options.wsHeader = header
+		return nil
+	}
+}
+
+// WithAuthenticator set the authenticator for MQTT 5 enhanced authentication,
+// only used when the connection is using MQTT 5
+func WithAuthenticator(a Authenticator) Option {
+	return func(c *client) error {
+		c.options.authenticator = a
+		return nil
+	}
+}
+
+// WithStrictDecode enables strict decoding of packets received from server,
+// connection will be closed when received malformed packets
+func WithStrictDecode(strict bool) Option {
+	return func(c *client) error {
+		c.options.strictDecode = strict
+		return nil
+	}
+}
+
+// WithMaxPacketSize set the max size of packets received from server,
+// connection will be closed when received packet exceeds the limit,
+// the limit is sent to server in MQTT 5 connection, 0 means no limit
+func WithMaxPacketSize(size int) Option {
+	return func(c *client) error {
+		if size < 0 {
+			size = 0
+		}
+		c.options.maxPacketSize = size
 		return nil
 	}
 }
@@ -167,6 +320,31 @@ func WithDialTimeout(timeout uint16) Option {
 	}
 }
 
+// Dialer creates the connection to server, server is the address
+// provided with WithServer, the returned connection is used for
+// MQTT byte stream directly
+type Dialer func(ctx context.Context, server string) (net.Conn, error)
+
+// WithDialer set the custom dialer for all servers, the dialer replaces
+// the builtin dialing of server schemes (tcp, unix, ws, wss) and TLS,
+// the ctx is canceled when dial timeout exceeded
+func WithDialer(d Dialer) Option {
+	return func(c *client) error {
+		c.options.dialer = d
+		return nil
+	}
+}
+
+// WithNetDialer set the net.Dialer used by builtin dialing of server
+// schemes, e.g. to bind local address, the dial timeout is applied
+// with context, so it's not necessary to set Timeout of the dialer
+func WithNetDialer(d *net.Dialer) Option {
+	return func(c *client) error {
+		c.options.netDialer = d
+		return nil
+	}
+}
+
 // WithSendBuf designate the channel size of send
 func WithSendBuf(size int) Option {
 	return func(c *client) error {
@@ -180,6 +358,22 @@ func WithSendBuf(size int) Option {
 	}
 }
 
+// WithInFlightWindow limits the number of QoS 1 and QoS 2 publish packets
+// waiting for acknowledgement, publish blocks when the window is full,
+// the window is also limited by the Receive Maximum of MQTT 5 servers
+// (the smallest of connected servers), 0 means no limit (default)
+func WithInFlightWindow(size int) Option {
+	return func(c *client) error {
+		if size < 0 {
+			size = 0
+		} else if size > math.MaxUint16 {
+			size = math.MaxUint16
+		}
+		c.options.inFlightWindow = size
+		return nil
+	}
+}
+
 // WithRecvBuf designate the channel size of receive
 func WithRecvBuf(size int) Option {
 	return func(c *client) error {
@@ -203,10 +397,31 @@ func WithRouter(r TopicRouter) Option {
 	}
 }
 
-// WithLog will create basic logger for log
+// WithLog will create basic logger writes to stderr for this client,
+// messages with level lower than l are discarded
 func WithLog(l LogLevel) Option {
 	return func(c *client) error {
-		lg = newLogger(l)
+		c.log = newFieldLogger(NewStdLogger(l))
+		return nil
+	}
+}
+
+// WithLogger set the structured logger for this client,
+// messages are logged with fields like server, packet_id and packet_type
+func WithLogger(l Logger) Option {
+	return func(c *client) error {
+		c.log = newFieldLogger(l)
+		return nil
+	}
+}
+
+// WithMetrics set the collector for metrics of client internals,
+// e.g. NewPrometheusMetrics
+func WithMetrics(m MetricsCollector) Option {
+	return func(c *client) error {
+		if m != nil {
+			c.metrics = m
+		}
 		return nil
 	}
 }
@@ -226,34 +441,79 @@ func NewClient(options ...Option) (Client, error) {
 		return nil, errors.New("no server provided, won't work ")
 	}
 
+	if c.options.clientID != "" {
+		c.log = c.log.with("client_id", c.options.clientID)
+	}
+
+	if r, ok := c.router.(*StandardRouter); ok {
+		r.useLog(c.log)
+	}
+
+	c.idGen.changed = c.metrics.InFlight
+	c.idGen.setLimit(c.options.inFlightWindow)
 	c.msgC = make(chan *message)
 	c.sendC = make(chan Packet, c.options.sendChanSize)
-	c.recvC = make(chan *PublishPacket, c.options.recvChanSize)
+	c.recvC = make(chan *Message, c.options.recvChanSize)
+	if c.options.offline != nil {
+		c.offline = newOfflineQueue(c, c.options.offline)
+		go c.offline.pump()
+	}
+
+	if c.options.dispatch != nil {
+		c.dispatch = newDispatchPool(c, c.options.dispatch)
+	}
+
+	// keep packet ids of the persisted in-flight packets in use,
+	// they will be resent once connected
+	c.persist.Range(func(key string, p Packet) bool {
+		if isSend, id, ok := parsePersistKey(key); ok && isSend {
+			c.idGen.use(id, p)
+		}
+		return true
+	})
 
 	return c, nil
 }
 
 // clientOptions is the options for client to connect, reconnect, disconnect
 type clientOptions struct {
-	sendChanSize    int           // send channel size
-	recvChanSize    int           // recv channel size
-	servers         []string      // server address strings
-	dialTimeout     time.Duration // dial timeout in second
-	clientID        string        // used by ConnPacket
-	username        string        // used by ConnPacket
-	password        string        // used by ConnPacket
-	keepalive       time.Duration // used by ConnPacket (time in second)
-	keepaliveFactor float64       // used for reasonable amount time to close conn if no ping resp
-	cleanSession    bool          // used by ConnPacket
-	isWill          bool          // used by ConnPacket
-	willTopic       string        // used by ConnPacket
-	willPayload     []byte        // used by ConnPacket
-	willQos         byte          // used by ConnPacket
-	willRetain      bool          // used by ConnPacket
-	tlsConfig       *tls.Config   // tls config with client side cert
-	maxDelay        time.Duration
-	firstDelay      time.Duration
-	backoffFactor   float64
+	sendChanSize     int             // send channel size
+	recvChanSize     int             // recv channel size
+	servers          []string        // server address strings
+	dialTimeout      time.Duration   // dial timeout in second
+	dialer           Dialer          // custom dialer
+	netDialer        *net.Dialer     // net dialer for builtin dialing
+	proxy            *url.URL        // proxy for all servers
+	proxyFromEnv     bool            // use proxy from environment variables
+	clientID         string          // used by ConnPacket
+	username         string          // used by ConnPacket
+	password         string          // used by ConnPacket
+	keepalive        time.Duration   // used by ConnPacket (time in second)
+	keepaliveFactor  float64         // used for reasonable amount time to close conn if no ping resp
+	cleanSession     bool            // used by ConnPacket
+	isWill           bool            // used by ConnPacket
+	willTopic        string          // used by ConnPacket
+	willPayload      []byte          // used by ConnPacket
+	willQos          byte            // used by ConnPacket
+	willRetain       bool            // used by ConnPacket
+	tlsConfig        *tls.Config     // tls config with client side cert
+	certLoader       CertLoader      // client cert loader for every connect
+	wsHeader         http.Header     // http header used in websocket handshake
+	protoVersion     ProtocolLevel   // used by ConnPacket, MQTT protocol version
+	protoCompromise  bool            // fallback to V311 when V5 not supported by server
+	connProps        *ConnProps      // used by ConnPacket (MQTT 5)
+	willProps        *WillProps      // used by ConnPacket (MQTT 5)
+	authenticator    Authenticator   // used by ConnPacket and AuthPacket (MQTT 5)
+	strictDecode     bool            // decode received packets in strict mode
+	maxPacketSize    int             // max size of packets received
+	sendInterceptors []Interceptor   // interceptors of packets to send
+	recvInterceptors []Interceptor   // interceptors of packets received
+	connStrategy     ConnStrategy    // strategy to connect to servers
+	offline          *offlineConfig  // offline queue of publish packets
+	inFlightWindow   int             // max QoS 1/2 publish packets in-flight
+	dispatch         *dispatchConfig // dispatch packets received with worker pool
+	manualAck        bool            // acknowledge packets received after application acked
+	reconnect        ReconnectPolicy
 }
 
 // Client act as a mqtt client
@@ -262,24 +522,53 @@ type Client interface {
 	// the default handler inside the client is TextHandler, which match the exactly same topic
 	Handle(topic string, h TopicHandler)
 
+	// HandleMessage register topic with MessageHandler, the router must
+	// implement MessageRouter, all builtin routers do
+	HandleMessage(topic string, h MessageHandler)
+
 	// Connect to all specified server with client options
 	Connect(ConnHandler)
 
 	// Publish a message for the topic
 	Publish(packets ...*PublishPacket)
 
+	// PublishContext publish a message and track the result with token,
+	// the message is dropped if ctx done before it's sent
+	PublishContext(ctx context.Context, packet *PublishPacket) *Token
+
 	// Subscribe topic(s)
 	Subscribe(topics ...*Topic)
 
+	// SubscribeContext subscribe topic(s) and track the result with token
+	SubscribeContext(ctx context.Context, topics ...*Topic) *Token
+
 	// UnSubscribe topic(s)
 	UnSubscribe(topics ...string)
 
+	// UnSubscribeContext unsubscribe topic(s) and track the result with token
+	UnSubscribeContext(ctx context.Context, topics ...string) *Token
+
+	// ReAuth start re-authentication with all connected MQTT 5 servers,
+	// using the authenticator provided by WithAuthenticator
+	ReAuth()
+
 	// Wait will wait until all connection finished
 	Wait()
 
 	// Destroy all client connection
 	Destroy(force bool)
 
+	// Shutdown close the client gracefully, drain packets before ctx done,
+	// and report packets abandoned
+	Shutdown(ctx context.Context) (*ShutdownReport, error)
+
+	// State returns the connection state of server
+	State(server string) ConnState
+
+	// OnStateChange subscribe the connection state changes of all servers,
+	// call cancel to unsubscribe
+	OnStateChange(h StateHandler) (cancel func())
+
 	// handlers
 	HandlePub(PubHandler)
 	HandleSub(SubHandler)
@@ -289,16 +578,34 @@ type Client interface {
 }
 
 type client struct {
-	options *clientOptions      // client connection options
-	subs    *sync.Map           // Topic(s) -> []TopicHandler
-	conn    *sync.Map           // ServerAddr -> connection
-	msgC    chan *message       // error channel
-	sendC   chan Packet         // Pub channel for sending publish packet to server
-	recvC   chan *PublishPacket // recv channel for server pub receiving
-	idGen   *idGenerator        // Packet id generator
-	router  TopicRouter         // Topic router
-	persist PersistMethod       // Persist method
-	workers *sync.WaitGroup     // Workers (connections)
+	options   *clientOptions    // client connection options
+	subs      *sync.Map         // Topic name -> *Topic with granted QoS
+	conn      *sync.Map         // ServerAddr -> connection
+	msgC      chan *message     // error channel
+	sendC     chan Packet       // Pub channel for sending publish packet to server
+	recvC     chan *Message     // recv channel for server pub receiving
+	idGen     *idGenerator      // Packet id generator
+	router    TopicRouter       // Topic router
+	persist   PersistMethod     // Persist method
+	workers   *sync.WaitGroup   // Workers (connections)
+	tokens    *sync.Map         // Packet id (or QoS 0 publish) -> *Token
+	queued    *sync.Map         // Packet id of packets waiting in sendC
+	log       *fieldLogger      // Logger of this client
+	metrics   MetricsCollector  // Metrics collector
+	fanOut    *fanOut           // Connections for ConnFanOut strategy
+	offline   *offlineQueue     // Offline queue of publish packets
+	dispatch  *dispatchPool     // Worker pool to dispatch packets received
+	stopC     chan struct{}     // Closed by Destroy or Shutdown, stop reconnecting
+	stopOnce  sync.Once         // Close stopC once
+	closingC  chan struct{}     // Closed by Shutdown, no more packets accepted
+	closedC   chan struct{}     // Closed after Shutdown, stop all goroutines
+	shutdown  int32             // Set by Shutdown, it can only be called once
+	sentLock  sync.Mutex        // Guards sentBy
+	sentBy    map[uint16]string // Packet id -> server the packet sent through
+	winLock   sync.Mutex        // Guards windows
+	windows   map[string]int    // Server -> in-flight window of the connection
+	enqueuing sync.RWMutex      // Held by enqueue, locked by Shutdown before closing sendC
+	states    *connStates       // Connection states of servers
 
 	// success/error handlers
 	pH  PubHandler
@@ -312,43 +619,76 @@ type client struct {
 func defaultClient() *client {
 	return &client{
 		options: &clientOptions{
-			sendChanSize:    128,
-			recvChanSize:    128,
-			maxDelay:        2 * time.Minute, // default max retry delay is 2min
-			firstDelay:      5 * time.Second, // first retry delay is 5s
-			backoffFactor:   1.5,
+			sendChanSize: 128,
+			recvChanSize: 128,
+			reconnect: &BackoffPolicy{
+				FirstDelay: 5 * time.Second, // first retry delay is 5s
+				MaxDelay:   2 * time.Minute, // default max retry delay is 2min
+				Factor:     1.5,
+			},
 			dialTimeout:     20 * time.Second, // default timeout when dial to server
 			keepalive:       2 * time.Minute,  // default keepalive interval is 2min
 			keepaliveFactor: 1.5,              // default reasonable amount of time 3min
+			protoVersion:    V311,
 		},
-		router:  NewTextRouter(),
-		subs:    &sync.Map{},
-		conn:    &sync.Map{},
-		idGen:   newIDGenerator(),
-		workers: &sync.WaitGroup{},
-		persist: NonePersist,
+		router:   NewTextRouter(),
+		subs:     &sync.Map{},
+		conn:     &sync.Map{},
+		idGen:    newIDGenerator(),
+		workers:  &sync.WaitGroup{},
+		tokens:   &sync.Map{},
+		queued:   &sync.Map{},
+		sentBy:   make(map[uint16]string),
+		windows:  make(map[string]int),
+		states:   newConnStates(),
+		stopC:    make(chan struct{}),
+		closingC: make(chan struct{}),
+		closedC:  make(chan struct{}),
+		persist:  NonePersist,
+		metrics:  nopMetrics{},
 	}
 }
 
 // Handle subscription message route
 func (c *client) Handle(topic string, h TopicHandler) {
 	if h != nil {
-		lg.d("HANDLE registered handler, topic =", topic)
+		c.log.d("HANDLE registered handler", "topic", topic)
 		c.router.Handle(topic, h)
 	}
 }
 
 // Connect to all designated server
 func (c *client) Connect(h ConnHandler) {
-	lg.d("CLIENT connect to server, handler =", h)
+	if c.stopped() {
+		c.log.w("CLIENT connect after destroyed")
+		return
+	}
+
+	c.log.d("CLIENT connect to server", "servers", c.options.servers)
 	go func() {
-		for pkt := range c.recvC {
-			c.router.Dispatch(pkt)
+		for m := range c.recvC {
+			c.metrics.QueueDepth("recv", len(c.recvC))
+			if c.dispatch != nil {
+				c.dispatch.dispatch(m)
+			} else {
+				c.route(m)
+			}
+		}
+
+		if c.dispatch != nil {
+			c.dispatch.close()
 		}
 	}()
 
 	go func() {
-		for m := range c.msgC {
+		for {
+			var m *message
+			select {
+			case m = <-c.msgC:
+			case <-c.closedC:
+				return
+			}
+
 			switch m.what {
 			case pubMsg:
 				if c.pH != nil {
@@ -367,6 +707,7 @@ func (c *client) Connect(h ConnHandler) {
 					go c.nH(m.msg, m.err)
 				}
 			case persistMsg:
+				c.metrics.PersistError(m.err)
 				if c.psH != nil {
 					go c.psH(m.err)
 				}
@@ -374,9 +715,20 @@ func (c *client) Connect(h ConnHandler) {
 		}
 	}()
 
+	if c.options.connStrategy.isSingle() {
+		c.workers.Add(1)
+		go c.connect(c.options.servers[0], h, c.options.protoVersion, 0, 0)
+		return
+	}
+
+	if c.options.connStrategy == ConnFanOut {
+		c.fanOut = newFanOut()
+		go c.fanOut.dispatch(c.sendC, c.queued)
+	}
+
 	for _, s := range c.options.servers {
 		c.workers.Add(1)
-		go c.connect(s, h, c.options.firstDelay)
+		go c.connect(s, h, c.options.protoVersion, 0, 0)
 	}
 }
 
@@ -387,54 +739,325 @@ func (c *client) Publish(msg ...*PublishPacket) {
 			continue
 		}
 
-		p := m
-		if p.Qos > Qos2 {
-			p.Qos = Qos2
-		}
+		c.publish(context.Background(), m, nil)
+	}
+}
 
-		if p.Qos != Qos0 && p.PacketID == 0 {
-			p.PacketID = c.idGen.next(p)
-			if err := c.persist.Store(sendKey(p.PacketID), p); err != nil {
-				c.msgC <- newPersistMsg(err)
-			}
+// PublishContext publish the message, the token returned is completed
+// when server acknowledged the message (or sent to server with QoS 0)
+func (c *client) PublishContext(ctx context.Context, msg *PublishPacket) *Token {
+	t := newToken()
+	if msg == nil {
+		t.complete(nil, ErrBadPacket)
+		return t
+	}
+
+	c.publish(ctx, msg, t)
+	return t
+}
+
+func (c *client) publish(ctx context.Context, p *PublishPacket, t *Token) {
+	if p.Qos > Qos2 {
+		p.Qos = Qos2
+	}
+
+	if p.Qos == Qos0 {
+		// token of QoS 0 publish is keyed by the packet, so that
+		// publishing the same packet again won't replace the token
+		cp := *p
+		p = &cp
+	}
+
+	if c.offline != nil {
+		c.offline.push(ctx, p, t)
+		return
+	}
+
+	key, _, err := c.prepare(ctx, c.closingC, p)
+	if err != nil {
+		c.reject(t, newPubMsg(p.TopicName, err))
+		return
+	}
+
+	if t != nil {
+		c.addToken(ctx, key, t)
+	}
+	c.enqueue(ctx, key, p)
+}
+
+// prepare the publish packet to send, returns the key of token,
+// assigned is true if the packet id is assigned (and persisted),
+// it blocks when the in-flight window is full until ctx done or stop closed
+func (c *client) prepare(ctx context.Context, stop <-chan struct{}, p *PublishPacket) (key interface{}, assigned bool, err error) {
+	if p.Qos == Qos0 {
+		return p, false, nil
+	}
+
+	if p.PacketID == 0 {
+		if p.PacketID, err = c.idGen.next(ctx, stop, p); err != nil {
+			return nil, false, err
+		}
+		if err := c.persist.Store(sendKey(p.PacketID), p); err != nil {
+			c.notify(newPersistMsg(err))
 		}
-		c.sendC <- p
+		assigned = true
 	}
+	return p.PacketID, assigned, nil
+}
+
+// reject the packet failed to get packet id, notify the error to
+// token and handler
+func (c *client) reject(t *Token, m *message) {
+	c.log.w("CLIENT packet rejected", "err", m.err)
+	if t != nil {
+		t.complete(nil, m.err)
+	}
+	c.notify(m)
 }
 
 // SubScribe topic(s)
 func (c *client) Subscribe(topics ...*Topic) {
-	lg.d("CLIENT subscribe, topic(s) =", topics)
+	c.subscribe(context.Background(), topics, nil)
+}
+
+// SubscribeContext subscribe topic(s), the token returned is completed
+// when server acknowledged the subscription
+func (c *client) SubscribeContext(ctx context.Context, topics ...*Topic) *Token {
+	t := newToken()
+	c.subscribe(ctx, topics, t)
+	return t
+}
+
+func (c *client) subscribe(ctx context.Context, topics []*Topic, t *Token) {
+	c.log.d("CLIENT subscribe", "topics", topics)
 	s := &SubscribePacket{Topics: topics}
-	s.PacketID = c.idGen.next(s)
-	c.sendC <- s
+	id, err := c.idGen.next(ctx, c.closingC, s)
+	if err != nil {
+		c.reject(t, newSubMsg(topics, err))
+		return
+	}
+
+	s.PacketID = id
+	if t != nil {
+		c.addToken(ctx, s.PacketID, t)
+	}
+	c.enqueue(ctx, s.PacketID, s)
 }
 
 // UnSubscribe topic(s)
 func (c *client) UnSubscribe(topics ...string) {
-	lg.d("CLIENT unsubscribe topic(s) =", topics)
-	for _, t := range topics {
-		c.subs.Delete(t)
+	c.unSubscribe(context.Background(), topics, nil)
+}
+
+// UnSubscribeContext unsubscribe topic(s), the token returned is completed
+// when server acknowledged the unsubscription
+func (c *client) UnSubscribeContext(ctx context.Context, topics ...string) *Token {
+	t := newToken()
+	c.unSubscribe(ctx, topics, t)
+	return t
+}
+
+func (c *client) unSubscribe(ctx context.Context, topics []string, t *Token) {
+	c.log.d("CLIENT unsubscribe", "topics", topics)
+	for _, topic := range topics {
+		c.subs.Delete(topic)
 	}
 	u := &UnSubPacket{
 		TopicNames: topics,
 	}
-	u.PacketID = c.idGen.next(u)
-	c.sendC <- u
+	id, err := c.idGen.next(ctx, c.closingC, u)
+	if err != nil {
+		c.reject(t, newUnSubMsg(topics, err))
+		return
+	}
+
+	u.PacketID = id
+	if t != nil {
+		c.addToken(ctx, u.PacketID, t)
+	}
+	c.enqueue(ctx, u.PacketID, u)
+}
+
+// inFlightWindow returns the in-flight window of the connection,
+// limited by the Receive Maximum of server
+func (c *client) inFlightWindow(connAck *ConnAckPacket) int {
+	window := c.options.inFlightWindow
+	if connAck.Props != nil && connAck.Props.MaxRecv > 0 &&
+		(window == 0 || int(connAck.Props.MaxRecv) < window) {
+		window = int(connAck.Props.MaxRecv)
+	}
+	return window
+}
+
+// setWindow set the in-flight window of the connected server, or remove it
+// when disconnected, packet ids are shared by all the connections, so the
+// in-flight window of client is the minimum of connected servers
+func (c *client) setWindow(server string, window int, connected bool) {
+	c.winLock.Lock()
+	defer c.winLock.Unlock()
+
+	if connected {
+		c.windows[server] = window
+	} else {
+		delete(c.windows, server)
+	}
+
+	limit := c.options.inFlightWindow
+	if len(c.windows) > 0 {
+		limit = 0
+		for _, w := range c.windows {
+			if w > 0 && (limit == 0 || w < limit) {
+				limit = w
+			}
+		}
+	}
+	c.idGen.setLimit(limit)
+}
+
+// ackedBy reports whether the packet with id should be completed
+// after acknowledged by server, always true if not ConnFanOut
+func (c *client) ackedBy(id uint16, server string) bool {
+	if c.fanOut == nil {
+		return true
+	}
+	return c.fanOut.acked(id, server)
+}
+
+// completeAcked completes the packet acknowledged by all the servers
+// waited for, when the last server waited for disconnected (ConnFanOut)
+func (c *client) completeAcked(id uint16) {
+	extra, ok := c.idGen.getExtra(id)
+	if !ok {
+		return
+	}
+
+	switch p := extra.(type) {
+	case *PublishPacket:
+		c.notify(newPubMsg(p.TopicName, nil))
+	case *pubReleased:
+		c.notify(newPubMsg(p.pub.TopicName, nil))
+	}
+	c.completeToken(id, nil, nil)
+	c.idGen.free(id)
+
+	if err := c.persist.Delete(sendKey(id)); err != nil {
+		c.notify(newPersistMsg(err))
+	}
+}
+
+// sentThrough records the server the packet with id was sent through
+func (c *client) sentThrough(id uint16, server string) {
+	c.sentLock.Lock()
+	c.sentBy[id] = server
+	c.sentLock.Unlock()
+}
+
+// claimResend reports whether the in-flight packet with id should be
+// resent through server, packets sent through another live connection
+// are left to it, with ConnFanOut, packets are resent to the servers
+// not acknowledged them
+func (c *client) claimResend(id uint16, server string) bool {
+	if c.fanOut != nil {
+		return c.fanOut.waiting(id, server)
+	}
+
+	c.sentLock.Lock()
+	defer c.sentLock.Unlock()
+
+	if owner, ok := c.sentBy[id]; ok && owner != server && c.State(owner) == StateConnected {
+		return false
+	}
+	c.sentBy[id] = server
+	return true
+}
+
+// trackSubs record the topics acknowledged by server with granted QoS,
+// failed ones are removed
+func (c *client) trackSubs(topics []*Topic) {
+	for _, t := range topics {
+		if t.Qos >= SubFail {
+			c.subs.Delete(t.Name)
+			continue
+		}
+
+		granted := *t
+		c.subs.Store(t.Name, &granted)
+	}
+}
+
+// enqueue the packet to send, the packet is released if ctx done before that
+func (c *client) enqueue(ctx context.Context, key interface{}, p Packet) {
+	id, hasID := key.(uint16)
+	if hasID {
+		// not sent, skip it when resuming session
+		c.queued.Store(id, true)
+	}
+
+	c.enqueuing.RLock()
+	err := ErrClientClosed
+	select {
+	case <-c.closingC:
+	default:
+		if err = ctx.Err(); err == nil {
+			select {
+			case c.sendC <- p:
+				c.enqueuing.RUnlock()
+				c.metrics.QueueDepth("send", len(c.sendC))
+				return
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-c.closingC:
+				err = ErrClientClosed
+			}
+		}
+	}
+	c.enqueuing.RUnlock()
+	c.release(key, p, err)
+}
+
+// release the packet canceled before sent, and complete the token with err
+func (c *client) release(key interface{}, p Packet, err error) {
+	c.log.d("CLIENT packet canceled before sent", "packet_type", p.Type(), "err", err)
+	if id, hasID := key.(uint16); hasID {
+		c.queued.Delete(id)
+		c.idGen.free(id)
+		if err := c.persist.Delete(sendKey(id)); err != nil {
+			c.notify(newPersistMsg(err))
+		}
+	}
+	c.completeToken(key, nil, err)
+}
+
+// ReAuth start re-authentication on all connections
+func (c *client) ReAuth() {
+	c.log.d("CLIENT re-authenticate")
+	c.conn.Range(func(k, v interface{}) bool {
+		va := v.(*connImpl)
+		if err := va.reAuth(); err != nil {
+			va.log.e("CLIENT re-authentication failed", "err", err)
+			c.notify(newNetMsg(va.name, err))
+		}
+		return true
+	})
 }
 
 // Wait will wait for all connection to exit
 func (c *client) Wait() {
-	lg.i("CLIENT wait for all connections")
+	c.log.i("CLIENT wait for all connections")
 	c.workers.Wait()
 }
 
-// Destroy will disconnect form all server
+// Destroy will disconnect form all server and stop reconnecting
 // If force is true, then close connection without sending a DisConnPacket
+// Packets queued are not handled, use Shutdown to drain them and release
+// all resources of the client
 func (c *client) Destroy(force bool) {
-	lg.d("CLIENT destroying client with force =", force)
-	// TODO close all channel properly
-	c.options.backoffFactor = -1
+	c.log.d("CLIENT destroying client", "force", force)
+	c.stop()
+	for _, s := range c.options.servers {
+		c.setState(s, StateClosed, nil)
+	}
+
 	if force {
 		c.conn.Range(func(k, v interface{}) bool {
 			va := v.(*connImpl)
@@ -452,79 +1075,294 @@ func (c *client) Destroy(force bool) {
 
 // HandlePubMsg register handler for pub error
 func (c *client) HandlePub(h PubHandler) {
-	lg.d("CLIENT registered pub handler")
+	c.log.d("CLIENT registered pub handler")
 	c.pH = h
 }
 
 // HandleSubMsg register handler for extra sub info
 func (c *client) HandleSub(h SubHandler) {
-	lg.d("CLIENT registered sub handler")
+	c.log.d("CLIENT registered sub handler")
 	c.sH = h
 }
 
 // HandleUnSubMsg register handler for unsubscription error
 func (c *client) HandleUnSub(h UnSubHandler) {
-	lg.d("CLIENT registered unsub handler")
+	c.log.d("CLIENT registered unsub handler")
 	c.uH = h
 }
 
 // HandleNet register handler for net error
 func (c *client) HandleNet(h NetHandler) {
-	lg.d("CLIENT registered net handler")
+	c.log.d("CLIENT registered net handler")
 	c.nH = h
 }
 
 // HandleNet register handler for net error
 func (c *client) HandlePersist(h PersistHandler) {
-	lg.d("CLIENT registered persist handler")
+	c.log.d("CLIENT registered persist handler")
 	c.psH = h
 }
 
-// connect to one server and start mqtt logic
-func (c *client) connect(server string, h ConnHandler, reconnectDelay time.Duration) {
-	defer c.workers.Done()
-	var conn net.Conn
-	var err error
+// dialServer dial the server with dial timeout, using the custom dialer if set,
+// the server can be "host:port" for TCP connection, or an url with scheme
+// "tcp", "unix", "ws" (WebSocket) or "wss" (WebSocket over TLS)
+func (c *client) dialServer(server string) (net.Conn, error) {
+	ctx := context.Background()
+	if c.options.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.dialTimeout)
+		defer cancel()
+	}
 
-	if c.options.tlsConfig != nil {
-		// with tls
-		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: c.options.dialTimeout}, "tcp", server, c.options.tlsConfig)
+	if c.options.dialer != nil {
+		return c.options.dialer(ctx, server)
+	}
+	return c.dial(ctx, server)
+}
+
+// dial the server with the scheme of server address
+func (c *client) dial(ctx context.Context, server string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if c.options.netDialer != nil {
+		*dialer = *c.options.netDialer
+	}
+
+	if !strings.Contains(server, "://") {
+		return c.dialTCP(ctx, dialer, server)
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return c.dialTCP(ctx, dialer, u.Host)
+	case "unix":
+		// unix:///path/to/socket or unix://relative/path
+		return dialer.DialContext(ctx, "unix", u.Host+u.Path)
+	case "ws", "wss":
+		dial, err := c.netDial(dialer, u.Scheme, wsHost(u))
 		if err != nil {
-			lg.e("CLIENT connect with tls failed, err =", err, "server =", server)
-			if h != nil {
-				h(server, math.MaxUint8, err)
-			}
-			return
+			return nil, err
 		}
-	} else {
-		// without tls
-		conn, err = net.DialTimeout("tcp", server, c.options.dialTimeout)
-		if err != nil {
-			lg.e("CLIENT connect failed, err =", err, "server =", server)
-			if h != nil {
-				h(server, math.MaxUint8, err)
+		var config *tls.Config
+		if u.Scheme == "wss" {
+			if config, err = c.loadTLSConfig(); err != nil {
+				return nil, err
 			}
-			return
 		}
+		return dialWebSocket(ctx, u, dial, config, c.options.wsHeader)
+	default:
+		return nil, ErrUnsupportedScheme
 	}
+}
 
-	connImpl := &connImpl{
-		parent:     c,
-		name:       server,
-		conn:       conn,
-		connW:      bufio.NewWriter(conn),
-		clientBuf:  &bytes.Buffer{},
-		sendBuf:    &bytes.Buffer{},
-		keepaliveC: make(chan int),
-		logicSendC: make(chan Packet),
-		netRecvC:   make(chan Packet),
+// loadTLSConfig returns tls config for new connection,
+// with client certificate loaded by certLoader
+func (c *client) loadTLSConfig() (*tls.Config, error) {
+	config := c.options.tlsConfig
+	if c.options.certLoader == nil {
+		return config, nil
 	}
 
-	go connImpl.handleLogicSend()
+	cert, err := c.options.certLoader()
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.Certificates = []tls.Certificate{*cert}
+	return config, nil
+}
+
+// dialTCP dial to server with tcp, tls will be used if configured
+func (c *client) dialTCP(ctx context.Context, dialer *net.Dialer, addr string) (net.Conn, error) {
+	if c.options.tlsConfig != nil {
+		// with tls
+		dial, err := c.netDial(dialer, "tls", addr)
+		if err != nil {
+			return nil, err
+		}
+		config, err := c.loadTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		return dialTLS(ctx, dial, addr, config)
+	}
+
+	// without tls
+	dial, err := c.netDial(dialer, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return dial(ctx, "tcp", addr)
+}
+
+// connect to one server and reconnect according to the strategy and
+// reconnect policy, attempt is the number of reconnects in a row,
+// last is the delay before this connect
+func (c *client) connect(server string, h ConnHandler, version ProtocolLevel, attempt int, last time.Duration) {
+	defer c.workers.Done()
+	if c.stopped() {
+		return
+	}
+
+	result, connected := c.connectServer(server, h, version)
+	if c.stopped() {
+		return
+	}
+
+	switch result {
+	case connFallback:
+		// server refused MQTT 5, fallback to MQTT 3.1.1
+		c.workers.Add(1)
+		go c.connect(server, h, V311, attempt, last)
+		return
+	case connLost:
+		if connected >= c.options.reconnect.ResetAfter() {
+			attempt, last = 0, 0
+		}
+	}
+
+	next, tried := c.nextServer(server, result == connLost)
+	if next != server {
+		version = c.options.protoVersion
+	}
+
+	if !tried {
+		// try next server immediately
+		c.workers.Add(1)
+		go c.connect(next, h, version, attempt, last)
+		return
+	}
+
+	attempt++
+	delay, ok := c.options.reconnect.Next(attempt, last)
+	if !ok {
+		c.log.w("CLIENT stop reconnecting", "server", next, "attempts", attempt-1)
+		return
+	}
+
+	c.workers.Add(1)
+	c.setState(next, StateReconnecting, nil)
+	c.log.w("CLIENT reconnecting", "server", next, "delay", delay, "attempt", attempt)
+	c.metrics.Reconnect(next)
+	go func() {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-c.stopC:
+		}
+		c.connect(next, h, version, attempt, delay)
+	}()
+}
+
+type connResult int
+
+const (
+	connFailed   connResult = iota // failed to connect
+	connLost                       // connected, then the connection lost
+	connFallback                   // connecting with another protocol version
+)
+
+// connectServer connect to one server and start mqtt logic, returns
+// after connection failed or lost, with the duration of connected
+func (c *client) connectServer(server string, h ConnHandler, version ProtocolLevel) (connResult, time.Duration) {
+	// notify the failure to ConnHandler and state subscribers,
+	// the connection is aborted if dialed
+	var dialed *connImpl
+	failed := func(code ConnAckCode, err error) (connResult, time.Duration) {
+		if dialed != nil {
+			dialed.abort()
+		}
+
+		if h != nil {
+			h(server, code, err)
+		}
+		if err == nil {
+			err = &ConnRefusedError{Code: code}
+		}
+		c.setState(server, StateDisconnected, err)
+		return connFailed, 0
+	}
+
+	c.setState(server, StateDialing, nil)
+	conn, err := c.dialServer(server)
+	if err != nil {
+		c.log.e("CLIENT connect failed", "server", server, "err", err)
+		return failed(math.MaxUint8, err)
+	}
+	c.setState(server, StateConnecting, nil)
+
+	connImpl := &connImpl{
+		parent:       c,
+		name:         server,
+		protoVersion: version,
+		conn:         conn,
+		connW:        bufio.NewWriter(conn),
+		clientBuf:    &bytes.Buffer{},
+		sendBuf:      &bytes.Buffer{},
+		keepaliveC:   make(chan int),
+		logicSendC:   make(chan Packet),
+		netRecvC:     make(chan Packet),
+		exitC:        make(chan struct{}),
+		log:          c.log.with("server", server),
+		decoder: &Decoder{
+			Version:       version,
+			Strict:        c.options.strictDecode,
+			MaxPacketSize: c.options.maxPacketSize,
+		},
+	}
+
+	if c.fanOut != nil {
+		connImpl.clientSendC = make(chan Packet, c.options.sendChanSize)
+	}
+
+	connImpl.sendChain = chainInterceptors(c.options.sendInterceptors, connImpl.writePacket)
+	connImpl.recvChain = chainInterceptors(c.options.recvInterceptors, connImpl.dispatch)
+
+	go connImpl.handleLogicSend()
 	go connImpl.handleRecv()
-	go connImpl.handleClientSend()
+	dialed = connImpl
+
+	connProps := c.options.connProps
+	if version == V5 && c.options.authenticator != nil {
+		// start enhanced authentication
+		data, err := c.options.authenticator.InitialData()
+		if err != nil {
+			c.log.e("CLIENT get initial auth data failed", "server", server, "err", err)
+			return failed(math.MaxUint8, err)
+		}
+
+		props := ConnProps{}
+		if connProps != nil {
+			props = *connProps
+		}
+		props.AuthMethod = c.options.authenticator.Method()
+		props.AuthData = data
+		connProps = &props
+	}
+
+	if version == V5 && c.options.maxPacketSize > 0 &&
+		(connProps == nil || connProps.MaxPacketSize == 0) {
+		// tell server the packet size limit
+		props := ConnProps{}
+		if connProps != nil {
+			props = *connProps
+		}
+		props.MaxPacketSize = uint32(c.options.maxPacketSize)
+		connProps = &props
+	}
 
 	connImpl.send(&ConnPacket{
+		BasePacket:   BasePacket{ProtoVersion: version},
 		Username:     c.options.username,
 		Password:     c.options.password,
 		ClientID:     c.options.clientID,
@@ -535,73 +1373,123 @@ func (c *client) connect(server string, h ConnHandler, reconnectDelay time.Durat
 		WillMessage:  c.options.willPayload,
 		WillRetain:   c.options.willRetain,
 		Keepalive:    uint16(c.options.keepalive / time.Second),
+		Props:        connProps,
+		WillProps:    c.options.willProps,
 	})
 
-	select {
-	case pkt, more := <-connImpl.netRecvC:
-		if more {
-			if pkt.Type() == CtrlConnAck {
-				p := pkt.(*ConnAckPacket)
-				if p.Code != ConnAccepted {
-					if h != nil {
-						h(server, p.Code, nil)
-					}
-					return
+	var connAck *ConnAckPacket
+	timeout := time.After(c.options.dialTimeout)
+	for connAck == nil {
+		select {
+		case pkt, more := <-connImpl.netRecvC:
+			if !more {
+				return failed(math.MaxUint8, ErrBadPacket)
+			}
+
+			switch pkt.Type() {
+			case CtrlConnAck:
+				connAck = pkt.(*ConnAckPacket)
+			case CtrlAuth:
+				// enhanced authentication in progress
+				if err := connImpl.handleAuth(pkt.(*AuthPacket)); err != nil {
+					c.log.e("CLIENT authentication failed", "server", server, "err", err)
+					return failed(math.MaxUint8, err)
 				}
-			} else {
-				if h != nil {
-					h(server, math.MaxUint8, ErrBadPacket)
+				continue
+			default:
+				return failed(math.MaxUint8, ErrBadPacket)
+			}
+
+			if connAck.Code != ConnAccepted {
+				if version == V5 && c.options.protoCompromise &&
+					(connAck.Code == ConnBadProtocol || connAck.Code == CodeUnsupportedProtoVersion) {
+					// server refused MQTT 5, fallback to MQTT 3.1.1
+					c.log.w("CLIENT server refused MQTT 5, fallback to V311", "server", server)
+					connImpl.abort()
+					return connFallback, 0
 				}
-				return
+
+				return failed(connAck.Code, nil)
 			}
-		} else {
-			if h != nil {
-				h(server, math.MaxUint8, ErrBadPacket)
+
+			if version == V5 && c.options.authenticator != nil {
+				// verify server final authentication data
+				var authPkt = &AuthPacket{Code: CodeSuccess}
+				if connAck.Props != nil {
+					authPkt.Props = &AuthProps{
+						AuthMethod: connAck.Props.AuthMethod,
+						AuthData:   connAck.Props.AuthData,
+					}
+				}
+
+				if err := connImpl.handleAuth(authPkt); err != nil {
+					c.log.e("CLIENT authentication failed", "server", server, "err", err)
+					// written before the connection aborted
+					connImpl.write(NewDisConnPacket(CodeNotAuthorized, nil))
+					return failed(math.MaxUint8, err)
+				}
 			}
-			return
-		}
-	case <-time.After(c.options.dialTimeout):
-		if h != nil {
-			h(server, math.MaxUint8, ErrTimeOut)
+		case <-timeout:
+			return failed(math.MaxUint8, ErrTimeOut)
 		}
-		return
 	}
 
-	lg.i("CLIENT connected server =", server)
+	c.log.i("CLIENT connected", "server", server, "session_present", connAck.Present)
+	c.setWindow(server, c.inFlightWindow(connAck), true)
+
+	// resend in-flight packets before any new client packet
+	connImpl.resume(connAck.Present)
+	if !connAck.Present {
+		connImpl.resubscribe()
+	}
+	go connImpl.handleClientSend()
+
 	if h != nil {
 		go h(server, ConnAccepted, nil)
 	}
 
 	// login success, start mqtt logic
+	connectedAt := time.Now()
 	c.conn.Store(server, connImpl)
+	if c.fanOut != nil {
+		c.fanOut.add(connImpl)
+	}
+	c.setState(server, StateConnected, nil)
+
 	connImpl.logic()
 
-	if c.options.backoffFactor > 1 {
-		c.workers.Add(1)
-		lg.w("CLIENT reconnecting to server =", server, "delay =", reconnectDelay)
-		go func() {
-			time.Sleep(reconnectDelay)
-			reconnectDelay = time.Duration(float64(reconnectDelay) * c.options.backoffFactor)
-			if reconnectDelay > c.options.maxDelay {
-				reconnectDelay = c.options.maxDelay
-			}
-			c.connect(server, h, reconnectDelay)
-		}()
+	if c.fanOut != nil {
+		for _, id := range c.fanOut.remove(connImpl) {
+			c.completeAcked(id)
+		}
 	}
+	c.conn.CompareAndDelete(server, connImpl)
+	c.setWindow(server, 0, false)
+	c.setState(server, StateDisconnected, connImpl.err)
+	return connLost, time.Since(connectedAt)
 }
 
 // connImpl is the wrapper of connection to server
 // tend to actual packet send and receive
 type connImpl struct {
-	parent     *client       // client which created this connection
-	name       string        // server addr info
-	conn       net.Conn      // connection to server
-	connW      *bufio.Writer // make buffered connection
-	sendBuf    *bytes.Buffer // buffer for logic packet send
-	clientBuf  *bytes.Buffer // buffer for client packet send
-	logicSendC chan Packet   // logic send channel
-	netRecvC   chan Packet   // received packet from server
-	keepaliveC chan int      // keepalive packet
+	parent       *client       // client which created this connection
+	name         string        // server addr info
+	protoVersion ProtocolLevel // MQTT protocol version used in this connection
+	conn         net.Conn      // connection to server
+	connW        *bufio.Writer // make buffered connection
+	writeLock    sync.Mutex    // lock for connW
+	sendBuf      *bytes.Buffer // buffer for logic packet send
+	clientBuf    *bytes.Buffer // buffer for client packet send
+	logicSendC   chan Packet   // logic send channel
+	netRecvC     chan Packet   // received packet from server
+	keepaliveC   chan int      // keepalive packet
+	exitC        chan struct{} // closed when connection broken
+	err          error         // error caused connection broken, set before exitC closed
+	clientSendC  chan Packet   // client packets for this connection (ConnFanOut)
+	decoder      *Decoder      // decoder for packets received
+	log          *fieldLogger  // logger with server field
+	sendChain    PacketHandler // send interceptors chained with writePacket
+	recvChain    PacketHandler // recv interceptors chained with dispatch
 }
 
 // start mqtt logic
@@ -616,7 +1504,10 @@ func (c *connImpl) logic() {
 		switch pkt.Type() {
 		case CtrlSubAck:
 			p := pkt.(*SubAckPacket)
-			lg.d("NET received SubAck, id =", p.PacketID)
+			c.log.d("NET received SubAck", "packet_id", p.PacketID)
+			if !c.parent.ackedBy(p.PacketID, c.name) {
+				break
+			}
 
 			if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 				switch originPkt.(type) {
@@ -628,133 +1519,363 @@ func (c *connImpl) logic() {
 							v.Qos = p.Codes[i]
 						}
 					}
-					c.parent.msgC <- newSubMsg(originSub.Topics, nil)
+					c.parent.trackSubs(originSub.Topics)
+					c.parent.notify(newSubMsg(originSub.Topics, nil))
+					c.parent.completeToken(p.PacketID, p.Codes, nil)
 					c.parent.idGen.free(p.PacketID)
 
 					if err := c.parent.persist.Delete(sendKey(p.PacketID)); err != nil {
-						c.parent.msgC <- newPersistMsg(err)
+						c.parent.notify(newPersistMsg(err))
 					}
 				}
 			}
 		case CtrlUnSubAck:
 			p := pkt.(*UnSubAckPacket)
-			lg.d("NET received UnSubAck, id =", p.PacketID)
+			c.log.d("NET received UnSubAck", "packet_id", p.PacketID)
+			if !c.parent.ackedBy(p.PacketID, c.name) {
+				break
+			}
 
 			if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 				switch originPkt.(type) {
 				case *UnSubPacket:
 					originUnSub := originPkt.(*UnSubPacket)
-					c.parent.msgC <- newUnSubMsg(originUnSub.TopicNames, nil)
+					c.parent.notify(newUnSubMsg(originUnSub.TopicNames, nil))
+					c.parent.completeToken(p.PacketID, p.Codes, nil)
 					c.parent.idGen.free(p.PacketID)
 
 					if err := c.parent.persist.Delete(sendKey(p.PacketID)); err != nil {
-						c.parent.msgC <- newPersistMsg(err)
+						c.parent.notify(newPersistMsg(err))
 					}
 				}
 			}
 		case CtrlPublish:
 			p := pkt.(*PublishPacket)
-			lg.d("NET received publish, id =", p.PacketID, "QoS =", p.Qos)
+			c.log.d("NET received Publish", "packet_id", p.PacketID, "topic", p.TopicName, "qos", p.Qos)
 			// received server publish, send to client
-			c.parent.recvC <- p
+			c.parent.recvC <- c.received(p)
+			c.parent.metrics.QueueDepth("recv", len(c.parent.recvC))
 
 			// tend to QoS
-			switch p.Qos {
-			case Qos1:
-				lg.d("NET send PubAck for Publish, id =", p.PacketID)
-				c.send(&PubAckPacket{PacketID: p.PacketID})
-
-				if err := c.parent.persist.Store(recvKey(p.PacketID), pkt); err != nil {
-					c.parent.msgC <- newPersistMsg(err)
-				}
-			case Qos2:
-				lg.d("NET send PubRecv for Publish, id =", p.PacketID)
-				c.send(&PubRecvPacket{PacketID: p.PacketID})
-
-				if err := c.parent.persist.Store(recvKey(p.PacketID), pkt); err != nil {
-					c.parent.msgC <- newPersistMsg(err)
-				}
+			if !c.parent.options.manualAck {
+				c.ackPublish(p)
 			}
 		case CtrlPubAck:
 			p := pkt.(*PubAckPacket)
-			lg.d("NET received PubAck, id =", p.PacketID)
+			c.log.d("NET received PubAck", "packet_id", p.PacketID)
+			if !c.parent.ackedBy(p.PacketID, c.name) {
+				break
+			}
 
 			if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 				switch originPkt.(type) {
 				case *PublishPacket:
 					originPub := originPkt.(*PublishPacket)
 					if originPub.Qos == Qos1 {
-						c.parent.msgC <- newPubMsg(originPub.TopicName, nil)
+						err := ackErr(p.Code)
+						c.parent.notify(newPubMsg(originPub.TopicName, err))
+						c.parent.completeToken(p.PacketID, []ReasonCode{p.Code}, err)
 						c.parent.idGen.free(p.PacketID)
 
 						if err := c.parent.persist.Delete(sendKey(p.PacketID)); err != nil {
-							c.parent.msgC <- newPersistMsg(err)
+							c.parent.notify(newPersistMsg(err))
 						}
 					}
 				}
 			}
 		case CtrlPubRecv:
 			p := pkt.(*PubRecvPacket)
-			lg.d("NET received PubRec, id =", p.PacketID)
+			c.log.d("NET received PubRec", "packet_id", p.PacketID)
 
 			if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
-				switch originPkt.(type) {
-				case *PublishPacket:
-					originPub := originPkt.(*PublishPacket)
-					if originPub.Qos == Qos2 {
-						c.send(&PubRelPacket{PacketID: p.PacketID})
-						lg.d("NET send PubRel, id =", p.PacketID)
+				if err := ackErr(p.Code); err != nil {
+					// publish refused by server, no PUBREL should be sent
+					if !c.parent.ackedBy(p.PacketID, c.name) {
+						break
 					}
+					if originPub, ok := originPkt.(*PublishPacket); ok {
+						c.parent.notify(newPubMsg(originPub.TopicName, err))
+					}
+					c.parent.completeToken(p.PacketID, []ReasonCode{p.Code}, err)
+					c.parent.idGen.free(p.PacketID)
+
+					if err := c.parent.persist.Delete(sendKey(p.PacketID)); err != nil {
+						c.parent.notify(newPersistMsg(err))
+					}
+					break
 				}
-			}
-		case CtrlPubRel:
-			p := pkt.(*PubRelPacket)
-			lg.d("NET send PubRel, id =", p.PacketID)
 
-			if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 				switch originPkt.(type) {
 				case *PublishPacket:
 					originPub := originPkt.(*PublishPacket)
 					if originPub.Qos == Qos2 {
-						c.send(&PubCompPacket{PacketID: p.PacketID})
-						lg.d("NET send PubComp, id =", p.PacketID)
-
-						if err := c.parent.persist.Store(recvKey(p.PacketID), pkt); err != nil {
-							c.parent.msgC <- newPersistMsg(err)
-						}
+						// PUBREL is resent instead of publish after reconnected
+						rel := &PubRelPacket{PacketID: p.PacketID}
+						c.parent.idGen.replace(p.PacketID, originPub, &pubReleased{rel: rel, pub: originPub})
+						c.send(rel)
+						c.log.d("NET send PubRel", "packet_id", p.PacketID)
 					}
+				case *pubReleased:
+					// PUBREC of PUBREL resent, or of another server (ConnFanOut)
+					c.send(&PubRelPacket{PacketID: p.PacketID})
+					c.log.d("NET send PubRel", "packet_id", p.PacketID)
+				case *PubRelPacket:
+					// resumed from persisted session
+					c.send(&PubRelPacket{PacketID: p.PacketID})
+					c.log.d("NET send PubRel", "packet_id", p.PacketID)
 				}
 			}
+		case CtrlPubRel:
+			p := pkt.(*PubRelPacket)
+			c.log.d("NET received PubRel", "packet_id", p.PacketID)
+
+			// packet id of received packets is allocated by server
+			c.send(&PubCompPacket{PacketID: p.PacketID})
+			c.log.d("NET send PubComp", "packet_id", p.PacketID)
 		case CtrlPubComp:
 			p := pkt.(*PubCompPacket)
-			lg.d("NET received PubComp, id =", p.PacketID)
+			c.log.d("NET received PubComp", "packet_id", p.PacketID)
+			if !c.parent.ackedBy(p.PacketID, c.name) {
+				break
+			}
 
 			if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
 				switch originPkt.(type) {
 				case *PublishPacket:
 					originPub := originPkt.(*PublishPacket)
 					if originPub.Qos == Qos2 {
-						c.send(&PubRelPacket{PacketID: p.PacketID})
-						lg.d("NET send PubRel, id =", p.PacketID)
-
-						c.parent.msgC <- newPubMsg(originPub.TopicName, nil)
+						err := ackErr(p.Code)
+						c.parent.notify(newPubMsg(originPub.TopicName, err))
+						c.parent.completeToken(p.PacketID, []ReasonCode{p.Code}, err)
 						c.parent.idGen.free(p.PacketID)
 
 						if err := c.parent.persist.Delete(sendKey(p.PacketID)); err != nil {
-							c.parent.msgC <- newPersistMsg(err)
+							c.parent.notify(newPersistMsg(err))
 						}
 					}
+				case *pubReleased:
+					err := ackErr(p.Code)
+					c.parent.notify(newPubMsg(originPkt.(*pubReleased).pub.TopicName, err))
+					c.parent.completeToken(p.PacketID, []ReasonCode{p.Code}, err)
+					c.parent.idGen.free(p.PacketID)
+
+					if err := c.parent.persist.Delete(sendKey(p.PacketID)); err != nil {
+						c.parent.notify(newPersistMsg(err))
+					}
+				case *PubRelPacket:
+					// resumed from persisted session, origin publish unknown
+					c.parent.completeToken(p.PacketID, []ReasonCode{p.Code}, ackErr(p.Code))
+					c.parent.idGen.free(p.PacketID)
+
+					if err := c.parent.persist.Delete(sendKey(p.PacketID)); err != nil {
+						c.parent.notify(newPersistMsg(err))
+					}
 				}
 			}
+		case CtrlAuth:
+			p := pkt.(*AuthPacket)
+			c.log.d("NET received Auth", "code", p.Code)
+
+			if err := c.handleAuth(p); err != nil {
+				c.log.e("NET re-authentication failed", "err", err)
+				c.parent.notify(newNetMsg(c.name, err))
+				c.send(NewDisConnPacket(CodeNotAuthorized, nil))
+			}
 		default:
-			lg.d("NET received packet, type =", pkt.Type())
+			c.log.d("NET received packet", "packet_type", pkt.Type())
+		}
+	}
+}
+
+// handleAuth tend to the authentication data sent by server
+func (c *connImpl) handleAuth(p *AuthPacket) error {
+	a := c.parent.options.authenticator
+	if a == nil {
+		return ErrBadAuthMethod
+	}
+
+	var data []byte
+	if p.Props != nil {
+		if p.Props.AuthMethod != a.Method() {
+			return ErrBadAuthMethod
+		}
+		data = p.Props.AuthData
+	}
+
+	switch p.Code {
+	case CodeContinueAuth:
+		resp, err := a.Challenge(p.Code, data)
+		if err != nil {
+			return err
 		}
+
+		c.send(&AuthPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			Code:       CodeContinueAuth,
+			Props:      &AuthProps{AuthMethod: a.Method(), AuthData: resp},
+		})
+	case CodeSuccess:
+		_, err := a.Challenge(p.Code, data)
+		return err
+	default:
+		return ErrAuthFailed
+	}
+
+	return nil
+}
+
+// reAuth start a re-authentication with server
+func (c *connImpl) reAuth() error {
+	a := c.parent.options.authenticator
+	if a == nil || c.protoVersion != V5 {
+		return nil
+	}
+
+	data, err := a.InitialData()
+	if err != nil {
+		return err
+	}
+
+	c.send(&AuthPacket{
+		BasePacket: BasePacket{ProtoVersion: V5},
+		Code:       CodeReAuth,
+		Props:      &AuthProps{AuthMethod: a.Method(), AuthData: data},
+	})
+	return nil
+}
+
+// resume the in-flight session state after connected, PUBLISH packets
+// are resent with DUP flag set and PUBREL packets are resent only if the
+// server still has the session, resend in the order of packet id
+func (c *connImpl) resume(sessionPresent bool) {
+	inflight := make(map[uint16]Packet)
+	c.parent.persist.Range(func(key string, p Packet) bool {
+		isSend, id, ok := parsePersistKey(key)
+		if !ok {
+			return true
+		}
+
+		if isSend {
+			inflight[id] = p
+		} else if !sessionPresent {
+			// server discarded the session, so as the packets it sent
+			if err := c.parent.persist.Delete(key); err != nil {
+				c.parent.notify(newPersistMsg(err))
+			}
+		}
+		return true
+	})
+
+	// packets sent without persist
+	c.parent.idGen.usedIds.Range(func(k, v interface{}) bool {
+		id := k.(uint16)
+		if inflight[id] != nil {
+			return true
+		}
+
+		switch p := v.(type) {
+		case *PublishPacket, *SubscribePacket, *UnSubPacket:
+			inflight[id] = p.(Packet)
+		case *pubReleased:
+			inflight[id] = p.rel
+		}
+		return true
+	})
+
+	ids := make([]int, 0, len(inflight))
+	for id := range inflight {
+		if _, ok := c.parent.queued.Load(id); ok {
+			// will be sent by handleClientSend
+			continue
+		}
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	for _, i := range ids {
+		id := uint16(i)
+		pkt := inflight[id]
+		switch p := pkt.(type) {
+		case *PublishPacket:
+			if p.Qos == Qos0 {
+				c.deletePersisted(id)
+				continue
+			}
+		case *PubRelPacket:
+			if !sessionPresent {
+				// server has received the publish packet, but won't complete it
+				c.parent.completeToken(id, nil, ErrSessionDiscarded)
+				c.parent.idGen.free(id)
+				c.deletePersisted(id)
+				continue
+			}
+		case *SubscribePacket, *UnSubPacket:
+			// not acknowledged, resend as is
+		default:
+			continue
+		}
+
+		if !c.parent.claimResend(id, c.name) {
+			// in-flight in another connection
+			continue
+		}
+
+		c.parent.idGen.use(id, pkt)
+
+		// packets are shared with other connections, resend a copy
+		pkt = shallowCopy(pkt)
+		if p, ok := pkt.(*PublishPacket); ok {
+			p.IsDup = sessionPresent
+		}
+
+		c.log.d("NET resend packet", "packet_type", pkt.Type(), "packet_id", id)
+		if err := c.write(pkt); err != nil {
+			c.log.e("NET resend packet failed", "err", err)
+			return
+		}
+	}
+}
+
+// resubscribe replay the tracked subscriptions when server has no session
+// for this client, results are reported through SubHandler
+func (c *connImpl) resubscribe() {
+	var topics []*Topic
+	c.parent.subs.Range(func(k, v interface{}) bool {
+		t := *v.(*Topic)
+		topics = append(topics, &t)
+		return true
+	})
+	if len(topics) == 0 {
+		return
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+
+	s := &SubscribePacket{Topics: topics}
+	id, err := c.parent.idGen.next(context.Background(), nil, s)
+	if err != nil {
+		c.parent.notify(newSubMsg(topics, err))
+		return
+	}
+
+	s.PacketID = id
+	c.log.i("NET resubscribe", "topics", topics)
+	if err := c.write(s); err != nil {
+		// will resubscribe after reconnected
+		c.parent.idGen.free(s.PacketID)
+		c.parent.notify(newSubMsg(topics, err))
+	}
+}
+
+// deletePersisted delete the persisted in-flight packet with packet id
+func (c *connImpl) deletePersisted(id uint16) {
+	if err := c.parent.persist.Delete(sendKey(id)); err != nil {
+		c.parent.notify(newPersistMsg(err))
 	}
 }
 
 // keepalive with server
 func (c *connImpl) keepalive() {
-	lg.d("NET start keepalive")
+	c.log.d("NET start keepalive")
 
 	t := time.NewTicker(c.parent.options.keepalive * 3 / 4)
 	timeout := time.Duration(float64(c.parent.options.keepalive) * c.parent.options.keepaliveFactor)
@@ -762,6 +1883,7 @@ func (c *connImpl) keepalive() {
 	defer t.Stop()
 
 	for range t.C {
+		sent := time.Now()
 		c.send(PingReqPacket)
 
 		select {
@@ -769,97 +1891,206 @@ func (c *connImpl) keepalive() {
 			if !more {
 				return
 			}
+			c.parent.metrics.KeepaliveRTT(c.name, time.Since(sent))
 			timeoutTimer.Reset(timeout)
 		case <-timeoutTimer.C:
-			lg.i("NET keepalive timeout")
+			c.log.i("NET keepalive timeout")
 			t.Stop()
 			c.conn.Close()
 			return
 		}
 	}
 
-	lg.d("NET stop keepalive")
+	c.log.d("NET stop keepalive")
 }
 
 // close this connection
 func (c *connImpl) close() {
-	lg.i("NET connection to server closed, remote =", c.name)
+	c.log.i("NET connection to server closed")
 	c.send(DisConnPacket)
 }
 
 // handle client message send
 func (c *connImpl) handleClientSend() {
-	for pkt := range c.parent.sendC {
-		if err := pkt.WriteTo(c.connW); err != nil {
-			break
+	sendC := c.parent.sendC
+	if c.clientSendC != nil {
+		sendC = c.clientSendC
+	}
+
+	for {
+		var pkt Packet
+		var more bool
+		select {
+		case pkt, more = <-sendC:
+			if !more {
+				// client shutdown
+				return
+			}
+		case <-c.exitC:
+			return
+		}
+		c.parent.metrics.QueueDepth("send", len(c.parent.sendC))
+
+		// tokens are completed with the origin packet
+		origin := pkt
+		if f, ok := pkt.(*fanOutPacket); ok {
+			pkt, origin = f.Packet, f.origin
+		}
+
+		switch p := pkt.(type) {
+		case *PublishPacket:
+			c.parent.queued.Delete(p.PacketID)
+		case *SubscribePacket:
+			c.parent.queued.Delete(p.PacketID)
+		case *UnSubPacket:
+			c.parent.queued.Delete(p.PacketID)
+		}
+
+		if err := c.write(pkt); err != nil {
+			// packets with packet id will be resent after reconnected
+			c.parent.completeToken(origin, nil, err)
+			return
+		}
+
+		if id, ok := packetID(pkt); ok {
+			c.parent.sentThrough(id, c.name)
 		}
-		c.connW.Flush()
 		switch pkt.Type() {
 		case CtrlPublish:
-			c.parent.msgC <- newPubMsg(pkt.(*PublishPacket).TopicName, nil)
+			c.parent.notify(newPubMsg(pkt.(*PublishPacket).TopicName, nil))
+			if p := pkt.(*PublishPacket); p.Qos == Qos0 {
+				c.parent.completeToken(origin, nil, nil)
+			}
 		case CtrlSubscribe:
-			c.parent.msgC <- newSubMsg(pkt.(*SubscribePacket).Topics, nil)
+			c.parent.notify(newSubMsg(pkt.(*SubscribePacket).Topics, nil))
 		case CtrlUnSub:
-			c.parent.msgC <- newUnSubMsg(pkt.(*UnSubPacket).TopicNames, nil)
+			c.parent.notify(newUnSubMsg(pkt.(*UnSubPacket).TopicNames, nil))
 		}
 	}
-
 }
 
 // handle mqtt logic control packet send
 func (c *connImpl) handleLogicSend() {
-	for logicPkt := range c.logicSendC {
-		if err := logicPkt.WriteTo(c.connW); err != nil {
+	for {
+		var logicPkt Packet
+		select {
+		case logicPkt = <-c.logicSendC:
+		case <-c.exitC:
+			return
+		}
+
+		if err := c.write(logicPkt); err != nil {
 			break
 		}
-		c.connW.Flush()
 		switch logicPkt.Type() {
 		case CtrlPubRel:
 			if err := c.parent.persist.Store(sendKey(logicPkt.(*PubRelPacket).PacketID), logicPkt); err != nil {
-				c.parent.msgC <- newPersistMsg(err)
-			}
-		case CtrlPubAck:
-			if err := c.parent.persist.Delete(sendKey(logicPkt.(*PubAckPacket).PacketID)); err != nil {
-				c.parent.msgC <- newPersistMsg(err)
+				c.parent.notify(newPersistMsg(err))
 			}
 		case CtrlPubComp:
-			if err := c.parent.persist.Delete(sendKey(logicPkt.(*PubCompPacket).PacketID)); err != nil {
-				c.parent.msgC <- newPersistMsg(err)
+			if err := c.parent.persist.Delete(recvKey(logicPkt.(*PubCompPacket).PacketID)); err != nil {
+				c.parent.notify(newPersistMsg(err))
 			}
 		case CtrlDisConn:
 			// disconnect to server
-			lg.i("disconnect to server")
+			c.log.i("NET disconnect to server")
 			c.conn.Close()
 			break
 		}
 	}
 }
 
+// abort the connection not started, packets received are drained
+// until handleRecv exited, handleLogicSend exits after that
+func (c *connImpl) abort() {
+	c.conn.Close()
+	go func() {
+		for range c.netRecvC {
+		}
+	}()
+	go func() {
+		for range c.keepaliveC {
+		}
+	}()
+}
+
 // handle all message receive
 func (c *connImpl) handleRecv() {
 	for {
-		pkt, err := DecodeOnePacket(c.conn)
+		pkt, err := c.decoder.Decode(c.conn)
 		if err != nil {
-			lg.e("NET connection broken, server =", c.name, "err =", err)
+			c.log.e("NET connection broken", "err", err)
+			c.err = err
+			close(c.exitC)
 			close(c.netRecvC)
 			close(c.keepaliveC)
-			// TODO send proper net error to net handler
-			if err != ErrBadPacket {
-				// c.parent.msgC <- newNetMsg(c.name, err)
+			if err != ErrBadPacket && !c.parent.stopped() {
+				c.parent.notify(newNetMsg(c.name, err))
 			}
 			break
 		}
 
-		if pkt == PingRespPacket {
-			lg.d("NET received keepalive message")
-			c.keepaliveC <- 1
-		} else {
-			c.netRecvC <- pkt
+		c.parent.metrics.PacketReceived(c.name, pkt.Type())
+		if err := c.recvChain(c.name, pkt); err != nil {
+			c.log.w("NET received packet dropped by interceptor", "packet_type", pkt.Type(), "err", err)
 		}
 	}
 }
 
+// dispatch the received packet to keepalive or mqtt logic
+func (c *connImpl) dispatch(server string, pkt Packet) error {
+	if pkt == PingRespPacket {
+		c.log.d("NET received keepalive message")
+		c.keepaliveC <- 1
+	} else {
+		c.netRecvC <- pkt
+	}
+	return nil
+}
+
 // send mqtt logic packet
 func (c *connImpl) send(pkt Packet) {
-	c.logicSendC <- pkt
+	select {
+	case c.logicSendC <- pkt:
+	case <-c.exitC:
+	}
+}
+
+// write packet to the connection through send interceptors, interceptors
+// handle a copy, so the packet stored as in-flight is resent as it was
+func (c *connImpl) write(pkt Packet) error {
+	return c.sendChain(c.name, shallowCopy(pkt))
+}
+
+// writePacket to the connection, client packets and logic packets
+// share the same buffered writer
+func (c *connImpl) writePacket(server string, pkt Packet) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.versioned(pkt).WriteTo(c.connW); err != nil {
+		return err
+	}
+	if err := c.connW.Flush(); err != nil {
+		return err
+	}
+
+	c.parent.metrics.PacketSent(c.name, pkt.Type())
+	return nil
+}
+
+// versioned returns the packet to encode with the protocol version of this
+// connection, the packet may be stored as in-flight and shared by
+// connections, so the version is set on a copy
+func (c *connImpl) versioned(pkt Packet) Packet {
+	p, ok := pkt.(versionedPacket)
+	if !ok || p.Version() == c.protoVersion {
+		return pkt
+	}
+
+	cp := shallowCopy(pkt)
+	if v, ok := cp.(versionedPacket); ok && cp != pkt {
+		v.setVersion(c.protoVersion)
+	}
+	return cp
 }
@@ -17,9 +17,25 @@
 package libmqtt
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // test with emqttd server (http://emqtt.io/ or https://github.com/emqtt/emqttd)
@@ -305,3 +321,310 @@ func TestClient_UnSubscribe(t *testing.T) {
 //	})
 //	c.Wait()
 //}
+
+// testConnAck reads the ConnPacket and accepts it
+func testConnAck(conn net.Conn) bool {
+	pkt, err := DecodeOnePacket(conn)
+	if _, ok := pkt.(*ConnPacket); err != nil || !ok {
+		conn.Close()
+		return false
+	}
+	testWritePacket(conn, &ConnAckPacket{})
+	return true
+}
+
+func TestWithDialer(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	go testConnAck(serverSide)
+
+	dialed := make(chan string, 1)
+	c, err := NewClient(
+		WithServer("pipe://server"),
+		WithKeepalive(0, 1.2),
+		WithDialer(func(ctx context.Context, server string) (net.Conn, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Log("dial timeout not applied")
+				t.Fail()
+			}
+			dialed <- server
+			return clientSide, nil
+		}),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	connected := make(chan ConnAckCode, 1)
+	c.Connect(func(server string, code ConnAckCode, err error) {
+		connected <- code
+	})
+
+	select {
+	case code := <-connected:
+		if code != CodeSuccess || <-dialed != "pipe://server" {
+			t.Log("unexpected connect result, code =", code)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("not connected")
+		t.Fail()
+	}
+	c.Destroy(true)
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libmqtt")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "mqtt.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if testConnAck(conn) {
+			DecodeOnePacket(conn)
+		}
+	}()
+
+	c, err := NewClient(
+		WithServer("unix://"+sock),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithNetDialer(&net.Dialer{}),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	connected := make(chan error, 1)
+	c.Connect(func(server string, code ConnAckCode, err error) {
+		connected <- err
+	})
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("not connected")
+		t.Fail()
+	}
+	c.Destroy(true)
+}
+
+// testCert creates a certificate signed by parent (self-signed if nil)
+func testCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) ([]byte, []byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		cert, key
+}
+
+// testTLSServer accepts TLS connections with client certificates,
+// sends the common name of client certificate and negotiated
+// protocol to ch, then closes the connection after ConnAck
+func testTLSServer(t *testing.T, caPEM []byte, ca *x509.Certificate, caKey *ecdsa.PrivateKey, ch chan<- string) net.Listener {
+	certPEM, keyPEM, _, _ := testCert(t, "server", false, ca, caKey)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		NextProtos:   []string{"mqtt"},
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				continue
+			}
+
+			state := tlsConn.ConnectionState()
+			ch <- state.PeerCertificates[0].Subject.CommonName + " " + state.NegotiatedProtocol
+			testConnAck(conn)
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestWithTLSPEM(t *testing.T) {
+	caPEM, _, ca, caKey := testCert(t, "ca", true, nil, nil)
+	certPEM, keyPEM, _, _ := testCert(t, "client", false, ca, caKey)
+
+	ch := make(chan string, 4)
+	l := testTLSServer(t, caPEM, ca, caKey, ch)
+	defer l.Close()
+
+	if _, err := NewClient(WithServer(l.Addr().String()), WithTLSPEM(nil, nil, []byte("bad"), "", false)); err != ErrBadCACert {
+		t.Log("unexpected error =", err)
+		t.Fail()
+	}
+
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithTLSPEM(certPEM, keyPEM, caPEM, "", false),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	c.Connect(nil)
+
+	select {
+	case s := <-ch:
+		if s != "client " {
+			t.Log("unexpected client cert =", s)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("not connected")
+		t.Fail()
+	}
+	c.Destroy(true)
+}
+
+func TestWithTLSCertLoader(t *testing.T) {
+	caPEM, _, ca, caKey := testCert(t, "ca", true, nil, nil)
+
+	ch := make(chan string, 4)
+	l := testTLSServer(t, caPEM, ca, caKey, ch)
+	defer l.Close()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	// rotate client certificate for every connect
+	var loaded int32
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 2),
+		WithTLSConfig(&tls.Config{RootCAs: pool, NextProtos: []string{"mqtt"}}),
+		WithTLSCertLoader(func() (*tls.Certificate, error) {
+			n := atomic.AddInt32(&loaded, 1)
+			certPEM, keyPEM, _, _ := testCert(t, fmt.Sprint("client", n), false, ca, caKey)
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			return &cert, err
+		}),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	c.Connect(nil)
+
+	for _, expected := range []string{"client1 mqtt", "client2 mqtt"} {
+		select {
+		case s := <-ch:
+			if s != expected {
+				t.Log("unexpected client cert =", s, "expected =", expected)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("not connected")
+			t.FailNow()
+		}
+	}
+	c.Destroy(true)
+}
+
+func TestConnImpl_WriteVersion(t *testing.T) {
+	c := defaultClient()
+	pkt := &PublishPacket{
+		TopicName: "foo",
+		Qos:       Qos1,
+		PacketID:  1,
+		Props:     &PublishProps{ContentType: "text/plain"},
+	}
+
+	for _, version := range []ProtocolLevel{V5, V311} {
+		buf := &bytes.Buffer{}
+		conn := &connImpl{parent: c, name: "a", protoVersion: version, connW: bufio.NewWriter(buf)}
+		if err := conn.writePacket("a", pkt); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		decoded, err := DecodeOnePacketWithVersion(version, buf)
+		if p, ok := decoded.(*PublishPacket); !ok || p.TopicName != "foo" ||
+			(version == V5) != (p.Props != nil && p.Props.ContentType == "text/plain") {
+			t.Log("unexpected packet encoded with", version, "packet =", decoded, "err =", err)
+			t.Fail()
+		}
+
+		// shared packet is not changed
+		if pkt.ProtoVersion != 0 {
+			t.Log("packet version changed by connection", version)
+			t.Fail()
+		}
+	}
+}
@@ -18,8 +18,8 @@ package libmqtt
 
 // ConnPacket is the first packet sent by Client to Server
 type ConnPacket struct {
+	BasePacket
 	protoName    string
-	protoLevel   ProtocolLevel
 	Username     string
 	Password     string
 	ClientID     string
@@ -30,6 +30,10 @@ type ConnPacket struct {
 	Keepalive    uint16
 	WillTopic    string
 	WillMessage  []byte
+
+	// MQTT 5 properties, ignored in V311
+	Props     *ConnProps
+	WillProps *WillProps
 }
 
 // Type ConnPacket'strategy type is CtrlConn
@@ -46,16 +50,20 @@ func (c *ConnPacket) WriteTo(w BufferWriter) error {
 	// 0x01 0x00
 	w.WriteByte(CtrlConn << 4)
 
+	var props []byte
+	if c.Version() == V5 {
+		props = encodeProps(c.Props.props())
+	}
 	payload := c.payload()
 	// remaining length
-	writeRemainLength(10+len(payload), w)
+	writeRemainLength(10+len(props)+len(payload), w)
 
 	// Protocol Name and level
 	// 0x00 0x04 'M' 'Q' 'T' 'T' 0x04
 	w.WriteByte(0x00)
 	w.WriteByte(0x04)
 	w.Write(mqtt)
-	w.WriteByte(V311)
+	w.WriteByte(c.Version())
 
 	// connect flags
 	w.WriteByte(c.flags())
@@ -64,6 +72,9 @@ func (c *ConnPacket) WriteTo(w BufferWriter) error {
 	w.WriteByte(byte(c.Keepalive >> 8))
 	w.WriteByte(byte(c.Keepalive))
 
+	// properties (MQTT 5 only)
+	w.Write(props)
+
 	_, err := w.Write(payload)
 	return err
 }
@@ -104,6 +115,9 @@ func (c *ConnPacket) payload() []byte {
 
 	// will topic and message
 	if c.IsWill {
+		if c.Version() == V5 {
+			result = append(result, encodeProps(c.WillProps.props())...)
+		}
 		result = append(result, encodeDataWithLen([]byte(c.WillTopic))...)
 		result = append(result, encodeDataWithLen(c.WillMessage)...)
 	}
@@ -119,13 +133,223 @@ func (c *ConnPacket) payload() []byte {
 	return result
 }
 
+// ConnProps defines connect packet properties (MQTT 5)
+type ConnProps struct {
+	// SessionExpiryInterval in seconds, 0 means session ends
+	// when connection closed, 0xFFFFFFFF means never expire
+	SessionExpiryInterval uint32
+
+	// MaxRecv limits the number of QoS 1 and QoS 2 publications
+	// the client is willing to process concurrently, 0 means no limit
+	MaxRecv uint16
+
+	// MaxPacketSize the client is willing to accept, 0 means no limit
+	MaxPacketSize uint32
+
+	// MaxTopicAlias the client accepts from the server
+	MaxTopicAlias uint16
+
+	// ReqRespInfo requests the server to return response information
+	ReqRespInfo *bool
+
+	// ReqProblemInfo indicates whether reason string or user properties
+	// are sent in the case of failures
+	ReqProblemInfo *bool
+
+	// UserProps user defined properties
+	UserProps UserProps
+
+	// AuthMethod the name of the authentication method used for
+	// extended authentication
+	AuthMethod string
+
+	// AuthData contains authentication data
+	AuthData []byte
+}
+
+func (c *ConnProps) props() []byte {
+	if c == nil {
+		return nil
+	}
+
+	var result []byte
+	if c.SessionExpiryInterval != 0 {
+		result = appendPropUint32(result, propKeySessionExpiryInterval, c.SessionExpiryInterval)
+	}
+
+	if c.MaxRecv != 0 {
+		result = appendPropUint16(result, propKeyMaxRecv, c.MaxRecv)
+	}
+
+	if c.MaxPacketSize != 0 {
+		result = appendPropUint32(result, propKeyMaxPacketSize, c.MaxPacketSize)
+	}
+
+	if c.MaxTopicAlias != 0 {
+		result = appendPropUint16(result, propKeyMaxTopicAlias, c.MaxTopicAlias)
+	}
+
+	if c.ReqRespInfo != nil {
+		result = appendPropByte(result, propKeyReqRespInfo, boolToByte(*c.ReqRespInfo))
+	}
+
+	if c.ReqProblemInfo != nil {
+		result = appendPropByte(result, propKeyReqProblemInfo, boolToByte(*c.ReqProblemInfo))
+	}
+
+	result = appendUserProps(result, c.UserProps)
+
+	if c.AuthMethod != "" {
+		result = appendPropString(result, propKeyAuthMethod, c.AuthMethod)
+	}
+
+	if c.AuthData != nil {
+		result = appendPropData(result, propKeyAuthData, c.AuthData)
+	}
+
+	return result
+}
+
+func (c *ConnProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeySessionExpiryInterval]; ok {
+		c.SessionExpiryInterval = propUint32(v)
+	}
+
+	if v, ok := props[propKeyMaxRecv]; ok {
+		c.MaxRecv = propUint16(v)
+	}
+
+	if v, ok := props[propKeyMaxPacketSize]; ok {
+		c.MaxPacketSize = propUint32(v)
+	}
+
+	if v, ok := props[propKeyMaxTopicAlias]; ok {
+		c.MaxTopicAlias = propUint16(v)
+	}
+
+	if v, ok := props[propKeyReqRespInfo]; ok {
+		b := propByte(v) == 1
+		c.ReqRespInfo = &b
+	}
+
+	if v, ok := props[propKeyReqProblemInfo]; ok {
+		b := propByte(v) == 1
+		c.ReqProblemInfo = &b
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		c.UserProps = propUserProps(v)
+	}
+
+	if v, ok := props[propKeyAuthMethod]; ok {
+		c.AuthMethod = propString(v)
+	}
+
+	if v, ok := props[propKeyAuthData]; ok {
+		c.AuthData = propData(v)
+	}
+}
+
+// WillProps defines will message properties (MQTT 5)
+type WillProps struct {
+	// WillDelayInterval in seconds, the server delays
+	// publishing the will message until it expires
+	WillDelayInterval uint32
+
+	// PayloadFormat 0 means unspecified bytes, 1 means UTF-8 string
+	PayloadFormat byte
+
+	// MessageExpiryInterval in seconds, 0 means never expire
+	MessageExpiryInterval uint32
+
+	// ContentType describes the content of the will message
+	ContentType string
+
+	// RespTopic is the topic name for a response message
+	RespTopic string
+
+	// CorrelationData used by the sender of the request message
+	// to identify which request the response message is for
+	CorrelationData []byte
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (c *WillProps) props() []byte {
+	if c == nil {
+		return nil
+	}
+
+	var result []byte
+	if c.WillDelayInterval != 0 {
+		result = appendPropUint32(result, propKeyWillDelayInterval, c.WillDelayInterval)
+	}
+
+	if c.PayloadFormat != 0 {
+		result = appendPropByte(result, propKeyPayloadFormatIndicator, c.PayloadFormat)
+	}
+
+	if c.MessageExpiryInterval != 0 {
+		result = appendPropUint32(result, propKeyMessageExpiryInterval, c.MessageExpiryInterval)
+	}
+
+	if c.ContentType != "" {
+		result = appendPropString(result, propKeyContentType, c.ContentType)
+	}
+
+	if c.RespTopic != "" {
+		result = appendPropString(result, propKeyRespTopic, c.RespTopic)
+	}
+
+	if c.CorrelationData != nil {
+		result = appendPropData(result, propKeyCorrelationData, c.CorrelationData)
+	}
+
+	return appendUserProps(result, c.UserProps)
+}
+
+func (c *WillProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeyWillDelayInterval]; ok {
+		c.WillDelayInterval = propUint32(v)
+	}
+
+	if v, ok := props[propKeyPayloadFormatIndicator]; ok {
+		c.PayloadFormat = propByte(v)
+	}
+
+	if v, ok := props[propKeyMessageExpiryInterval]; ok {
+		c.MessageExpiryInterval = propUint32(v)
+	}
+
+	if v, ok := props[propKeyContentType]; ok {
+		c.ContentType = propString(v)
+	}
+
+	if v, ok := props[propKeyRespTopic]; ok {
+		c.RespTopic = propString(v)
+	}
+
+	if v, ok := props[propKeyCorrelationData]; ok {
+		c.CorrelationData = propData(v)
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		c.UserProps = propUserProps(v)
+	}
+}
+
 // ConnAckPacket is the packet sent by the Server in response to a ConnPacket
 // received from a Client.
 //
 // The first packet sent from the Server to the Client MUST be a ConnAckPacket
 type ConnAckPacket struct {
+	BasePacket
 	Present bool
 	Code    ConnAckCode
+
+	// MQTT 5 properties, ignored in V311
+	Props *ConnAckProps
 }
 
 // Type ConnAckPacket'strategy type is CtrlConnAck
@@ -141,6 +365,16 @@ func (c *ConnAckPacket) WriteTo(w BufferWriter) error {
 	// fixed header
 	// 0x02 0x00
 	w.WriteByte(CtrlConnAck << 4)
+
+	if c.Version() == V5 {
+		props := encodeProps(c.Props.props())
+		writeRemainLength(2+len(props), w)
+		w.WriteByte(boolToByte(c.Present))
+		w.WriteByte(c.Code)
+		_, err := w.Write(props)
+		return err
+	}
+
 	w.WriteByte(0x02)
 	// present flag
 	w.WriteByte(boolToByte(c.Present))
@@ -149,25 +383,304 @@ func (c *ConnAckPacket) WriteTo(w BufferWriter) error {
 	return w.WriteByte(c.Code)
 }
 
+// ConnAckProps defines connect acknowledge properties (MQTT 5)
+type ConnAckProps struct {
+	// SessionExpiryInterval set by server, overrides the one in ConnProps
+	SessionExpiryInterval uint32
+
+	// MaxRecv limits the number of QoS 1 and QoS 2 publications
+	// the server is willing to process concurrently, 0 means no limit
+	MaxRecv uint16
+
+	// MaxQos the server supports, nil means QoS 2
+	MaxQos *QosLevel
+
+	// RetainAvail declares whether the server supports retained messages
+	RetainAvail *bool
+
+	// MaxPacketSize the server is willing to accept, 0 means no limit
+	MaxPacketSize uint32
+
+	// AssignedClientID is the client id assigned by server when
+	// client connected with an empty client id
+	AssignedClientID string
+
+	// MaxTopicAlias the server accepts from the client
+	MaxTopicAlias uint16
+
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+
+	// WildcardSubAvail declares whether the server supports wildcard subscriptions
+	WildcardSubAvail *bool
+
+	// SubIDAvail declares whether the server supports subscription identifiers
+	SubIDAvail *bool
+
+	// SharedSubAvail declares whether the server supports shared subscriptions
+	SharedSubAvail *bool
+
+	// ServerKeepalive set by server, overrides the keepalive sent by client
+	ServerKeepalive uint16
+
+	// RespInfo used as the basis for creating a response topic
+	RespInfo string
+
+	// ServerRef is another server to use
+	ServerRef string
+
+	// AuthMethod the name of the authentication method
+	AuthMethod string
+
+	// AuthData contains authentication data
+	AuthData []byte
+}
+
+func (c *ConnAckProps) props() []byte {
+	if c == nil {
+		return nil
+	}
+
+	var result []byte
+	if c.SessionExpiryInterval != 0 {
+		result = appendPropUint32(result, propKeySessionExpiryInterval, c.SessionExpiryInterval)
+	}
+
+	if c.MaxRecv != 0 {
+		result = appendPropUint16(result, propKeyMaxRecv, c.MaxRecv)
+	}
+
+	if c.MaxQos != nil {
+		result = appendPropByte(result, propKeyMaxQos, *c.MaxQos)
+	}
+
+	if c.RetainAvail != nil {
+		result = appendPropByte(result, propKeyRetainAvail, boolToByte(*c.RetainAvail))
+	}
+
+	if c.MaxPacketSize != 0 {
+		result = appendPropUint32(result, propKeyMaxPacketSize, c.MaxPacketSize)
+	}
+
+	if c.AssignedClientID != "" {
+		result = appendPropString(result, propKeyAssignedClientID, c.AssignedClientID)
+	}
+
+	if c.MaxTopicAlias != 0 {
+		result = appendPropUint16(result, propKeyMaxTopicAlias, c.MaxTopicAlias)
+	}
+
+	result = appendReasonProps(result, c.ReasonString, c.UserProps)
+
+	if c.WildcardSubAvail != nil {
+		result = appendPropByte(result, propKeyWildcardSubAvail, boolToByte(*c.WildcardSubAvail))
+	}
+
+	if c.SubIDAvail != nil {
+		result = appendPropByte(result, propKeySubIDAvail, boolToByte(*c.SubIDAvail))
+	}
+
+	if c.SharedSubAvail != nil {
+		result = appendPropByte(result, propKeySharedSubAvail, boolToByte(*c.SharedSubAvail))
+	}
+
+	if c.ServerKeepalive != 0 {
+		result = appendPropUint16(result, propKeyServerKeepalive, c.ServerKeepalive)
+	}
+
+	if c.RespInfo != "" {
+		result = appendPropString(result, propKeyRespInfo, c.RespInfo)
+	}
+
+	if c.ServerRef != "" {
+		result = appendPropString(result, propKeyServerRef, c.ServerRef)
+	}
+
+	if c.AuthMethod != "" {
+		result = appendPropString(result, propKeyAuthMethod, c.AuthMethod)
+	}
+
+	if c.AuthData != nil {
+		result = appendPropData(result, propKeyAuthData, c.AuthData)
+	}
+
+	return result
+}
+
+func (c *ConnAckProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeySessionExpiryInterval]; ok {
+		c.SessionExpiryInterval = propUint32(v)
+	}
+
+	if v, ok := props[propKeyMaxRecv]; ok {
+		c.MaxRecv = propUint16(v)
+	}
+
+	if v, ok := props[propKeyMaxQos]; ok {
+		q := propByte(v)
+		c.MaxQos = &q
+	}
+
+	if v, ok := props[propKeyRetainAvail]; ok {
+		b := propByte(v) == 1
+		c.RetainAvail = &b
+	}
+
+	if v, ok := props[propKeyMaxPacketSize]; ok {
+		c.MaxPacketSize = propUint32(v)
+	}
+
+	if v, ok := props[propKeyAssignedClientID]; ok {
+		c.AssignedClientID = propString(v)
+	}
+
+	if v, ok := props[propKeyMaxTopicAlias]; ok {
+		c.MaxTopicAlias = propUint16(v)
+	}
+
+	if v, ok := props[propKeyReasonString]; ok {
+		c.ReasonString = propString(v)
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		c.UserProps = propUserProps(v)
+	}
+
+	if v, ok := props[propKeyWildcardSubAvail]; ok {
+		b := propByte(v) == 1
+		c.WildcardSubAvail = &b
+	}
+
+	if v, ok := props[propKeySubIDAvail]; ok {
+		b := propByte(v) == 1
+		c.SubIDAvail = &b
+	}
+
+	if v, ok := props[propKeySharedSubAvail]; ok {
+		b := propByte(v) == 1
+		c.SharedSubAvail = &b
+	}
+
+	if v, ok := props[propKeyServerKeepalive]; ok {
+		c.ServerKeepalive = propUint16(v)
+	}
+
+	if v, ok := props[propKeyRespInfo]; ok {
+		c.RespInfo = propString(v)
+	}
+
+	if v, ok := props[propKeyServerRef]; ok {
+		c.ServerRef = propString(v)
+	}
+
+	if v, ok := props[propKeyAuthMethod]; ok {
+		c.AuthMethod = propString(v)
+	}
+
+	if v, ok := props[propKeyAuthData]; ok {
+		c.AuthData = propData(v)
+	}
+}
+
 var (
 	// DisConnPacket is the final instance of disConnPacket
 	DisConnPacket = &disConnPacket{}
 )
 
+// NewDisConnPacket creates a MQTT 5 DisConn packet with reason code and properties
+func NewDisConnPacket(code ReasonCode, props *DisConnProps) Packet {
+	return &disConnPacket{Code: code, Props: props}
+}
+
 // disConnPacket is the final Control Packet sent from the Client to the Server.
 // It indicates that the Client is disconnecting cleanly.
+//
+// In MQTT 5, it can also be sent by the Server with a reason code,
+// a disConnPacket with non-zero Code or properties is encoded as MQTT 5
 type disConnPacket struct {
+	Code  ReasonCode
+	Props *DisConnProps
 }
 
 func (s *disConnPacket) Type() CtrlType {
 	return CtrlDisConn
 }
 
+// Version of disConnPacket is V5 only when it carries reason code or properties
+func (s *disConnPacket) Version() ProtocolLevel {
+	if s.Code != CodeSuccess || s.Props != nil {
+		return V5
+	}
+	return V311
+}
+
 func (s *disConnPacket) WriteTo(w BufferWriter) error {
 	if w == nil || s == nil {
 		return nil
 	}
 	// fixed header
 	w.WriteByte(CtrlDisConn << 4)
+	if s.Version() == V5 {
+		props := encodeProps(s.Props.props())
+		writeRemainLength(1+len(props), w)
+		w.WriteByte(s.Code)
+		_, err := w.Write(props)
+		return err
+	}
 	return w.WriteByte(0x00)
 }
+
+// DisConnProps defines disconnect properties (MQTT 5)
+type DisConnProps struct {
+	// SessionExpiryInterval in seconds, only client can set this property
+	SessionExpiryInterval uint32
+
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+
+	// ServerRef is another server to use, only server can set this property
+	ServerRef string
+}
+
+func (d *DisConnProps) props() []byte {
+	if d == nil {
+		return nil
+	}
+
+	var result []byte
+	if d.SessionExpiryInterval != 0 {
+		result = appendPropUint32(result, propKeySessionExpiryInterval, d.SessionExpiryInterval)
+	}
+
+	result = appendReasonProps(result, d.ReasonString, d.UserProps)
+
+	if d.ServerRef != "" {
+		result = appendPropString(result, propKeyServerRef, d.ServerRef)
+	}
+
+	return result
+}
+
+func (d *DisConnProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeySessionExpiryInterval]; ok {
+		d.SessionExpiryInterval = propUint32(v)
+	}
+
+	if v, ok := props[propKeyReasonString]; ok {
+		d.ReasonString = propString(v)
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		d.UserProps = propUserProps(v)
+	}
+
+	if v, ok := props[propKeyServerRef]; ok {
+		d.ServerRef = propString(v)
+	}
+}
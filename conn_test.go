@@ -35,3 +35,19 @@ func TestConnAckPacket_Bytes(t *testing.T) {
 func TestDisConnPacket_Bytes(t *testing.T) {
 	testBytes(testDisConnMsg, testDisConnMsgBytes, t)
 }
+
+func TestConnPacket_BytesV5(t *testing.T) {
+	testBytes(&ConnPacket{
+		BasePacket:   BasePacket{ProtoVersion: V5},
+		ClientID:     "a",
+		CleanSession: true,
+		Keepalive:    10,
+	}, []byte{
+		CtrlConn << 4, 14, // fixed header
+		0, 4, 'M', 'Q', 'T', 'T', V5, // protocol name and level
+		0x02,  // connect flags: clean session
+		0, 10, // keepalive
+		0,         // properties length
+		0, 1, 'a', // client id
+	}, t)
+}
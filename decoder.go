@@ -18,38 +18,150 @@ package libmqtt
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"unicode/utf8"
 )
 
 var (
-	// ErrBadPacket is the error happened when trying to decode a none MQTT packet
+	// ErrBadPacket is the error happened when trying to decode a none MQTT packet,
+	// decoding errors are *DecodeError, which can be matched with errors.Is(err, ErrBadPacket)
 	ErrBadPacket = errors.New("decoded none MQTT packet ")
+
+	// ErrPacketTooLarge is the error when packet size exceeds the limit of decoder
+	ErrPacketTooLarge = errors.New("packet size exceeds the limit ")
 )
 
-// DecodeOnePacket will decode one mqtt packet
+// DecodeError describes what's wrong with the malformed packet
+type DecodeError struct {
+	// Type of the malformed packet, 0 if not known
+	Type CtrlType
+	// Reason why the packet is malformed
+	Reason string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("malformed packet, type = %d, reason = %s ", e.Type, e.Reason)
+}
+
+// Is reports whether target is ErrBadPacket
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrBadPacket
+}
+
+func newDecodeError(t CtrlType, reason string) error {
+	return &DecodeError{Type: t, Reason: reason}
+}
+
+// Decoder decodes packets with protocol version and decoding rules
+type Decoder struct {
+	// Version is the protocol version used to decode packets (except
+	// ConnPacket, which is decoded with its own protocol level),
+	// zero value means V311
+	Version ProtocolLevel
+
+	// Strict enables the well-formedness checks defined in the spec,
+	// including reserved flags, UTF-8 strings and invalid field values
+	Strict bool
+
+	// MaxPacketSize limits the size of the whole packet in bytes,
+	// packets exceed the limit are rejected before reading the body,
+	// zero means no limit
+	MaxPacketSize int
+}
+
+// DecodeOnePacket will decode one mqtt packet (MQTT 3.1.1)
 func DecodeOnePacket(reader io.Reader) (pkt Packet, err error) {
+	return DecodeOnePacketWithVersion(V311, reader)
+}
+
+// DecodeOnePacketWithVersion will decode one mqtt packet encoded with
+// the protocol version, ConnPacket is decoded with its own protocol level
+func DecodeOnePacketWithVersion(version ProtocolLevel, reader io.Reader) (pkt Packet, err error) {
+	d := &Decoder{Version: version}
+	return d.Decode(reader)
+}
+
+// Decode one packet from reader
+func (d *Decoder) Decode(reader io.Reader) (Packet, error) {
+	pkt, err := d.decode(reader)
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// reservedFlags of fixed header, publish packets have their own flags
+var reservedFlags = map[CtrlType]byte{
+	CtrlConn:      0x00,
+	CtrlConnAck:   0x00,
+	CtrlPubAck:    0x00,
+	CtrlPubRecv:   0x00,
+	CtrlPubRel:    0x02,
+	CtrlPubComp:   0x00,
+	CtrlSubscribe: 0x02,
+	CtrlSubAck:    0x00,
+	CtrlUnSub:     0x02,
+	CtrlUnSubAck:  0x00,
+	CtrlPingReq:   0x00,
+	CtrlPingResp:  0x00,
+	CtrlDisConn:   0x00,
+	CtrlAuth:      0x00,
+}
+
+func (d *Decoder) decode(reader io.Reader) (pkt Packet, err error) {
+	version := d.Version
+	if version == 0 {
+		version = V311
+	}
+
 	headerBytes := make([]byte, 1)
 	if _, err = io.ReadFull(reader, headerBytes[:]); err != nil {
 		return
 	}
 
-	var bytesToRead int
-	if bytesToRead, err = decodeRemainLength(reader); err != nil {
+	header := headerBytes[0]
+	ctrlType := header >> 4
+	if d.Strict {
+		if flags, ok := reservedFlags[ctrlType]; ok && header&0x0F != flags {
+			return nil, newDecodeError(ctrlType, "invalid fixed header flags")
+		}
+	}
+
+	var bytesToRead, lenSize int
+	if bytesToRead, lenSize, err = decodeRemainLength(reader); err != nil {
+		if err == errBadRemainLength {
+			err = newDecodeError(ctrlType, "invalid remaining length")
+		}
 		return
-	} else if bytesToRead == 0 {
-		switch headerBytes[0] >> 4 {
+	}
+
+	if d.MaxPacketSize > 0 && 1+lenSize+bytesToRead > d.MaxPacketSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	if bytesToRead == 0 {
+		switch ctrlType {
 		case CtrlPingReq:
 			pkt = PingReqPacket
 		case CtrlPingResp:
 			pkt = PingRespPacket
 		case CtrlDisConn:
 			pkt = DisConnPacket
+		case CtrlAuth:
+			if version != V5 {
+				err = newDecodeError(ctrlType, "auth packet requires MQTT 5")
+				return
+			}
+			pkt = &AuthPacket{BasePacket: BasePacket{ProtoVersion: version}}
 		default:
-			err = ErrBadPacket
+			err = newDecodeError(ctrlType, "unexpected empty packet")
 		}
 		return
-	} else if bytesToRead < 2 {
-		err = ErrBadPacket
+	} else if bytesToRead < 2 && (version != V5 ||
+		(ctrlType != CtrlDisConn && ctrlType != CtrlAuth)) {
+		err = newDecodeError(ctrlType, "packet too short")
 		return
 	}
 
@@ -58,136 +170,427 @@ func DecodeOnePacket(reader io.Reader) (pkt Packet, err error) {
 		return
 	}
 
-	header := headerBytes[0]
 	var next []byte
-	switch header >> 4 {
+	switch ctrlType {
 	case CtrlConn:
 		var protocol string
-		if protocol, next, err = decodeString(body); err != nil {
+		if protocol, next, err = d.decodeString(ctrlType, body); err != nil {
 			return
 		}
 
 		if len(next) < 4 {
-			err = ErrBadPacket
+			err = newDecodeError(ctrlType, "packet too short")
 			return
 		}
-		hasUsername := next[1]&0x80 == 0x80
-		hasPassword := next[1]&0x40 == 0x40
+		flags := next[1]
+		hasUsername := flags&0x80 == 0x80
+		hasPassword := flags&0x40 == 0x40
 		tmpPkt := &ConnPacket{
+			BasePacket:   BasePacket{ProtoVersion: next[0]},
 			protoName:    protocol,
-			protoLevel:   next[0],
-			CleanSession: next[1]&0x02 == 0x02,
-			IsWill:       next[1]&0x04 == 0x04,
-			WillQos:      next[1] & 0x18 >> 3,
-			WillRetain:   next[1]&0x20 == 0x20,
+			CleanSession: flags&0x02 == 0x02,
+			IsWill:       flags&0x04 == 0x04,
+			WillQos:      flags & 0x18 >> 3,
+			WillRetain:   flags&0x20 == 0x20,
 			Keepalive:    uint16(next[2])<<8 + uint16(next[3]),
 		}
-		if tmpPkt.ClientID, next, err = decodeString(next[4:]); err != nil {
+		if d.Strict {
+			if err = checkConnFlags(protocol, next[0], flags); err != nil {
+				return
+			}
+		}
+		next = next[4:]
+
+		if tmpPkt.Version() == V5 {
+			tmpPkt.Props = &ConnProps{}
+			if next, err = d.decodePropsTo(ctrlType, next, tmpPkt.Props); err != nil {
+				return
+			}
+		}
+
+		if tmpPkt.ClientID, next, err = d.decodeString(ctrlType, next); err != nil {
 			return
 		}
 
 		if tmpPkt.IsWill {
-			tmpPkt.WillTopic, next, err = decodeString(next)
-			tmpPkt.WillMessage, next, err = decodeData(next)
+			if tmpPkt.Version() == V5 {
+				tmpPkt.WillProps = &WillProps{}
+				if next, err = d.decodePropsTo(ctrlType, next, tmpPkt.WillProps); err != nil {
+					return
+				}
+			}
+
+			if tmpPkt.WillTopic, next, err = d.decodeString(ctrlType, next); err != nil {
+				return
+			}
+
+			if tmpPkt.WillMessage, next, err = decodeData(next); err != nil {
+				return
+			}
 		}
 
 		if hasUsername {
-			tmpPkt.Username, next, err = decodeString(next)
+			if tmpPkt.Username, next, err = d.decodeString(ctrlType, next); err != nil {
+				return
+			}
 		}
 
 		if hasPassword {
-			tmpPkt.Password, _, err = decodeString(next)
+			var password []byte
+			if password, next, err = decodeData(next); err != nil {
+				return
+			}
+			tmpPkt.Password = string(password)
 		}
 
-		if err != nil {
+		if d.Strict && len(next) > 0 {
+			err = newDecodeError(ctrlType, "unexpected trailing bytes")
 			return
 		}
 
 		pkt = tmpPkt
 	case CtrlConnAck:
-		pkt = &ConnAckPacket{
-			Present: body[0]&0x01 == 0x01,
-			Code:    body[1],
+		if d.Strict && (body[0]&0xFE != 0 || (version != V5 && len(body) != 2)) {
+			err = newDecodeError(ctrlType, "invalid acknowledge flags or length")
+			return
+		}
+
+		tmpPkt := &ConnAckPacket{
+			BasePacket: BasePacket{ProtoVersion: version},
+			Present:    body[0]&0x01 == 0x01,
+			Code:       body[1],
+		}
+
+		if version == V5 {
+			tmpPkt.Props = &ConnAckProps{}
+			if _, err = d.decodePropsTo(ctrlType, body[2:], tmpPkt.Props); err != nil {
+				return
+			}
 		}
+		pkt = tmpPkt
 	case CtrlPublish:
 		var topicName string
-		if topicName, next, err = decodeString(body); err != nil {
+		if topicName, next, err = d.decodeString(ctrlType, body); err != nil {
 			return
 		}
 
-		if len(next) < 2 {
-			err = ErrBadPacket
-			return
+		pub := &PublishPacket{
+			BasePacket: BasePacket{ProtoVersion: version},
+			IsDup:      header&0x08 == 0x08,
+			Qos:        header & 0x06 >> 1,
+			IsRetain:   header&0x01 == 1,
+			TopicName:  topicName,
 		}
 
-		pub := &PublishPacket{
-			IsDup:     header&0x08 == 0x08,
-			Qos:       header & 0x06 >> 1,
-			IsRetain:  header&0x01 == 1,
-			TopicName: topicName,
+		if d.Strict {
+			switch {
+			case pub.Qos > Qos2:
+				err = newDecodeError(ctrlType, "invalid QoS")
+			case pub.Qos == Qos0 && pub.IsDup:
+				err = newDecodeError(ctrlType, "DUP flag set with QoS 0")
+			case strings.ContainsAny(topicName, "#+") || (topicName == "" && version != V5):
+				err = newDecodeError(ctrlType, "invalid topic name")
+			}
+			if err != nil {
+				return
+			}
 		}
 
 		if pub.Qos > Qos0 {
+			if len(next) < 2 {
+				err = newDecodeError(ctrlType, "missing packet id")
+				return
+			}
+
 			pub.PacketID = uint16(next[0])<<8 + uint16(next[1])
 			next = next[2:]
+			if d.Strict && pub.PacketID == 0 {
+				err = newDecodeError(ctrlType, "zero packet id")
+				return
+			}
+		}
+
+		if version == V5 {
+			pub.Props = &PublishProps{}
+			if next, err = d.decodePropsTo(ctrlType, next, pub.Props); err != nil {
+				return
+			}
 		}
 
 		pub.Payload = next
 		pkt = pub
 	case CtrlPubAck:
-		pkt = &PubAckPacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		tmpPkt := &PubAckPacket{BasePacket: BasePacket{ProtoVersion: version}}
+		if tmpPkt.PacketID, tmpPkt.Code, err = d.decodeAckPacket(ctrlType, version, body, func() propsSetter {
+			tmpPkt.Props = &PubAckProps{}
+			return tmpPkt.Props
+		}); err != nil {
+			return
+		}
+		pkt = tmpPkt
 	case CtrlPubRecv:
-		pkt = &PubRecvPacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		tmpPkt := &PubRecvPacket{BasePacket: BasePacket{ProtoVersion: version}}
+		if tmpPkt.PacketID, tmpPkt.Code, err = d.decodeAckPacket(ctrlType, version, body, func() propsSetter {
+			tmpPkt.Props = &PubRecvProps{}
+			return tmpPkt.Props
+		}); err != nil {
+			return
+		}
+		pkt = tmpPkt
 	case CtrlPubRel:
-		pkt = &PubRelPacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		tmpPkt := &PubRelPacket{BasePacket: BasePacket{ProtoVersion: version}}
+		if tmpPkt.PacketID, tmpPkt.Code, err = d.decodeAckPacket(ctrlType, version, body, func() propsSetter {
+			tmpPkt.Props = &PubRelProps{}
+			return tmpPkt.Props
+		}); err != nil {
+			return
+		}
+		pkt = tmpPkt
 	case CtrlPubComp:
-		pkt = &PubCompPacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		tmpPkt := &PubCompPacket{BasePacket: BasePacket{ProtoVersion: version}}
+		if tmpPkt.PacketID, tmpPkt.Code, err = d.decodeAckPacket(ctrlType, version, body, func() propsSetter {
+			tmpPkt.Props = &PubCompProps{}
+			return tmpPkt.Props
+		}); err != nil {
+			return
+		}
+		pkt = tmpPkt
 	case CtrlSubscribe:
-		pktTmp := &SubscribePacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		pktTmp := &SubscribePacket{
+			BasePacket: BasePacket{ProtoVersion: version},
+			PacketID:   uint16(body[0])<<8 + uint16(body[1]),
+		}
 
 		next = body[2:]
+		if version == V5 {
+			pktTmp.Props = &SubProps{}
+			if next, err = d.decodePropsTo(ctrlType, next, pktTmp.Props); err != nil {
+				return
+			}
+		}
+
 		topics := make([]*Topic, 0)
 		for len(next) > 0 {
 			var name string
-			if name, next, err = decodeString(next); err != nil {
+			if name, next, err = d.decodeString(ctrlType, next); err != nil {
 				return
 			}
 
 			if len(next) < 1 {
-				err = ErrBadPacket
+				err = newDecodeError(ctrlType, "missing subscription options")
 				return
 			}
 
-			topics = append(topics, &Topic{Name: name, Qos: next[0]})
+			if d.Strict {
+				if err = checkSubOptions(version, next[0]); err != nil {
+					return
+				}
+			}
+
+			topic := &Topic{Name: name, Qos: next[0] & 0x03}
+			if version == V5 {
+				topic.NoLocal = next[0]&0x04 == 0x04
+				topic.RetainAsPublished = next[0]&0x08 == 0x08
+				topic.RetainHandling = next[0] >> 4 & 0x03
+			}
+			topics = append(topics, topic)
 			next = next[1:]
 		}
+
+		if d.Strict && (pktTmp.PacketID == 0 || len(topics) == 0) {
+			err = newDecodeError(ctrlType, "zero packet id or no topic")
+			return
+		}
 		pktTmp.Topics = topics
 		pkt = pktTmp
 	case CtrlSubAck:
-		pktTmp := &SubAckPacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		pktTmp := &SubAckPacket{
+			BasePacket: BasePacket{ProtoVersion: version},
+			PacketID:   uint16(body[0])<<8 + uint16(body[1]),
+		}
 
 		next = body[2:]
-		codes := make([]SubAckCode, 0)
-		for i := 0; i < len(next); i++ {
-			codes = append(codes, next[i])
+		if version == V5 {
+			pktTmp.Props = &SubAckProps{}
+			if next, err = d.decodePropsTo(ctrlType, next, pktTmp.Props); err != nil {
+				return
+			}
+		}
+
+		if d.Strict && len(next) == 0 {
+			err = newDecodeError(ctrlType, "no return code")
+			return
 		}
+		pktTmp.Codes = append([]SubAckCode{}, next...)
 		pkt = pktTmp
 	case CtrlUnSub:
-		pktTmp := &UnSubPacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		pktTmp := &UnSubPacket{
+			BasePacket: BasePacket{ProtoVersion: version},
+			PacketID:   uint16(body[0])<<8 + uint16(body[1]),
+		}
+
 		next = body[2:]
+		if version == V5 {
+			pktTmp.Props = &UnSubProps{}
+			if next, err = d.decodePropsTo(ctrlType, next, pktTmp.Props); err != nil {
+				return
+			}
+		}
+
 		topics := make([]string, 0)
 		for len(next) > 0 {
 			var name string
-			name, next, err = decodeString(next)
+			name, next, err = d.decodeString(ctrlType, next)
 			if err != nil {
 				return
 			}
 			topics = append(topics, name)
 		}
+
+		if d.Strict && (pktTmp.PacketID == 0 || len(topics) == 0) {
+			err = newDecodeError(ctrlType, "zero packet id or no topic")
+			return
+		}
 		pktTmp.TopicNames = topics
 		pkt = pktTmp
 	case CtrlUnSubAck:
-		pkt = &UnSubAckPacket{PacketID: uint16(body[0])<<8 + uint16(body[1])}
+		pktTmp := &UnSubAckPacket{
+			BasePacket: BasePacket{ProtoVersion: version},
+			PacketID:   uint16(body[0])<<8 + uint16(body[1]),
+		}
+
+		if version == V5 {
+			pktTmp.Props = &UnSubAckProps{}
+			if next, err = d.decodePropsTo(ctrlType, body[2:], pktTmp.Props); err != nil {
+				return
+			}
+			pktTmp.Codes = append([]ReasonCode{}, next...)
+		} else if d.Strict && len(body) != 2 {
+			err = newDecodeError(ctrlType, "invalid remaining length")
+			return
+		}
+		pkt = pktTmp
+	case CtrlDisConn:
+		if version != V5 {
+			err = newDecodeError(ctrlType, "disconnect packet with body requires MQTT 5")
+			return
+		}
+
+		pktTmp := &disConnPacket{Code: body[0]}
+		if len(body) > 1 {
+			pktTmp.Props = &DisConnProps{}
+			if _, err = d.decodePropsTo(ctrlType, body[1:], pktTmp.Props); err != nil {
+				return
+			}
+		}
+		pkt = pktTmp
+	case CtrlAuth:
+		if version != V5 {
+			err = newDecodeError(ctrlType, "auth packet requires MQTT 5")
+			return
+		}
+
+		pktTmp := &AuthPacket{
+			BasePacket: BasePacket{ProtoVersion: version},
+			Code:       body[0],
+		}
+		if len(body) > 1 {
+			pktTmp.Props = &AuthProps{}
+			if _, err = d.decodePropsTo(ctrlType, body[1:], pktTmp.Props); err != nil {
+				return
+			}
+		}
+		pkt = pktTmp
+	default:
+		err = newDecodeError(ctrlType, "unknown packet type")
+	}
+	return
+}
+
+// checkConnFlags checks the protocol name and connect flags
+func checkConnFlags(protocol string, level ProtocolLevel, flags byte) error {
+	switch {
+	case protocol != "MQTT":
+		return newDecodeError(CtrlConn, "invalid protocol name")
+	case flags&0x01 != 0:
+		return newDecodeError(CtrlConn, "reserved connect flag set")
+	case flags&0x18 == 0x18:
+		return newDecodeError(CtrlConn, "invalid will QoS")
+	case flags&0x04 == 0 && flags&0x38 != 0:
+		return newDecodeError(CtrlConn, "will QoS or retain set without will flag")
+	case level != V5 && flags&0xC0 == 0x40:
+		return newDecodeError(CtrlConn, "password set without username")
+	}
+	return nil
+}
+
+// checkSubOptions checks the reserved bits and values of subscription options
+func checkSubOptions(version ProtocolLevel, options byte) error {
+	switch {
+	case options&0x03 > Qos2:
+		return newDecodeError(CtrlSubscribe, "invalid QoS")
+	case version != V5 && options&0xFC != 0:
+		return newDecodeError(CtrlSubscribe, "reserved subscription options set")
+	case version == V5 && (options&0xC0 != 0 || options>>4&0x03 > 2):
+		return newDecodeError(CtrlSubscribe, "invalid subscription options")
+	}
+	return nil
+}
+
+// propsSetter is the MQTT 5 properties holder
+type propsSetter interface {
+	setProps(props map[byte][][]byte)
+}
+
+// decodePropsTo decode properties at the beginning of data into setter,
+// in strict mode, only user property and subscription identifier can
+// appear more than once
+func (d *Decoder) decodePropsTo(t CtrlType, data []byte, setter propsSetter) (next []byte, err error) {
+	var props map[byte][][]byte
+	if props, next, err = decodeProps(data); err != nil {
+		return nil, err
+	}
+
+	if d.Strict {
+		for key, v := range props {
+			if len(v) > 1 && key != propKeyUserProps && key != propKeySubID {
+				return nil, newDecodeError(t, fmt.Sprintf("duplicated property %#x", key))
+			}
+		}
+	}
+
+	setter.setProps(props)
+	return next, nil
+}
+
+// decodeAckPacket decode packet id, and reason code and properties in MQTT 5,
+// newProps is called only when there are properties
+func (d *Decoder) decodeAckPacket(t CtrlType, version ProtocolLevel, body []byte, newProps func() propsSetter) (packetID uint16, code ReasonCode, err error) {
+	packetID = uint16(body[0])<<8 + uint16(body[1])
+	if d.Strict && (packetID == 0 || (version != V5 && len(body) != 2)) {
+		err = newDecodeError(t, "zero packet id or invalid remaining length")
+		return
+	}
+
+	if version != V5 || len(body) < 3 {
+		return
+	}
+
+	code = body[2]
+	if len(body) > 3 {
+		_, err = d.decodePropsTo(t, body[3:], newProps())
+	}
+	return
+}
+
+// decodeString decode UTF-8 encoded string, which is validated in strict mode
+func (d *Decoder) decodeString(t CtrlType, data []byte) (str string, next []byte, err error) {
+	if str, next, err = decodeString(data); err != nil {
+		return
+	}
+
+	if d.Strict && (!utf8.ValidString(str) || strings.ContainsRune(str, 0)) {
+		return "", nil, newDecodeError(t, "invalid UTF-8 string")
 	}
 	return
 }
@@ -204,34 +607,215 @@ func decodeString(data []byte) (d string, next []byte, err error) {
 
 func decodeData(data []byte) (d []byte, next []byte, err error) {
 	if len(data) < 2 {
-		return nil, nil, ErrBadPacket
+		return nil, nil, newDecodeError(0, "missing data length")
 	}
 	length := int(data[0])<<8 + int(data[1])
 	if length+2 > len(data) {
 		// out of bounds
-		return nil, nil, ErrBadPacket
+		return nil, nil, newDecodeError(0, "data length out of bounds")
 	}
 	return data[2 : length+2], data[length+2:], nil
 }
 
-func decodeRemainLength(reader io.Reader) (result int, err error) {
+var errBadRemainLength = errors.New("bad remaining length ")
+
+// decodeRemainLength decode the variable length integer of remaining
+// length, size is the number of bytes used by the remaining length
+func decodeRemainLength(reader io.Reader) (result, size int, err error) {
 	buf := make([]byte, 1)
-	_, err = io.ReadFull(reader, buf[:])
-	result = int(buf[0] & 127)
 	m := 1
-	for (buf[0] & 0x80) != 0 {
-		_, err = io.ReadFull(reader, buf[:])
-		if err != nil {
-			return
+	for size < 4 {
+		if _, err = io.ReadFull(reader, buf[:]); err != nil {
+			return 0, size, err
+		}
+		size++
+
+		result += int(buf[0]&0x7F) * m
+		if buf[0]&0x80 == 0 {
+			return result, size, nil
 		}
+		m *= 128
+	}
 
-		result += int(buf[0]&127) * m
-		m <<= 8
+	// more than 4 bytes
+	return 0, size, errBadRemainLength
+}
 
-		if m > 128*128*128 {
-			return
+// property value types defined in MQTT 5
+const (
+	propTypeByte = iota
+	propTypeUint16
+	propTypeUint32
+	propTypeVarInt
+	propTypeString
+	propTypeData
+	propTypeStringPair
+)
+
+var propTypes = map[byte]int{
+	propKeyPayloadFormatIndicator: propTypeByte,
+	propKeyMessageExpiryInterval:  propTypeUint32,
+	propKeyContentType:            propTypeString,
+	propKeyRespTopic:              propTypeString,
+	propKeyCorrelationData:        propTypeData,
+	propKeySubID:                  propTypeVarInt,
+	propKeySessionExpiryInterval:  propTypeUint32,
+	propKeyAssignedClientID:       propTypeString,
+	propKeyServerKeepalive:        propTypeUint16,
+	propKeyAuthMethod:             propTypeString,
+	propKeyAuthData:               propTypeData,
+	propKeyReqProblemInfo:         propTypeByte,
+	propKeyWillDelayInterval:      propTypeUint32,
+	propKeyReqRespInfo:            propTypeByte,
+	propKeyRespInfo:               propTypeString,
+	propKeyServerRef:              propTypeString,
+	propKeyReasonString:           propTypeString,
+	propKeyMaxRecv:                propTypeUint16,
+	propKeyMaxTopicAlias:          propTypeUint16,
+	propKeyTopicAlias:             propTypeUint16,
+	propKeyMaxQos:                 propTypeByte,
+	propKeyRetainAvail:            propTypeByte,
+	propKeyUserProps:              propTypeStringPair,
+	propKeyMaxPacketSize:          propTypeUint32,
+	propKeyWildcardSubAvail:       propTypeByte,
+	propKeySubIDAvail:             propTypeByte,
+	propKeySharedSubAvail:         propTypeByte,
+}
+
+// decodeVarInt decode a variable byte integer from data
+func decodeVarInt(data []byte) (result int, next []byte, err error) {
+	m := 1
+	for i := 0; i < 4; i++ {
+		if i >= len(data) {
+			return 0, nil, newDecodeError(0, "variable byte integer out of bounds")
+		}
+
+		result += int(data[i]&127) * m
+		if data[i]&0x80 == 0 {
+			return result, data[i+1:], nil
 		}
+		m *= 128
 	}
 
+	return 0, nil, newDecodeError(0, "invalid variable byte integer")
+}
+
+// decodeProps decode the properties block at the beginning of data,
+// values of each property are grouped by property identifier
+func decodeProps(data []byte) (props map[byte][][]byte, next []byte, err error) {
+	var length int
+	if length, next, err = decodeVarInt(data); err != nil {
+		return
+	}
+
+	if length > len(next) {
+		return nil, nil, newDecodeError(0, "properties length out of bounds")
+	}
+
+	propData := next[:length]
+	next = next[length:]
+	props = make(map[byte][][]byte)
+	for len(propData) > 0 {
+		key := propData[0]
+		propData = propData[1:]
+
+		t, ok := propTypes[key]
+		if !ok {
+			return nil, nil, newDecodeError(0, fmt.Sprintf("unknown property %#x", key))
+		}
+
+		var size int
+		switch t {
+		case propTypeByte:
+			size = 1
+		case propTypeUint16:
+			size = 2
+		case propTypeUint32:
+			size = 4
+		case propTypeVarInt:
+			var rest []byte
+			if _, rest, err = decodeVarInt(propData); err != nil {
+				return nil, nil, err
+			}
+			size = len(propData) - len(rest)
+		case propTypeString, propTypeData:
+			var rest []byte
+			if _, rest, err = decodeData(propData); err != nil {
+				return nil, nil, err
+			}
+			size = len(propData) - len(rest)
+		case propTypeStringPair:
+			var rest []byte
+			if _, rest, err = decodeData(propData); err != nil {
+				return nil, nil, err
+			}
+			if _, rest, err = decodeData(rest); err != nil {
+				return nil, nil, err
+			}
+			size = len(propData) - len(rest)
+		}
+
+		if size > len(propData) {
+			return nil, nil, newDecodeError(0, "property value out of bounds")
+		}
+
+		props[key] = append(props[key], propData[:size])
+		propData = propData[size:]
+	}
+
+	return
+}
+
+func propByte(v [][]byte) byte {
+	return v[0][0]
+}
+
+func propUint16(v [][]byte) uint16 {
+	return uint16(v[0][0])<<8 | uint16(v[0][1])
+}
+
+func propUint32(v [][]byte) uint32 {
+	return uint32(v[0][0])<<24 | uint32(v[0][1])<<16 | uint32(v[0][2])<<8 | uint32(v[0][3])
+}
+
+func propVarInts(v [][]byte) []int {
+	result := make([]int, 0, len(v))
+	for _, d := range v {
+		n, _, _ := decodeVarInt(d)
+		result = append(result, n)
+	}
+	return result
+}
+
+func propString(v [][]byte) string {
+	s, _, _ := decodeString(v[0])
+	return s
+}
+
+func propData(v [][]byte) []byte {
+	d, _, _ := decodeData(v[0])
+	return d
+}
+
+func propUserProps(v [][]byte) UserProps {
+	result := make(UserProps)
+	for _, d := range v {
+		key, next, _ := decodeString(d)
+		value, _, _ := decodeString(next)
+		result.Add(key, value)
+	}
+	return result
+}
+
+// decodeReasonProps decode the reason string and user properties,
+// which is all the properties of most ack packets
+func decodeReasonProps(props map[byte][][]byte) (reason string, userProps UserProps) {
+	if v, ok := props[propKeyReasonString]; ok {
+		reason = propString(v)
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		userProps = propUserProps(v)
+	}
 	return
 }
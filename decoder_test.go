@@ -18,18 +18,104 @@ package libmqtt
 
 import (
 	"bytes"
+	"errors"
+	"reflect"
 	"testing"
 )
 
 func TestDecodeRemainLength(t *testing.T) {
-	buffer := &bytes.Buffer{}
-	buffer.Write([]byte{0x04})
-	length, err := decodeRemainLength(buffer)
-	if err != nil || length != 0x04 {
-		t.Log(length)
+	cases := map[int][]byte{
+		0x04:      {0x04},
+		127:       {0x7F},
+		128:       {0x80, 0x01},
+		321:       {0xC1, 0x02},
+		16383:     {0xFF, 0x7F},
+		2097152:   {0x80, 0x80, 0x80, 0x01},
+		268435455: {0xFF, 0xFF, 0xFF, 0x7F},
+	}
+
+	for expected, data := range cases {
+		length, size, err := decodeRemainLength(bytes.NewReader(data))
+		if err != nil || length != expected || size != len(data) {
+			t.Log("length =", length, "size =", size, "expected =", expected, "err =", err)
+			t.Fail()
+		}
+	}
+
+	// more than 4 bytes
+	if _, _, err := decodeRemainLength(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x7F})); err == nil {
+		t.Log("decoded remaining length longer than 4 bytes")
+		t.Fail()
+	}
+
+	// error on the first byte
+	if _, _, err := decodeRemainLength(bytes.NewReader(nil)); err == nil {
+		t.Log("decoded remaining length without data")
+		t.Fail()
+	}
+}
+
+func TestDecoder_Strict(t *testing.T) {
+	malformed := [][]byte{
+		// subscribe with wrong fixed header flags
+		{CtrlSubscribe << 4, 6, 0, 1, 0, 1, 'a', 1},
+		// subscribe with reserved option bits
+		{CtrlSubscribe<<4 | 0x02, 6, 0, 1, 0, 1, 'a', 0x41},
+		// subscribe without topic
+		{CtrlSubscribe<<4 | 0x02, 2, 0, 1},
+		// publish with QoS 3
+		{CtrlPublish<<4 | 0x06, 5, 0, 1, 'a', 0, 1},
+		// publish with wildcard in topic name
+		{CtrlPublish << 4, 3, 0, 1, '#'},
+		// publish with invalid UTF-8 topic name
+		{CtrlPublish << 4, 4, 0, 2, 0xC3, 0x28},
+		// puback with zero packet id
+		{CtrlPubAck << 4, 2, 0, 0},
+		// connect with reserved flag set
+		{CtrlConn << 4, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x03, 0, 10, 0, 1, 'a'},
+	}
+
+	for i, data := range malformed {
+		strict := &Decoder{Strict: true}
+		pkt, err := strict.Decode(bytes.NewReader(data))
+		if err == nil {
+			t.Log("strict decoder accepted malformed packet", i, pkt)
+			t.Fail()
+			continue
+		}
+
+		if _, ok := err.(*DecodeError); !ok || !errors.Is(err, ErrBadPacket) {
+			t.Log("unexpected error type, err =", err)
+			t.Fail()
+		}
+	}
+
+	// SubAck codes should be decoded
+	pkt, err := (&Decoder{Strict: true}).Decode(bytes.NewReader([]byte{CtrlSubAck << 4, 4, 0, 1, SubOkMaxQos1, SubFail}))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if codes := pkt.(*SubAckPacket).Codes; len(codes) != 2 || codes[0] != SubOkMaxQos1 || codes[1] != SubFail {
+		t.Log("unexpected SubAck codes =", codes)
+		t.Fail()
+	}
+}
+
+func TestDecoder_MaxPacketSize(t *testing.T) {
+	d := &Decoder{MaxPacketSize: 128}
+	// remaining length 16383 without body
+	if _, err := d.Decode(bytes.NewReader([]byte{CtrlPublish << 4, 0xFF, 0x7F})); err != ErrPacketTooLarge {
+		t.Log("unexpected error =", err)
+		t.Fail()
+	}
+
+	buf := &bytes.Buffer{}
+	(&PublishPacket{TopicName: "foo", Payload: make([]byte, 100)}).WriteTo(buf)
+	if _, err := d.Decode(buf); err != nil {
+		t.Log(err)
 		t.Fail()
 	}
-	buffer.Reset()
 }
 
 func TestDecodeOnePacket(t *testing.T) {
@@ -112,3 +198,142 @@ func BenchmarkDecodeOnePacket(b *testing.B) {
 		}
 	}
 }
+
+func TestDecodeOnePacketWithVersion(t *testing.T) {
+	boolTrue := true
+	maxQos := Qos1
+	v5 := BasePacket{ProtoVersion: V5}
+	userProps := UserProps{"foo": {"bar", "baz"}}
+	pkts := []Packet{
+		&ConnPacket{
+			BasePacket:   v5,
+			protoName:    "MQTT",
+			Username:     testUsername,
+			Password:     testPassword,
+			ClientID:     testClientID,
+			CleanSession: testCleanSession,
+			IsWill:       testWill,
+			WillQos:      testWillQos,
+			WillRetain:   testWillRetain,
+			WillTopic:    testWillTopic,
+			WillMessage:  testWillMessage,
+			Keepalive:    testKeepalive,
+			Props: &ConnProps{
+				SessionExpiryInterval: 3600,
+				MaxRecv:               16,
+				ReqProblemInfo:        &boolTrue,
+				UserProps:             userProps,
+				AuthMethod:            "SCRAM-SHA-256",
+				AuthData:              []byte("data"),
+			},
+			WillProps: &WillProps{WillDelayInterval: 10, ContentType: "text/plain"},
+		},
+		&ConnAckPacket{
+			BasePacket: v5,
+			Present:    true,
+			Code:       CodeSuccess,
+			Props: &ConnAckProps{
+				MaxQos:           &maxQos,
+				AssignedClientID: "foo",
+				ServerKeepalive:  60,
+				UserProps:        userProps,
+			},
+		},
+		&PublishPacket{
+			BasePacket: v5,
+			Qos:        Qos1,
+			TopicName:  "foo",
+			Payload:    []byte("bar"),
+			PacketID:   testPacketID,
+			Props: &PublishProps{
+				PayloadFormat:   1,
+				RespTopic:       "foo/resp",
+				CorrelationData: []byte("id"),
+				SubIDs:          []int{1, 268435455},
+			},
+		},
+		&PubAckPacket{BasePacket: v5, PacketID: testPacketID, Code: CodeNoMatchingSubscribers, Props: &PubAckProps{ReasonString: "foo"}},
+		&PubRecvPacket{BasePacket: v5, PacketID: testPacketID, Code: CodeQuotaExceeded},
+		&PubRelPacket{BasePacket: v5, PacketID: testPacketID, Code: CodePacketIDNotFound, Props: &PubRelProps{UserProps: userProps}},
+		&PubCompPacket{BasePacket: v5, PacketID: testPacketID},
+		&SubscribePacket{
+			BasePacket: v5,
+			PacketID:   testPacketID,
+			Topics:     []*Topic{{Name: "foo", Qos: Qos1, NoLocal: true, RetainHandling: 2}, {Name: "bar", Qos: Qos2, RetainAsPublished: true}},
+			Props:      &SubProps{SubID: 128},
+		},
+		&SubAckPacket{BasePacket: v5, PacketID: testPacketID, Codes: []SubAckCode{CodeGrantedQos1, CodeNotAuthorized}, Props: &SubAckProps{}},
+		&UnSubPacket{BasePacket: v5, PacketID: testPacketID, TopicNames: testTopics, Props: &UnSubProps{}},
+		&UnSubAckPacket{BasePacket: v5, PacketID: testPacketID, Codes: []ReasonCode{CodeSuccess, CodeNoSubscriptionExisted}, Props: &UnSubAckProps{ReasonString: "foo"}},
+		&disConnPacket{Code: CodeServerShuttingDown, Props: &DisConnProps{ServerRef: "localhost:1884"}},
+	}
+
+	for _, p := range pkts {
+		buf := &bytes.Buffer{}
+		if err := p.WriteTo(buf); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		pkt, err := DecodeOnePacketWithVersion(V5, buf)
+		if err != nil {
+			t.Log("decode failed, type =", p.Type(), "err =", err)
+			t.FailNow()
+		}
+
+		if !reflect.DeepEqual(p, pkt) {
+			t.Logf("source %#v", p)
+			t.Logf("target %#v", pkt)
+			t.Fail()
+		}
+	}
+}
+
+func TestDecoder_Props(t *testing.T) {
+	malformed := [][]byte{
+		// unknown property
+		{CtrlPubAck << 4, 6, 0, 1, 0, 2, 0x7F, 0},
+		// properties length not terminated
+		{CtrlPubAck << 4, 4, 0, 1, 0, 0x80},
+		// properties length out of bounds
+		{CtrlPubAck << 4, 4, 0, 1, 0, 5},
+	}
+
+	for i, data := range malformed {
+		_, err := (&Decoder{Version: V5}).Decode(bytes.NewReader(data))
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Log("unexpected error of malformed properties", i, ", err =", err)
+			t.Fail()
+		}
+	}
+
+	// reason string appears twice
+	duplicated := []byte{CtrlPubAck << 4, 12, 0, 1, 0, 8, 0x1F, 0, 1, 'a', 0x1F, 0, 1, 'b'}
+	if _, err := (&Decoder{Version: V5}).Decode(bytes.NewReader(duplicated)); err != nil {
+		t.Log("duplicated property rejected in non-strict mode, err =", err)
+		t.Fail()
+	}
+
+	_, err := (&Decoder{Version: V5, Strict: true}).Decode(bytes.NewReader(duplicated))
+	if _, ok := err.(*DecodeError); !ok {
+		t.Log("duplicated property accepted in strict mode, err =", err)
+		t.Fail()
+	}
+
+	// user properties can appear more than once
+	userProps := []byte{CtrlPubAck << 4, 18, 0, 1, 0, 14,
+		0x26, 0, 1, 'k', 0, 1, 'a',
+		0x26, 0, 1, 'k', 0, 1, 'b',
+	}
+	pkt, err := (&Decoder{Version: V5, Strict: true}).Decode(bytes.NewReader(userProps))
+	if err != nil {
+		t.Log("user properties rejected in strict mode, err =", err)
+		t.FailNow()
+	}
+
+	if v := pkt.(*PubAckPacket).Props.UserProps["k"]; len(v) != 2 {
+		t.Log("unexpected user properties =", v)
+		t.Fail()
+	}
+}
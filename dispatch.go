@@ -0,0 +1,214 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// DispatchKey returns the ordering key of publish packet, packets with
+// the same key are dispatched in order
+type DispatchKey func(p *PublishPacket) string
+
+// DispatchByTopic orders packets with the same topic name
+func DispatchByTopic(p *PublishPacket) string {
+	return p.TopicName
+}
+
+// WithDispatchPool dispatch the publish packets received with a pool of
+// workers, so that slow handlers won't block the other packets
+//
+// packets with the same key (DispatchByTopic if key is nil) are dispatched
+// in order by the same worker, each worker has a queue of queueSize
+// packets, receiving blocks when the queue is full
+//
+// timeout (0 means no timeout) limits how long the worker waits for the
+// handlers of one packet, handlers exceeded the timeout are left running,
+// and the worker continues with packets of other keys, packets with the
+// same key are held until the handlers return to keep them in order, the
+// worker stops receiving when queueSize packets are held for one key
+func WithDispatchPool(workers, queueSize int, key DispatchKey, timeout time.Duration) Option {
+	return func(c *client) error {
+		if workers < 1 {
+			workers = 1
+		}
+
+		if queueSize < 1 {
+			queueSize = 1
+		}
+
+		if key == nil {
+			key = DispatchByTopic
+		}
+
+		c.options.dispatch = &dispatchConfig{
+			workers:   workers,
+			queueSize: queueSize,
+			key:       key,
+			timeout:   timeout,
+		}
+		return nil
+	}
+}
+
+type dispatchConfig struct {
+	workers   int
+	queueSize int
+	key       DispatchKey
+	timeout   time.Duration
+}
+
+type dispatchItem struct {
+	msg *Message
+	at  time.Time
+}
+
+// dispatchPool dispatch packets to workers by the hash of key
+type dispatchPool struct {
+	parent *client
+	config *dispatchConfig
+	queues []chan *dispatchItem
+}
+
+func newDispatchPool(c *client, config *dispatchConfig) *dispatchPool {
+	d := &dispatchPool{
+		parent: c,
+		config: config,
+		queues: make([]chan *dispatchItem, config.workers),
+	}
+
+	for i := range d.queues {
+		d.queues[i] = make(chan *dispatchItem, config.queueSize)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+// dispatch the message to the worker of its key, blocks when the queue is full
+func (d *dispatchPool) dispatch(m *Message) {
+	h := fnv.New32a()
+	h.Write([]byte(d.config.key(m.packet)))
+	d.queues[h.Sum32()%uint32(len(d.queues))] <- &dispatchItem{msg: m, at: time.Now()}
+	d.parent.metrics.QueueDepth("dispatch", d.depth())
+}
+
+// depth returns the number of packets waiting in all queues
+func (d *dispatchPool) depth() int {
+	n := 0
+	for _, q := range d.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// close the queues, workers exit after all packets dispatched,
+// including packets held by handlers timed out
+func (d *dispatchPool) close() {
+	for _, q := range d.queues {
+		close(q)
+	}
+}
+
+func (d *dispatchPool) work(q <-chan *dispatchItem) {
+	// keys with handlers timed out, packets of these keys are held
+	// until the handlers return to keep them in order
+	held := make(map[string][]*dispatchItem)
+	released := make(chan string)
+	blocked := false
+	for q != nil || len(held) > 0 {
+		in := q
+		if blocked {
+			// stop receiving, dispatch blocks when the queue is full
+			in = nil
+		}
+
+		select {
+		case item, more := <-in:
+			if !more {
+				q = nil
+				continue
+			}
+
+			key := d.config.key(item.msg.packet)
+			if pending, ok := held[key]; ok {
+				held[key] = append(pending, item)
+				if len(held[key]) >= d.config.queueSize {
+					d.parent.log.w("CLIENT dispatch blocked by timed out handler", "topic", item.msg.Topic)
+					blocked = true
+				}
+				continue
+			}
+
+			if !d.run(key, item, released) {
+				held[key] = nil
+			}
+		case key := <-released:
+			pending := held[key]
+			delete(held, key)
+			for i, item := range pending {
+				if !d.run(key, item, released) {
+					held[key] = pending[i+1:]
+					break
+				}
+			}
+			blocked = d.full(held)
+		}
+	}
+}
+
+// full reports whether packets held for any key reach the queue size
+func (d *dispatchPool) full(held map[string][]*dispatchItem) bool {
+	for _, pending := range held {
+		if len(pending) >= d.config.queueSize {
+			return true
+		}
+	}
+	return false
+}
+
+// run the handlers of one packet, returns false if timed out, and the key
+// is sent to released after the handlers return
+func (d *dispatchPool) run(key string, item *dispatchItem, released chan<- string) bool {
+	c := d.parent
+	c.metrics.DispatchLag(time.Since(item.at))
+	if d.config.timeout <= 0 {
+		c.route(item.msg)
+		return true
+	}
+
+	done := make(chan struct{})
+	go func(m *Message) {
+		c.route(m)
+		close(done)
+	}(item.msg)
+
+	t := time.NewTimer(d.config.timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		c.log.w("CLIENT dispatch timeout", "topic", item.msg.Topic, "timeout", d.config.timeout)
+		c.metrics.DispatchTimeout()
+		go func() {
+			<-done
+			released <- key
+		}()
+		return false
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testDispatchPool(workers int, timeout time.Duration) (*client, *dispatchPool) {
+	c := defaultClient()
+	c.router = NewStandardRouter()
+	c.metrics = NewPrometheusMetrics("")
+	return c, newDispatchPool(c, &dispatchConfig{
+		workers:   workers,
+		queueSize: 16,
+		key:       DispatchByTopic,
+		timeout:   timeout,
+	})
+}
+
+func TestDispatchPool_Order(t *testing.T) {
+	c, d := testDispatchPool(2, 0)
+	defer d.close()
+
+	// find a topic dispatched by another worker
+	worker := func(topic string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(topic))
+		return h.Sum32() % 2
+	}
+	fast := "fast"
+	for i := 0; worker(fast) == worker("slow"); i++ {
+		fast = "fast" + strconv.Itoa(i)
+	}
+
+	release := make(chan struct{})
+	c.Handle("slow", func(topic string, qos QosLevel, msg []byte) {
+		<-release
+	})
+
+	var lock sync.Mutex
+	received := make([]string, 0)
+	done := make(chan struct{})
+	c.Handle(fast, func(topic string, qos QosLevel, msg []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, string(msg))
+		if len(received) == 100 {
+			close(done)
+		}
+	})
+
+	d.dispatch(newMessage(&PublishPacket{TopicName: "slow"}))
+	for i := 0; i < 100; i++ {
+		d.dispatch(newMessage(&PublishPacket{TopicName: fast, Payload: []byte(strconv.Itoa(i))}))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Log("packets blocked by slow handler of another topic")
+		t.FailNow()
+	}
+	close(release)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i, msg := range received {
+		if msg != strconv.Itoa(i) {
+			t.Log("unexpected order at", i, "msg =", msg)
+			t.FailNow()
+		}
+	}
+}
+
+func TestDispatchPool_Timeout(t *testing.T) {
+	c, d := testDispatchPool(1, 10*time.Millisecond)
+	defer d.close()
+
+	release := make(chan struct{})
+	slow := make(chan string, 2)
+	c.Handle("slow", func(topic string, qos QosLevel, msg []byte) {
+		if string(msg) == "1" {
+			<-release
+		}
+		slow <- string(msg)
+	})
+
+	done := make(chan struct{})
+	c.Handle("next", func(topic string, qos QosLevel, msg []byte) {
+		close(done)
+	})
+
+	d.dispatch(newMessage(&PublishPacket{TopicName: "slow", Payload: []byte("1")}))
+	d.dispatch(newMessage(&PublishPacket{TopicName: "slow", Payload: []byte("2")}))
+	d.dispatch(newMessage(&PublishPacket{TopicName: "next"}))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Log("worker blocked after timeout")
+		t.FailNow()
+	}
+
+	// packets with the same key are held until the handler returns
+	select {
+	case msg := <-slow:
+		t.Log("packet of timed out key not held, msg =", msg)
+		t.FailNow()
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	for _, expected := range []string{"1", "2"} {
+		select {
+		case msg := <-slow:
+			if msg != expected {
+				t.Log("unexpected order, expected =", expected, "msg =", msg)
+				t.FailNow()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("held packet not dispatched", expected)
+			t.FailNow()
+		}
+	}
+
+	m := c.metrics.(*PrometheusMetrics)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.timeouts != 1 || m.lag.count != 3 {
+		t.Log("unexpected metrics, timeouts =", m.timeouts, "lag count =", m.lag.count)
+		t.Fail()
+	}
+}
+
+func TestDispatchPool_HeldFull(t *testing.T) {
+	c := defaultClient()
+	c.router = NewStandardRouter()
+	d := newDispatchPool(c, &dispatchConfig{
+		workers:   1,
+		queueSize: 1,
+		key:       DispatchByTopic,
+		timeout:   10 * time.Millisecond,
+	})
+	defer d.close()
+
+	release := make(chan struct{})
+	slow := make(chan string, 2)
+	c.Handle("slow", func(topic string, qos QosLevel, msg []byte) {
+		if string(msg) == "1" {
+			<-release
+		}
+		slow <- string(msg)
+	})
+	c.Handle("next", func(topic string, qos QosLevel, msg []byte) {})
+
+	d.dispatch(newMessage(&PublishPacket{TopicName: "slow", Payload: []byte("1")}))
+	time.Sleep(50 * time.Millisecond)
+	d.dispatch(newMessage(&PublishPacket{TopicName: "slow", Payload: []byte("2")}))
+	time.Sleep(10 * time.Millisecond)
+
+	// held packets reached queue size, the worker stops receiving
+	d.dispatch(newMessage(&PublishPacket{TopicName: "next"}))
+	dispatched := make(chan struct{})
+	go func() {
+		d.dispatch(newMessage(&PublishPacket{TopicName: "next"}))
+		close(dispatched)
+	}()
+
+	select {
+	case <-dispatched:
+		t.Log("dispatch not blocked by held packets")
+		t.Fail()
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Log("dispatch blocked after handler returned")
+		t.FailNow()
+	}
+
+	for _, expected := range []string{"1", "2"} {
+		if msg := <-slow; msg != expected {
+			t.Log("unexpected order, expected =", expected, "msg =", msg)
+			t.Fail()
+		}
+	}
+}
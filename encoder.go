@@ -16,6 +16,10 @@
 
 package libmqtt
 
+import (
+	"sort"
+)
+
 func encodeDataWithLen(data []byte) []byte {
 	l := len(data)
 	result := []byte{byte(l >> 8), byte(l)}
@@ -36,3 +40,83 @@ func writeRemainLength(n int, w BufferWriter) {
 		w.WriteByte(encodedByte)
 	}
 }
+
+func encodeStringWithLen(s string) []byte {
+	return encodeDataWithLen([]byte(s))
+}
+
+// varIntBytes encode n as variable byte integer
+func varIntBytes(n int) []byte {
+	result := make([]byte, 0, 4)
+	for {
+		encodedByte := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			encodedByte |= 128
+		}
+		result = append(result, encodedByte)
+		if n <= 0 {
+			return result
+		}
+	}
+}
+
+// encodeProps prepends the property length to encoded properties
+func encodeProps(props []byte) []byte {
+	return append(varIntBytes(len(props)), props...)
+}
+
+func appendPropByte(buf []byte, key byte, v byte) []byte {
+	return append(buf, key, v)
+}
+
+func appendPropUint16(buf []byte, key byte, v uint16) []byte {
+	return append(buf, key, byte(v>>8), byte(v))
+}
+
+func appendPropUint32(buf []byte, key byte, v uint32) []byte {
+	return append(buf, key, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendPropVarInt(buf []byte, key byte, v int) []byte {
+	return append(append(buf, key), varIntBytes(v)...)
+}
+
+func appendPropString(buf []byte, key byte, v string) []byte {
+	return append(append(buf, key), encodeStringWithLen(v)...)
+}
+
+func appendPropData(buf []byte, key byte, v []byte) []byte {
+	return append(append(buf, key), encodeDataWithLen(v)...)
+}
+
+func appendUserProps(buf []byte, props UserProps) []byte {
+	if len(props) == 0 {
+		return buf
+	}
+
+	// keep the output stable
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range props[k] {
+			buf = append(buf, propKeyUserProps)
+			buf = append(buf, encodeStringWithLen(k)...)
+			buf = append(buf, encodeStringWithLen(v)...)
+		}
+	}
+	return buf
+}
+
+// appendReasonProps encode the reason string and user properties,
+// which is all the properties of most ack packets
+func appendReasonProps(buf []byte, reason string, userProps UserProps) []byte {
+	if reason != "" {
+		buf = appendPropString(buf, propKeyReasonString, reason)
+	}
+	return appendUserProps(buf, userProps)
+}
@@ -39,18 +39,15 @@ func NewRedisPersist(conn *redis.Client, mainKey string) *RedisPersist {
 		mainKey = defaultRedisKey
 	}
 
-	buf := &bytes.Buffer{}
 	return &RedisPersist{
 		conn:    conn,
 		mainKey: mainKey,
-		buf:     buf,
 	}
 }
 
 // RedisPersist defines the persist method with redis
 type RedisPersist struct {
 	conn    *redis.Client
-	buf     *bytes.Buffer
 	mainKey string
 }
 
@@ -69,14 +66,12 @@ func (r *RedisPersist) Store(key string, p lib.Packet) error {
 		return nil
 	}
 
-	if p.WriteTo(r.buf) != nil {
-		if ok, err := r.conn.HSet(r.mainKey, key, r.buf.String()).Result(); !ok {
-			return err
-		}
+	buf := &bytes.Buffer{}
+	if err := p.WriteTo(buf); err != nil {
+		return err
 	}
-	r.buf.Reset()
 
-	return nil
+	return r.conn.HSet(r.mainKey, key, buf.String()).Err()
 }
 
 // Load a packet from stored data according to the key
@@ -85,7 +80,7 @@ func (r *RedisPersist) Load(key string) (lib.Packet, bool) {
 		return nil, false
 	}
 
-	if rs, err := r.conn.HGet(r.mainKey, key).Result(); err != nil {
+	if rs, err := r.conn.HGet(r.mainKey, key).Result(); err == nil {
 		if pkt, err := lib.DecodeOnePacket(strings.NewReader(rs)); err != nil {
 			// delete wrong packet
 			r.Delete(key)
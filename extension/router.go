@@ -17,11 +17,58 @@
 package extension
 
 import (
+	"strings"
+	"sync"
+
 	lib "github.com/goiiot/libmqtt"
 )
 
-// HttpRouter is a HTTP URL style router
+var _ lib.MessageRouter = (*HttpRouter)(nil)
+
+// Param is a named parameter extracted from topic
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Params is the named parameters extracted from topic, in the order
+// they appeared in the route
+type Params []Param
+
+// ByName returns the value of the first param with name,
+// empty string if not found
+func (ps Params) ByName(name string) string {
+	for _, p := range ps {
+		if p.Key == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// ParamsHandler handles the message routed by HttpRouter with the
+// named parameters extracted from topic
+type ParamsHandler func(m *lib.Message, ps Params)
+
+// NewHttpRouter will create a HTTP URL style router
+func NewHttpRouter() *HttpRouter {
+	return &HttpRouter{}
+}
+
+// HttpRouter is a HTTP URL style router, routes are topics with levels
+// of named parameters, e.g. `devices/:id/telemetry/*rest`
+//
+// `:name` matches exactly one level, `*name` matches all the rest levels
+// (at least one) and must be the last level, static levels take priority
+// over `:name` which takes priority over `*name`, only the handler of the
+// best matched route will be called
+//
+// MQTT wildcards `+` and `#` are not supported in routes, use `:name` and
+// `*name` instead, routes with them are rejected rather than matched
+// literally
 type HttpRouter struct {
+	lock sync.RWMutex
+	root *httpNode
 }
 
 // Name of HttpRouter is "HttpRouter"
@@ -33,12 +80,179 @@ func (r *HttpRouter) Name() string {
 	return "HttpRouter"
 }
 
-// Handle the topic with TopicHandler h
+// Handle the topic with TopicHandler h, it panics if the route is not
+// valid or conflicts with the routes registered
 func (r *HttpRouter) Handle(topic string, h lib.TopicHandler) {
+	if h == nil {
+		return
+	}
+
+	r.handle(topic, func(m *lib.Message, ps Params) {
+		h(m.Topic, m.Qos, m.Payload)
+	}, false)
+}
+
+// HandleMessage the topic with MessageHandler h, it panics if the route
+// is not valid or conflicts with the routes registered
+func (r *HttpRouter) HandleMessage(topic string, h lib.MessageHandler) {
+	if h == nil {
+		return
+	}
 
+	r.handle(topic, func(m *lib.Message, ps Params) {
+		h(m)
+	}, true)
 }
 
-// Dispatch the received packet
+// HandleParams the topic with ParamsHandler h, it panics if the route
+// is not valid or conflicts with the routes registered
+func (r *HttpRouter) HandleParams(topic string, h ParamsHandler) {
+	if h == nil {
+		return
+	}
+
+	r.handle(topic, h, true)
+}
+
+// Dispatch the received packet, the client dispatches messages received
+// with DispatchMessage instead, so that handlers can Ack and Reply them
 func (r *HttpRouter) Dispatch(p *lib.PublishPacket) {
+	if p == nil {
+		return
+	}
+
+	r.DispatchMessage(lib.NewMessage(p))
+}
+
+// DispatchMessage the received message
+func (r *HttpRouter) DispatchMessage(m *lib.Message) {
+	if r == nil || m == nil {
+		return
+	}
+
+	r.lock.RLock()
+	var (
+		route *httpRoute
+		ps    Params
+	)
+	if r.root != nil {
+		route, ps = r.root.match(strings.Split(m.Topic, "/"), nil)
+	}
+	r.lock.RUnlock()
+
+	if route == nil {
+		return
+	}
+
+	if !route.message {
+		route.h(m, ps)
+		return
+	}
+
+	lib.MessageHandler(func(m *lib.Message) {
+		route.h(m, ps)
+	}).Handle(m)
+}
 
+func (r *HttpRouter) handle(topic string, h ParamsHandler, message bool) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.root == nil {
+		r.root = newHttpNode()
+	}
+
+	levels := strings.Split(topic, "/")
+	node := r.root
+	for i, level := range levels {
+		node = node.child(topic, level, i == len(levels)-1)
+	}
+	node.route = &httpRoute{h: h, message: message}
+}
+
+// httpRoute is the handler registered
+type httpRoute struct {
+	h       ParamsHandler
+	message bool // whether h is a MessageHandler or ParamsHandler
+}
+
+// httpNode is the node of route tree, one node for one topic level
+type httpNode struct {
+	static   map[string]*httpNode
+	param    *httpNode // child of `:name`
+	catchAll *httpNode // child of `*name`
+	name     string    // param name of `:name` or `*name` node
+	route    *httpRoute
+}
+
+func newHttpNode() *httpNode {
+	return &httpNode{static: make(map[string]*httpNode)}
+}
+
+// child returns the child node of the route level, created if not exists
+func (n *httpNode) child(topic, level string, last bool) *httpNode {
+	if strings.ContainsAny(level, "+#") {
+		panic("extension: MQTT wildcard in route " + topic +
+			" not supported, use :name or *name instead")
+	}
+
+	if level == "" || (level[0] != ':' && level[0] != '*') {
+		c, ok := n.static[level]
+		if !ok {
+			c = newHttpNode()
+			n.static[level] = c
+		}
+		return c
+	}
+
+	name := level[1:]
+	if name == "" {
+		panic("extension: empty param name in route " + topic)
+	}
+
+	slot := &n.param
+	if level[0] == '*' {
+		if !last {
+			panic("extension: catch-all param must be the last level in route " + topic)
+		}
+		slot = &n.catchAll
+	}
+
+	if *slot == nil {
+		*slot = newHttpNode()
+		(*slot).name = name
+	} else if (*slot).name != name {
+		panic("extension: param " + level + " in route " + topic +
+			" conflicts with the param name " + (*slot).name + " registered")
+	}
+	return *slot
+}
+
+// match the rest topic levels, return the route matched with params
+func (n *httpNode) match(levels []string, ps Params) (*httpRoute, Params) {
+	if len(levels) == 0 {
+		return n.route, ps
+	}
+
+	if c, ok := n.static[levels[0]]; ok {
+		if route, ps := c.match(levels[1:], ps); route != nil {
+			return route, ps
+		}
+	}
+
+	if n.param != nil {
+		route, matched := n.param.match(levels[1:], append(ps, Param{Key: n.param.name, Value: levels[0]}))
+		if route != nil {
+			return route, matched
+		}
+	}
+
+	if n.catchAll != nil && n.catchAll.route != nil {
+		return n.catchAll.route, append(ps, Param{Key: n.catchAll.name, Value: strings.Join(levels, "/")})
+	}
+	return nil, nil
 }
@@ -15,3 +15,156 @@
  */
 
 package extension
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	lib "github.com/goiiot/libmqtt"
+)
+
+func TestHttpRouter_Dispatch(t *testing.T) {
+	r := NewHttpRouter()
+
+	var (
+		route  string
+		params Params
+	)
+	handle := func(name string) ParamsHandler {
+		return func(m *lib.Message, ps Params) {
+			route, params = name, ps
+		}
+	}
+	r.HandleParams("devices/:id/telemetry/*rest", handle("telemetry"))
+	r.HandleParams("devices/:id/status", handle("status"))
+	r.HandleParams("devices/all/status", handle("all"))
+	r.HandleParams("devices/*rest", handle("devices"))
+
+	for _, c := range []struct {
+		topic  string
+		route  string
+		params Params
+	}{
+		{"devices/1/telemetry/temp/room1", "telemetry", Params{{"id", "1"}, {"rest", "temp/room1"}}},
+		{"devices/1/status", "status", Params{{"id", "1"}}},
+		{"devices/all/status", "all", nil},
+		{"devices/1/telemetry", "devices", Params{{"rest", "1/telemetry"}}},
+		{"devices", "", nil},
+		{"others/1/status", "", nil},
+	} {
+		route, params = "", nil
+		r.Dispatch(&lib.PublishPacket{TopicName: c.topic})
+		if route != c.route || len(params) != len(c.params) {
+			t.Log("bad route of topic =", c.topic, ", route =", route, ", params =", params)
+			t.Fail()
+			continue
+		}
+
+		for _, p := range c.params {
+			if params.ByName(p.Key) != p.Value {
+				t.Log("bad params of topic =", c.topic, ", params =", params)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestHttpRouter_HandleConflict(t *testing.T) {
+	r := NewHttpRouter()
+	r.HandleParams("devices/:id", func(m *lib.Message, ps Params) {})
+
+	for _, topic := range []string{"devices/:name", "devices/*rest/status", "devices/:", "devices/+/status", "devices/#"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Log("invalid route accepted, topic =", topic)
+					t.Fail()
+				}
+			}()
+			r.HandleParams(topic, func(m *lib.Message, ps Params) {})
+		}()
+	}
+}
+
+func TestHttpRouter_DispatchMessage(t *testing.T) {
+	r := &HttpRouter{}
+
+	var received *lib.Message
+	r.HandleMessage("devices/:id/status", func(m *lib.Message) {
+		received = m
+	})
+
+	m := &lib.Message{Topic: "devices/1/status", Qos: lib.Qos1}
+	r.DispatchMessage(m)
+	if received != m {
+		t.Log("message not dispatched")
+		t.Fail()
+	}
+}
+
+func TestHttpRouter_ManualAck(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	r := NewHttpRouter()
+	c, err := lib.NewClient(
+		lib.WithServer("pipe://server"),
+		lib.WithKeepalive(0, 1.2),
+		lib.WithManualAck(true),
+		lib.WithRouter(r),
+		lib.WithDialer(func(ctx context.Context, server string) (net.Conn, error) {
+			return clientSide, nil
+		}),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+
+	msgC := make(chan *lib.Message, 1)
+	r.HandleParams("devices/:id/status", func(m *lib.Message, ps Params) {
+		if ps.ByName("id") != "1" {
+			t.Log("bad params =", ps)
+			t.Fail()
+		}
+		msgC <- m
+	})
+	c.Connect(func(server string, code lib.ConnAckCode, err error) {})
+
+	write := func(pkt lib.Packet) {
+		buf := &bytes.Buffer{}
+		pkt.WriteTo(buf)
+		serverSide.Write(buf.Bytes())
+	}
+	if _, err := lib.DecodeOnePacket(serverSide); err != nil {
+		t.Log("connect failed, err =", err)
+		t.FailNow()
+	}
+	write(&lib.ConnAckPacket{})
+
+	write(&lib.PublishPacket{TopicName: "devices/1/status", Qos: lib.Qos1, PacketID: 1})
+	select {
+	case m := <-msgC:
+		if m.Server != "pipe://server" || m.PacketID != 1 {
+			t.Log("bad message received, message =", m)
+			t.Fail()
+		}
+		m.Ack()
+	case <-time.After(5 * time.Second):
+		t.Log("message not routed")
+		t.FailNow()
+	}
+
+	serverSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if ack, err := lib.DecodeOnePacket(serverSide); err != nil {
+		t.Log("PubAck not sent after Ack, err =", err)
+		t.Fail()
+	} else if p, _ := ack.(*lib.PubAckPacket); p == nil || p.PacketID != 1 {
+		t.Log("unexpected packet after Ack =", ack)
+		t.Fail()
+	}
+}
@@ -28,6 +28,20 @@ type ConnHandler func(server string, code ConnAckCode, err error)
 // code can be SubOkMaxQos0, SubOkMaxQos1, SubOkMaxQos2, SubFail
 type TopicHandler func(topic string, qos QosLevel, msg []byte)
 
+// MessageHandler handles topic sub message with the Message received,
+// which carries the flags, packet id, server, MQTT 5 properties and receive
+// time of the message, in manual ack mode, the message must be acknowledged
+// with Ack or Nack
+type MessageHandler func(m *Message)
+
+// Handle calls the handler with message m, routers should call
+// MessageHandler with Handle, so that messages delivered won't be
+// acknowledged automatically in manual ack mode
+func (h MessageHandler) Handle(m *Message) {
+	m.deliver()
+	h(m)
+}
+
 // PubHandler handles the error occurred when publish some message
 // if err is not nil, that means a error occurred when sending pub msg
 type PubHandler func(topic string, err error)
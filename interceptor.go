@@ -0,0 +1,61 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+// PacketHandler handles a packet sent to or received from the server
+type PacketHandler func(server string, pkt Packet) error
+
+// Interceptor is the middleware of packets, it can observe or mutate
+// the packet, pass it (or another packet) to next, or drop it by
+// not calling next at all, next can be called with delay
+//
+// Send interceptors handle a copy of packet for every send, so changes
+// are not applied again when the packet is resent after reconnected,
+// but values referred by the packet (e.g. Payload, Props) are shared
+//
+// Packets dropped are not acknowledged, so operations with packet id
+// (e.g. QoS 1 publish) dropped by interceptor won't complete
+type Interceptor func(next PacketHandler) PacketHandler
+
+// WithSendInterceptors set interceptors for packets to be sent to server,
+// the first interceptor is the first to handle the packet, the error
+// returned by next is the error of writing the packet to connection
+func WithSendInterceptors(interceptors ...Interceptor) Option {
+	return func(c *client) error {
+		c.options.sendInterceptors = append(c.options.sendInterceptors, interceptors...)
+		return nil
+	}
+}
+
+// WithRecvInterceptors set interceptors for packets received from server,
+// the first interceptor is the first to handle the packet, next must be
+// called before the interceptor returns, errors returned by interceptors
+// are logged and the packet will be dropped
+func WithRecvInterceptors(interceptors ...Interceptor) Option {
+	return func(c *client) error {
+		c.options.recvInterceptors = append(c.options.recvInterceptors, interceptors...)
+		return nil
+	}
+}
+
+// chainInterceptors wraps h with interceptors, the first one is the outermost
+func chainInterceptors(interceptors []Interceptor, h PacketHandler) PacketHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		h = interceptors[i](h)
+	}
+	return h
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterceptors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	published := make(chan *PublishPacket, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := DecodeOnePacket(conn); err != nil {
+			return
+		}
+		testWritePacket(conn, &ConnAckPacket{})
+
+		for {
+			pkt, err := DecodeOnePacket(conn)
+			if err != nil {
+				return
+			}
+
+			if p, ok := pkt.(*PublishPacket); ok {
+				published <- p
+				testWritePacket(conn, &PublishPacket{TopicName: "foo", Payload: p.Payload})
+			}
+		}
+	}()
+
+	var (
+		lock     sync.Mutex
+		sent     []CtrlType
+		received []CtrlType
+	)
+	record := func(types *[]CtrlType) Interceptor {
+		return func(next PacketHandler) PacketHandler {
+			return func(server string, pkt Packet) error {
+				if server != l.Addr().String() {
+					t.Log("unexpected server =", server)
+					t.Fail()
+				}
+				lock.Lock()
+				*types = append(*types, pkt.Type())
+				lock.Unlock()
+				return next(server, pkt)
+			}
+		}
+	}
+
+	prefix := func(next PacketHandler) PacketHandler {
+		return func(server string, pkt Packet) error {
+			if p, ok := pkt.(*PublishPacket); ok {
+				if p.TopicName == "drop" {
+					return nil
+				}
+				p.TopicName = "prefix/" + p.TopicName
+			}
+			return next(server, pkt)
+		}
+	}
+
+	unPrefix := func(next PacketHandler) PacketHandler {
+		return func(server string, pkt Packet) error {
+			if p, ok := pkt.(*PublishPacket); ok {
+				p.TopicName = strings.TrimPrefix(p.TopicName, "prefix/")
+			}
+			return next(server, pkt)
+		}
+	}
+
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithSendInterceptors(record(&sent), prefix),
+		WithRecvInterceptors(record(&received), unPrefix),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	handled := make(chan string, 1)
+	c.Handle("foo", func(topic string, qos QosLevel, msg []byte) {
+		handled <- string(msg)
+	})
+
+	c.Connect(nil)
+	c.Publish(&PublishPacket{TopicName: "drop", Payload: []byte("dropped")})
+	c.Publish(&PublishPacket{TopicName: "foo", Payload: []byte("bar")})
+
+	select {
+	case p := <-published:
+		if p.TopicName != "prefix/foo" || string(p.Payload) != "bar" {
+			t.Log("unexpected publish packet =", p)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("publish packet not received")
+		t.FailNow()
+	}
+
+	select {
+	case msg := <-handled:
+		if msg != "bar" {
+			t.Log("unexpected message =", msg)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("message not handled")
+		t.Fail()
+	}
+
+	lock.Lock()
+	if len(sent) != 3 || sent[0] != CtrlConn || sent[1] != CtrlPublish ||
+		len(received) != 2 || received[0] != CtrlConnAck || received[1] != CtrlPublish {
+		t.Log("sent =", sent, "received =", received)
+		t.Fail()
+	}
+	lock.Unlock()
+
+	c.Destroy(true)
+}
+
+func TestInterceptors_Resend(t *testing.T) {
+	c := defaultClient()
+	buf := &bytes.Buffer{}
+	conn := &connImpl{parent: c, name: "a", connW: bufio.NewWriter(buf)}
+	conn.sendChain = chainInterceptors([]Interceptor{func(next PacketHandler) PacketHandler {
+		return func(server string, pkt Packet) error {
+			switch p := pkt.(type) {
+			case *PublishPacket:
+				p.TopicName = "prefix/" + p.TopicName
+			case *SubscribePacket:
+				p.Topics[0].Name = "prefix/" + p.Topics[0].Name
+			}
+			return next(server, pkt)
+		}
+	}}, conn.writePacket)
+
+	pub := &PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1}
+	sub := &SubscribePacket{Topics: []*Topic{{Name: "bar"}}, PacketID: 2}
+	c.idGen.use(1, pub)
+	c.idGen.use(2, sub)
+	conn.write(pub)
+	conn.write(sub)
+
+	// resent after reconnected
+	conn.resume(true)
+
+	for i, expected := range []string{"prefix/foo", "prefix/bar", "prefix/foo", "prefix/bar"} {
+		pkt, err := DecodeOnePacket(buf)
+		topic := ""
+		switch p := pkt.(type) {
+		case *PublishPacket:
+			topic = p.TopicName
+		case *SubscribePacket:
+			topic = p.Topics[0].Name
+		}
+		if topic != expected {
+			t.Log("unexpected packet at", i, "packet =", pkt, "err =", err)
+			t.Fail()
+		}
+	}
+
+	if pub.TopicName != "foo" || sub.Topics[0].Name != "bar" {
+		t.Log("in-flight packets changed by interceptor")
+		t.Fail()
+	}
+}
@@ -25,10 +25,47 @@ type Packet interface {
 	WriteTo(BufferWriter) error
 }
 
+// BasePacket holds the MQTT protocol version of a packet,
+// which decides the encoding of the packet
+type BasePacket struct {
+	// ProtoVersion is the protocol level of this packet,
+	// zero value means V311
+	ProtoVersion ProtocolLevel
+}
+
+// Version return the protocol version of this packet, V311 by default
+func (b *BasePacket) Version() ProtocolLevel {
+	if b.ProtoVersion == 0 {
+		return V311
+	}
+	return b.ProtoVersion
+}
+
+func (b *BasePacket) setVersion(version ProtocolLevel) {
+	b.ProtoVersion = version
+}
+
+// versionedPacket is the packet whose protocol version can be
+// decided by the connection it will be sent to
+type versionedPacket interface {
+	Version() ProtocolLevel
+	setVersion(ProtocolLevel)
+}
+
 // Topic for both topic name and topic qos
 type Topic struct {
 	Name string
 	Qos  QosLevel
+
+	// MQTT 5 subscription options, ignored in V311
+
+	// NoLocal means server will not forward messages published by this client
+	NoLocal bool
+	// RetainAsPublished means server will keep the retain flag of forwarded messages
+	RetainAsPublished bool
+	// RetainHandling decides when to send retained messages,
+	// 0 at subscribe time, 1 only for new subscription, 2 never
+	RetainHandling byte
 }
 
 const (
@@ -67,6 +104,8 @@ const (
 	CtrlPingResp
 	// CtrlDisConn Disconnect
 	CtrlDisConn
+	// CtrlAuth Authentication exchange (MQTT 5)
+	CtrlAuth
 )
 
 // ProtocolLevel MQTT Protocol
@@ -95,6 +134,157 @@ var (
 	mqtt = []byte("MQTT")
 )
 
+// ReasonCode is the MQTT 5 reason code carried by
+// ConnAck, PubAck, PubRecv, PubRel, PubComp, SubAck, UnSubAck and DisConn
+type ReasonCode = byte
+
+const (
+	// CodeSuccess success (also normal disconnection, granted QoS 0)
+	CodeSuccess ReasonCode = 0x00
+	// CodeGrantedQos1 granted QoS 1
+	CodeGrantedQos1 ReasonCode = 0x01
+	// CodeGrantedQos2 granted QoS 2
+	CodeGrantedQos2 ReasonCode = 0x02
+	// CodeDisconnWithWill disconnect with will message
+	CodeDisconnWithWill ReasonCode = 0x04
+	// CodeNoMatchingSubscribers no matching subscribers
+	CodeNoMatchingSubscribers ReasonCode = 0x10
+	// CodeNoSubscriptionExisted no subscription existed
+	CodeNoSubscriptionExisted ReasonCode = 0x11
+	// CodeContinueAuth continue authentication
+	CodeContinueAuth ReasonCode = 0x18
+	// CodeReAuth re-authenticate
+	CodeReAuth ReasonCode = 0x19
+	// CodeUnspecifiedError unspecified error
+	CodeUnspecifiedError ReasonCode = 0x80
+	// CodeMalformedPacket malformed packet
+	CodeMalformedPacket ReasonCode = 0x81
+	// CodeProtoError protocol error
+	CodeProtoError ReasonCode = 0x82
+	// CodeImplementationSpecificError implementation specific error
+	CodeImplementationSpecificError ReasonCode = 0x83
+	// CodeUnsupportedProtoVersion unsupported protocol version
+	CodeUnsupportedProtoVersion ReasonCode = 0x84
+	// CodeClientIDNotValid client identifier not valid
+	CodeClientIDNotValid ReasonCode = 0x85
+	// CodeBadUserPass bad username or password
+	CodeBadUserPass ReasonCode = 0x86
+	// CodeNotAuthorized not authorized
+	CodeNotAuthorized ReasonCode = 0x87
+	// CodeServerUnavailable server unavailable
+	CodeServerUnavailable ReasonCode = 0x88
+	// CodeServerBusy server busy
+	CodeServerBusy ReasonCode = 0x89
+	// CodeBanned banned
+	CodeBanned ReasonCode = 0x8A
+	// CodeServerShuttingDown server shutting down
+	CodeServerShuttingDown ReasonCode = 0x8B
+	// CodeBadAuthenticationMethod bad authentication method
+	CodeBadAuthenticationMethod ReasonCode = 0x8C
+	// CodeKeepaliveTimeout keep alive timeout
+	CodeKeepaliveTimeout ReasonCode = 0x8D
+	// CodeSessionTakenOver session taken over
+	CodeSessionTakenOver ReasonCode = 0x8E
+	// CodeTopicFilterInvalid topic filter invalid
+	CodeTopicFilterInvalid ReasonCode = 0x8F
+	// CodeTopicNameInvalid topic name invalid
+	CodeTopicNameInvalid ReasonCode = 0x90
+	// CodePacketIDInUse packet identifier in use
+	CodePacketIDInUse ReasonCode = 0x91
+	// CodePacketIDNotFound packet identifier not found
+	CodePacketIDNotFound ReasonCode = 0x92
+	// CodeReceiveMaxExceeded receive maximum exceeded
+	CodeReceiveMaxExceeded ReasonCode = 0x93
+	// CodeTopicAliasInvalid topic alias invalid
+	CodeTopicAliasInvalid ReasonCode = 0x94
+	// CodePacketTooLarge packet too large
+	CodePacketTooLarge ReasonCode = 0x95
+	// CodeMessageRateTooHigh message rate too high
+	CodeMessageRateTooHigh ReasonCode = 0x96
+	// CodeQuotaExceeded quota exceeded
+	CodeQuotaExceeded ReasonCode = 0x97
+	// CodeAdminAction administrative action
+	CodeAdminAction ReasonCode = 0x98
+	// CodePayloadFormatInvalid payload format invalid
+	CodePayloadFormatInvalid ReasonCode = 0x99
+	// CodeRetainNotSupported retain not supported
+	CodeRetainNotSupported ReasonCode = 0x9A
+	// CodeQosNotSupported QoS not supported
+	CodeQosNotSupported ReasonCode = 0x9B
+	// CodeUseAnotherServer use another server
+	CodeUseAnotherServer ReasonCode = 0x9C
+	// CodeServerMoved server moved
+	CodeServerMoved ReasonCode = 0x9D
+	// CodeSharedSubNotSupported shared subscriptions not supported
+	CodeSharedSubNotSupported ReasonCode = 0x9E
+	// CodeConnectionRateExceeded connection rate exceeded
+	CodeConnectionRateExceeded ReasonCode = 0x9F
+	// CodeMaxConnectTime maximum connect time
+	CodeMaxConnectTime ReasonCode = 0xA0
+	// CodeSubIDNotSupported subscription identifiers not supported
+	CodeSubIDNotSupported ReasonCode = 0xA1
+	// CodeWildcardSubNotSupported wildcard subscriptions not supported
+	CodeWildcardSubNotSupported ReasonCode = 0xA2
+)
+
+// MQTT 5 property identifiers
+const (
+	propKeyPayloadFormatIndicator = 0x01
+	propKeyMessageExpiryInterval  = 0x02
+	propKeyContentType            = 0x03
+	propKeyRespTopic              = 0x08
+	propKeyCorrelationData        = 0x09
+	propKeySubID                  = 0x0B
+	propKeySessionExpiryInterval  = 0x11
+	propKeyAssignedClientID       = 0x12
+	propKeyServerKeepalive        = 0x13
+	propKeyAuthMethod             = 0x15
+	propKeyAuthData               = 0x16
+	propKeyReqProblemInfo         = 0x17
+	propKeyWillDelayInterval      = 0x18
+	propKeyReqRespInfo            = 0x19
+	propKeyRespInfo               = 0x1A
+	propKeyServerRef              = 0x1C
+	propKeyReasonString           = 0x1F
+	propKeyMaxRecv                = 0x21
+	propKeyMaxTopicAlias          = 0x22
+	propKeyTopicAlias             = 0x23
+	propKeyMaxQos                 = 0x24
+	propKeyRetainAvail            = 0x25
+	propKeyUserProps              = 0x26
+	propKeyMaxPacketSize          = 0x27
+	propKeyWildcardSubAvail       = 0x28
+	propKeySubIDAvail             = 0x29
+	propKeySharedSubAvail         = 0x2A
+)
+
+// UserProps contains user defined properties (MQTT 5)
+type UserProps map[string][]string
+
+// Add a value to the key
+func (u UserProps) Add(key, value string) {
+	u[key] = append(u[key], value)
+}
+
+// Get the first value of the key
+func (u UserProps) Get(key string) (string, bool) {
+	v, ok := u[key]
+	if !ok || len(v) == 0 {
+		return "", false
+	}
+	return v[0], true
+}
+
+// Set the key with value, replacing existing values
+func (u UserProps) Set(key, value string) {
+	u[key] = []string{value}
+}
+
+// Del the key and its values
+func (u UserProps) Del(key string) {
+	delete(u, key)
+}
+
 // ConnAckCode is connection response code from server
 type ConnAckCode = byte
 
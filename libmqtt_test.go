@@ -65,7 +65,7 @@ func initConn() {
 	testConnWillMsg = &ConnPacket{
 		Username:     testUsername,
 		Password:     testPassword,
-		protoLevel:   testProtoVersion,
+		BasePacket:   BasePacket{ProtoVersion: testProtoVersion},
 		ClientID:     testClientID,
 		CleanSession: testCleanSession,
 		IsWill:       testWill,
@@ -97,7 +97,7 @@ func initConn() {
 	testConnMsg = &ConnPacket{
 		Username:     testUsername,
 		Password:     testPassword,
-		protoLevel:   testProtoVersion,
+		BasePacket:   BasePacket{ProtoVersion: testProtoVersion},
 		ClientID:     testClientID,
 		CleanSession: testCleanSession,
 		Keepalive:    testKeepalive,
@@ -17,12 +17,12 @@
 package libmqtt
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
-var lg *logger
-
 // LogLevel is used to set log level in client creation
 type LogLevel int
 
@@ -41,6 +41,22 @@ const (
 	Error
 )
 
+// Logger is the structured logger used by client, fields are
+// key/value pairs, e.g. "server", "localhost:1883", "packet_id", 1
+type Logger interface {
+	// Enabled reports whether messages of this level should be logged
+	Enabled(level LogLevel) bool
+
+	// Log a message with fields
+	Log(level LogLevel, msg string, fields ...interface{})
+}
+
+// NewStdLogger creates a Logger writes to stderr with standard library
+// log package, messages with level lower than l are discarded
+func NewStdLogger(l LogLevel) Logger {
+	return newLogger(l)
+}
+
 type logger struct {
 	verbose *log.Logger
 	debug   *log.Logger
@@ -129,3 +145,96 @@ func (l *logger) e(data ...interface{}) {
 	}
 	l.error.Println(data...)
 }
+
+func (l *logger) target(level LogLevel) *log.Logger {
+	if l == nil {
+		return nil
+	}
+
+	switch level {
+	case Verbose:
+		return l.verbose
+	case Debug:
+		return l.debug
+	case Info:
+		return l.info
+	case Warning:
+		return l.warning
+	case Error:
+		return l.error
+	}
+	return nil
+}
+
+// Enabled reports whether messages of this level should be logged
+func (l *logger) Enabled(level LogLevel) bool {
+	return l.target(level) != nil
+}
+
+// Log a message with fields formatted as key=value
+func (l *logger) Log(level LogLevel, msg string, fields ...interface{}) {
+	if t := l.target(level); t != nil {
+		t.Println(formatFields(msg, fields))
+	}
+}
+
+func formatFields(msg string, fields []interface{}) string {
+	if len(fields) == 0 {
+		return msg
+	}
+
+	b := &strings.Builder{}
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(' ')
+		if i+1 < len(fields) {
+			fmt.Fprintf(b, "%v=%v", fields[i], fields[i+1])
+		} else {
+			fmt.Fprintf(b, "!BADKEY=%v", fields[i])
+		}
+	}
+	return b.String()
+}
+
+// fieldLogger logs with a Logger and fields added to every message
+type fieldLogger struct {
+	l      Logger
+	fields []interface{}
+}
+
+func newFieldLogger(l Logger) *fieldLogger {
+	if l == nil {
+		return nil
+	}
+	return &fieldLogger{l: l}
+}
+
+// with creates a child logger with extra fields
+func (l *fieldLogger) with(fields ...interface{}) *fieldLogger {
+	if l == nil {
+		return nil
+	}
+
+	all := make([]interface{}, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	return &fieldLogger{l: l.l, fields: append(all, fields...)}
+}
+
+func (l *fieldLogger) log(level LogLevel, msg string, fields []interface{}) {
+	if l == nil || !l.l.Enabled(level) {
+		return
+	}
+
+	if len(l.fields) > 0 {
+		all := make([]interface{}, 0, len(l.fields)+len(fields))
+		all = append(all, l.fields...)
+		fields = append(all, fields...)
+	}
+	l.l.Log(level, msg, fields...)
+}
+
+func (l *fieldLogger) v(msg string, fields ...interface{}) { l.log(Verbose, msg, fields) }
+func (l *fieldLogger) d(msg string, fields ...interface{}) { l.log(Debug, msg, fields) }
+func (l *fieldLogger) i(msg string, fields ...interface{}) { l.log(Info, msg, fields) }
+func (l *fieldLogger) w(msg string, fields ...interface{}) { l.log(Warning, msg, fields) }
+func (l *fieldLogger) e(msg string, fields ...interface{}) { l.log(Error, msg, fields) }
@@ -0,0 +1,69 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelVerbose is the slog level used for Verbose messages
+const LevelVerbose = slog.LevelDebug - 4
+
+// NewSlogLogger creates a Logger writes to slog.Logger, fields are
+// passed as slog key/value pairs, if l is nil, slog.Default() will be used
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case Verbose:
+		return LevelVerbose
+	case Debug:
+		return slog.LevelDebug
+	case Info:
+		return slog.LevelInfo
+	case Warning:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// Enabled reports whether the slog handler handles messages of this level
+func (s *slogLogger) Enabled(level LogLevel) bool {
+	return level != Silent && s.l.Enabled(context.Background(), slogLevel(level))
+}
+
+// Log a message with slog key/value pairs
+func (s *slogLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	if level == Silent {
+		return
+	}
+	s.l.Log(context.Background(), slogLevel(level), msg, fields...)
+}
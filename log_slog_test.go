@@ -0,0 +1,49 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	if l.Enabled(Debug) || !l.Enabled(Info) || !l.Enabled(Error) {
+		t.Log("unexpected enabled levels")
+		t.Fail()
+	}
+
+	fl := newFieldLogger(l).with("server", "localhost:1883")
+	fl.d("discarded")
+	fl.w("NET received PubAck", "packet_id", 1)
+
+	out := buf.String()
+	if strings.Contains(out, "discarded") ||
+		!strings.Contains(out, "level=WARN") ||
+		!strings.Contains(out, `msg="NET received PubAck" server=localhost:1883 packet_id=1`) {
+		t.Log("unexpected slog output =", out)
+		t.Fail()
+	}
+}
@@ -16,7 +16,10 @@
 
 package libmqtt
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func Test_SilentLogger(t *testing.T) {
 	if l := newLogger(Silent); l != nil {
@@ -104,3 +107,57 @@ func Test_VerboseLogger(t *testing.T) {
 		l.e("test")
 	}
 }
+
+type testLogEntry struct {
+	level  LogLevel
+	msg    string
+	fields []interface{}
+}
+
+type testLogger struct {
+	level   LogLevel
+	entries []testLogEntry
+}
+
+func (l *testLogger) Enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func (l *testLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	l.entries = append(l.entries, testLogEntry{level: level, msg: msg, fields: fields})
+}
+
+func TestFieldLogger(t *testing.T) {
+	var nilLogger *fieldLogger
+	nilLogger.with("server", "foo").e("test")
+
+	tl := &testLogger{level: Info}
+	l := newFieldLogger(tl).with("server", "foo")
+	l.with("packet_id", 1).i("test", "qos", Qos1)
+	l.d("discarded")
+	l.e("test")
+
+	if len(tl.entries) != 2 {
+		t.Log("unexpected log entries =", tl.entries)
+		t.FailNow()
+	}
+
+	if e := tl.entries[0]; e.level != Info || e.msg != "test" ||
+		!reflect.DeepEqual(e.fields, []interface{}{"server", "foo", "packet_id", 1, "qos", Qos1}) {
+		t.Log("unexpected log entry =", e)
+		t.Fail()
+	}
+
+	if e := tl.entries[1]; e.level != Error ||
+		!reflect.DeepEqual(e.fields, []interface{}{"server", "foo"}) {
+		t.Log("unexpected log entry =", e)
+		t.Fail()
+	}
+}
+
+func TestFormatFields(t *testing.T) {
+	if s := formatFields("msg", []interface{}{"server", "foo", "packet_id", 1, "bad"}); s != "msg server=foo packet_id=1 !BADKEY=bad" {
+		t.Log("unexpected formatted message =", s)
+		t.Fail()
+	}
+}
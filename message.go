@@ -0,0 +1,202 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoResponseTopic is the error when replying to a message without
+// response topic
+var ErrNoResponseTopic = errors.New("no response topic in message ")
+
+// WithManualAck defers the acknowledgement of QoS 1/2 messages received
+// until the application acknowledged them with Message.Ack
+//
+// PubAck (QoS 1) or PubRec (QoS 2) is sent when the message acknowledged,
+// and PubComp follows the PubRel from server, messages not delivered to any
+// MessageHandler are acknowledged after the TopicHandlers returned
+func WithManualAck(manual bool) Option {
+	return func(c *client) error {
+		c.options.manualAck = manual
+		return nil
+	}
+}
+
+// Message is the publish message received from server
+type Message struct {
+	Topic    string
+	Qos      QosLevel
+	Payload  []byte
+	IsRetain bool
+	IsDup    bool
+	PacketID uint16
+
+	// Server is the server address the message received from
+	Server string
+
+	// ReceivedAt is the time the message received
+	ReceivedAt time.Time
+
+	// MQTT 5 properties, nil in V311
+	Props *PublishProps
+
+	client    *client
+	packet    *PublishPacket
+	ack       func(ok bool) // send acknowledgement, nil if not required
+	once      sync.Once
+	delivered int32 // 1 if delivered to MessageHandler
+}
+
+// NewMessage creates the message of publish packet p for routers to
+// dispatch packets with DispatchMessage, the message is not received by
+// any client, so Ack and Nack take no effect and Reply always fails
+func NewMessage(p *PublishPacket) *Message {
+	return newMessage(p)
+}
+
+func newMessage(p *PublishPacket) *Message {
+	return &Message{
+		Topic:    p.TopicName,
+		Qos:      p.Qos,
+		Payload:  p.Payload,
+		IsRetain: p.IsRetain,
+		IsDup:    p.IsDup,
+		PacketID: p.PacketID,
+		Props:    p.Props,
+		packet:   p,
+	}
+}
+
+// Reply publish payload to the response topic of the message with the
+// correlation data (MQTT 5 request/response), with the QoS of the message
+//
+// the token is completed with ErrNoResponseTopic if the message has no
+// response topic
+func (m *Message) Reply(ctx context.Context, payload []byte) *Token {
+	if m.Props == nil || m.Props.RespTopic == "" || m.client == nil {
+		t := newToken()
+		t.complete(nil, ErrNoResponseTopic)
+		return t
+	}
+
+	return m.client.PublishContext(ctx, &PublishPacket{
+		TopicName: m.Props.RespTopic,
+		Qos:       m.Qos,
+		Payload:   payload,
+		Props: &PublishProps{
+			CorrelationData: m.Props.CorrelationData,
+		},
+	})
+}
+
+// Ack acknowledges the message in manual ack mode, only the first call
+// of Ack or Nack takes effect
+func (m *Message) Ack() {
+	m.done(true)
+}
+
+// Nack rejects the message in manual ack mode, no acknowledgement will be
+// sent, the server redelivers the message after reconnected with the
+// session kept (clean session disabled)
+func (m *Message) Nack() {
+	m.done(false)
+}
+
+func (m *Message) done(ok bool) {
+	m.once.Do(func() {
+		if m.ack != nil {
+			m.ack(ok)
+		}
+	})
+}
+
+// deliver marks the message delivered to MessageHandler
+func (m *Message) deliver() {
+	atomic.StoreInt32(&m.delivered, 1)
+}
+
+func (m *Message) isDelivered() bool {
+	return atomic.LoadInt32(&m.delivered) == 1
+}
+
+// route the message with router, the message is acknowledged after
+// routed if not delivered to any MessageHandler
+func (c *client) route(m *Message) {
+	if r, ok := c.router.(MessageRouter); ok {
+		r.DispatchMessage(m)
+	} else {
+		c.router.Dispatch(m.packet)
+	}
+
+	if !m.isDelivered() {
+		m.Ack()
+	}
+}
+
+// HandleMessage register topic with MessageHandler, the router must
+// implement MessageRouter
+func (c *client) HandleMessage(topic string, h MessageHandler) {
+	c.log.d("CLIENT registered message handler", "topic", topic)
+	if r, ok := c.router.(MessageRouter); ok {
+		r.HandleMessage(topic, h)
+		return
+	}
+	c.log.w("CLIENT router does not support message handler", "router", c.router.Name())
+}
+
+// received builds the message of publish packet received, in manual ack
+// mode the acknowledgement is sent when the message acknowledged
+func (c *connImpl) received(p *PublishPacket) *Message {
+	m := newMessage(p)
+	m.Server = c.name
+	m.ReceivedAt = time.Now()
+	m.client = c.parent
+	if p.Qos == Qos0 || !c.parent.options.manualAck {
+		return m
+	}
+
+	m.ack = func(ok bool) {
+		if !ok {
+			c.log.d("NET nack Publish", "packet_id", p.PacketID)
+			return
+		}
+		c.ackPublish(p)
+	}
+	return m
+}
+
+// ackPublish sends PubAck for QoS 1 and PubRec for QoS 2 publish
+func (c *connImpl) ackPublish(p *PublishPacket) {
+	switch p.Qos {
+	case Qos1:
+		c.log.d("NET send PubAck for Publish", "packet_id", p.PacketID)
+		c.send(&PubAckPacket{PacketID: p.PacketID})
+	case Qos2:
+		// keep the publish until server released it
+		if err := c.parent.persist.Store(recvKey(p.PacketID), p); err != nil {
+			c.parent.notify(newPersistMsg(err))
+		}
+
+		c.log.d("NET send PubRec for Publish", "packet_id", p.PacketID)
+		c.send(&PubRecvPacket{PacketID: p.PacketID})
+	}
+}
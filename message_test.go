@@ -0,0 +1,144 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestManualAck(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	c, err := NewClient(
+		WithServer("pipe://server"),
+		WithKeepalive(0, 1.2),
+		WithManualAck(true),
+		WithDialer(func(ctx context.Context, server string) (net.Conn, error) {
+			return clientSide, nil
+		}),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+
+	msgC := make(chan *Message, 1)
+	c.HandleMessage("manual", func(m *Message) {
+		msgC <- m
+	})
+	c.Handle("auto", func(topic string, qos QosLevel, msg []byte) {})
+	c.Connect(func(server string, code ConnAckCode, err error) {})
+
+	if !testConnAck(serverSide) {
+		t.Log("connect failed")
+		t.FailNow()
+	}
+
+	// read the next packet from client, nil if nothing sent before timeout
+	next := func() Packet {
+		serverSide.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		pkt, _ := DecodeOnePacket(serverSide)
+		return pkt
+	}
+
+	testWritePacket(serverSide, &PublishPacket{TopicName: "manual", Qos: Qos1, PacketID: 1})
+	if pkt := next(); pkt != nil {
+		t.Log("acknowledged before Ack, packet =", pkt)
+		t.FailNow()
+	}
+
+	m := <-msgC
+	if m.Server != "pipe://server" || m.PacketID != 1 || m.ReceivedAt.IsZero() {
+		t.Log("bad message received, message =", m)
+		t.Fail()
+	}
+
+	m.Ack()
+	if ack, ok := next().(*PubAckPacket); !ok || ack.PacketID != 1 {
+		t.Log("PubAck not sent after Ack")
+		t.FailNow()
+	}
+
+	// messages not delivered to MessageHandler are acknowledged after routed
+	testWritePacket(serverSide, &PublishPacket{TopicName: "auto", Qos: Qos1, PacketID: 2})
+	if ack, ok := next().(*PubAckPacket); !ok || ack.PacketID != 2 {
+		t.Log("PubAck not sent for TopicHandler")
+		t.FailNow()
+	}
+
+	testWritePacket(serverSide, &PublishPacket{TopicName: "manual", Qos: Qos2, PacketID: 3})
+	m = <-msgC
+	m.Nack()
+	m.Ack()
+	if pkt := next(); pkt != nil {
+		t.Log("acknowledged after Nack, packet =", pkt)
+		t.Fail()
+	}
+}
+
+func TestMessage_Reply(t *testing.T) {
+	c, err := NewClient(WithServer("localhost:1883"))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+
+	m := newMessage(&PublishPacket{TopicName: "request", Qos: Qos1})
+	m.client = c.(*client)
+	if err := m.Reply(context.Background(), nil).Err(); err != ErrNoResponseTopic {
+		t.Log("replied without response topic, err =", err)
+		t.Fail()
+	}
+
+	m.Props = &PublishProps{RespTopic: "response", CorrelationData: []byte("id")}
+	m.Reply(context.Background(), []byte("bar"))
+
+	select {
+	case pkt := <-c.(*client).sendC:
+		p, ok := pkt.(*PublishPacket)
+		if !ok || p.TopicName != "response" || p.Qos != Qos1 ||
+			string(p.Payload) != "bar" || string(p.Props.CorrelationData) != "id" {
+			t.Log("bad reply, packet =", pkt)
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Log("reply not sent")
+		t.Fail()
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	p := &PublishPacket{TopicName: "test", Qos: Qos1, PacketID: 1, Props: &PublishProps{RespTopic: "response"}}
+	m := NewMessage(p)
+	if m.packet != p || m.Topic != "test" || m.PacketID != 1 || m.Props != p.Props {
+		t.Log("bad message of packet, message =", m)
+		t.Fail()
+	}
+
+	// not received by client
+	m.Ack()
+	if err := m.Reply(context.Background(), nil).Err(); err != ErrNoResponseTopic {
+		t.Log("replied without client, err =", err)
+		t.Fail()
+	}
+}
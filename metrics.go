@@ -0,0 +1,353 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsCollector collects metrics of client internals,
+// all methods should be safe for concurrent use
+type MetricsCollector interface {
+	// PacketSent is called when a packet has been written to server
+	PacketSent(server string, t CtrlType)
+
+	// PacketReceived is called when a packet has been received from server
+	PacketReceived(server string, t CtrlType)
+
+	// Reconnect is called when client is going to reconnect to server
+	Reconnect(server string)
+
+	// KeepaliveRTT is called with the round trip time of PingReq and PingResp
+	KeepaliveRTT(server string, rtt time.Duration)
+
+	// PersistError is called when the persist method failed
+	PersistError(err error)
+
+	// QueueDepth is called with the number of packets waiting in the queue,
+	// queue is "send" for packets to publish, "offline" for packets in
+	// offline queue, "recv" for packets received and "dispatch" for packets
+	// waiting for dispatch workers
+	QueueDepth(queue string, n int)
+
+	// InFlight is called with the number of packet ids in use
+	InFlight(n int)
+
+	// DispatchLag is called with the time a publish packet waited in the
+	// dispatch queue before its handlers called (WithDispatchPool)
+	DispatchLag(lag time.Duration)
+
+	// DispatchTimeout is called when handlers exceeded the dispatch timeout
+	DispatchTimeout()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) PacketSent(string, CtrlType)        {}
+func (nopMetrics) PacketReceived(string, CtrlType)    {}
+func (nopMetrics) Reconnect(string)                   {}
+func (nopMetrics) KeepaliveRTT(string, time.Duration) {}
+func (nopMetrics) PersistError(error)                 {}
+func (nopMetrics) QueueDepth(string, int)             {}
+func (nopMetrics) InFlight(int)                       {}
+func (nopMetrics) DispatchLag(time.Duration)          {}
+func (nopMetrics) DispatchTimeout()                   {}
+
+var ctrlTypeNames = map[CtrlType]string{
+	CtrlConn:      "connect",
+	CtrlConnAck:   "connack",
+	CtrlPublish:   "publish",
+	CtrlPubAck:    "puback",
+	CtrlPubRecv:   "pubrec",
+	CtrlPubRel:    "pubrel",
+	CtrlPubComp:   "pubcomp",
+	CtrlSubscribe: "subscribe",
+	CtrlSubAck:    "suback",
+	CtrlUnSub:     "unsubscribe",
+	CtrlUnSubAck:  "unsuback",
+	CtrlPingReq:   "pingreq",
+	CtrlPingResp:  "pingresp",
+	CtrlDisConn:   "disconnect",
+	CtrlAuth:      "auth",
+}
+
+func ctrlTypeName(t CtrlType) string {
+	if name, ok := ctrlTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// DefaultRTTBuckets is the default histogram buckets (in seconds)
+// used for keepalive round trip time and dispatch lag
+var DefaultRTTBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewPrometheusMetrics creates a MetricsCollector exposes metrics in
+// Prometheus text format, metric names are prefixed with namespace
+// ("libmqtt" if empty), histogram uses DefaultRTTBuckets if no buckets provided
+func NewPrometheusMetrics(namespace string, buckets ...float64) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "libmqtt"
+	}
+
+	if len(buckets) == 0 {
+		buckets = DefaultRTTBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &PrometheusMetrics{
+		namespace:  namespace,
+		buckets:    buckets,
+		sent:       make(map[packetLabel]uint64),
+		received:   make(map[packetLabel]uint64),
+		reconnects: make(map[string]uint64),
+		queueDepth: make(map[string]int),
+		rtt:        make(map[string]*histogram),
+		lag:        newHistogram(buckets),
+	}
+}
+
+type packetLabel struct {
+	server string
+	t      CtrlType
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // count of each bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// PrometheusMetrics is the MetricsCollector exposes metrics in
+// Prometheus text format (version 0.0.4), it's also a http.Handler
+// can be registered as the scrape endpoint
+type PrometheusMetrics struct {
+	namespace string
+	buckets   []float64
+
+	lock          sync.Mutex
+	sent          map[packetLabel]uint64
+	received      map[packetLabel]uint64
+	reconnects    map[string]uint64
+	persistErrors uint64
+	queueDepth    map[string]int
+	inFlight      int
+	rtt           map[string]*histogram
+	lag           *histogram
+	timeouts      uint64
+}
+
+// PacketSent increases the packets sent counter
+func (m *PrometheusMetrics) PacketSent(server string, t CtrlType) {
+	m.lock.Lock()
+	m.sent[packetLabel{server: server, t: t}]++
+	m.lock.Unlock()
+}
+
+// PacketReceived increases the packets received counter
+func (m *PrometheusMetrics) PacketReceived(server string, t CtrlType) {
+	m.lock.Lock()
+	m.received[packetLabel{server: server, t: t}]++
+	m.lock.Unlock()
+}
+
+// Reconnect increases the reconnects counter
+func (m *PrometheusMetrics) Reconnect(server string) {
+	m.lock.Lock()
+	m.reconnects[server]++
+	m.lock.Unlock()
+}
+
+// KeepaliveRTT observes the keepalive round trip time
+func (m *PrometheusMetrics) KeepaliveRTT(server string, rtt time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	h, ok := m.rtt[server]
+	if !ok {
+		h = newHistogram(m.buckets)
+		m.rtt[server] = h
+	}
+	h.observe(rtt.Seconds())
+}
+
+// PersistError increases the persist errors counter
+func (m *PrometheusMetrics) PersistError(err error) {
+	m.lock.Lock()
+	m.persistErrors++
+	m.lock.Unlock()
+}
+
+// QueueDepth sets the queue depth gauge
+func (m *PrometheusMetrics) QueueDepth(queue string, n int) {
+	m.lock.Lock()
+	m.queueDepth[queue] = n
+	m.lock.Unlock()
+}
+
+// InFlight sets the in-flight packets gauge
+func (m *PrometheusMetrics) InFlight(n int) {
+	m.lock.Lock()
+	m.inFlight = n
+	m.lock.Unlock()
+}
+
+// DispatchLag observes the dispatch queue lag
+func (m *PrometheusMetrics) DispatchLag(lag time.Duration) {
+	m.lock.Lock()
+	m.lag.observe(lag.Seconds())
+	m.lock.Unlock()
+}
+
+// DispatchTimeout increases the dispatch timeouts counter
+func (m *PrometheusMetrics) DispatchTimeout() {
+	m.lock.Lock()
+	m.timeouts++
+	m.lock.Unlock()
+}
+
+// ServeHTTP writes all metrics in Prometheus text format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in Prometheus text format
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	b := &strings.Builder{}
+
+	m.lock.Lock()
+	m.writePackets(b, "packets_sent_total", "Number of packets sent to server.", m.sent)
+	m.writePackets(b, "packets_received_total", "Number of packets received from server.", m.received)
+
+	m.writeHeader(b, "reconnects_total", "Number of reconnects to server.", "counter")
+	reconnected := make([]string, 0, len(m.reconnects))
+	for s := range m.reconnects {
+		reconnected = append(reconnected, s)
+	}
+	sort.Strings(reconnected)
+	for _, s := range reconnected {
+		fmt.Fprintf(b, "%s_reconnects_total{server=%s} %d\n", m.namespace, labelValue(s), m.reconnects[s])
+	}
+
+	m.writeHeader(b, "persist_errors_total", "Number of persist method errors.", "counter")
+	fmt.Fprintf(b, "%s_persist_errors_total %d\n", m.namespace, m.persistErrors)
+
+	m.writeHeader(b, "queue_depth", "Number of packets waiting in client queue.", "gauge")
+	queues := make([]string, 0, len(m.queueDepth))
+	for q := range m.queueDepth {
+		queues = append(queues, q)
+	}
+	sort.Strings(queues)
+	for _, q := range queues {
+		fmt.Fprintf(b, "%s_queue_depth{queue=%s} %d\n", m.namespace, labelValue(q), m.queueDepth[q])
+	}
+
+	m.writeHeader(b, "inflight_packets", "Number of packet ids in use.", "gauge")
+	fmt.Fprintf(b, "%s_inflight_packets %d\n", m.namespace, m.inFlight)
+
+	m.writeHeader(b, "keepalive_rtt_seconds", "Round trip time of keepalive ping.", "histogram")
+	servers := make([]string, 0, len(m.rtt))
+	for s := range m.rtt {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+	for _, s := range servers {
+		m.writeHistogram(b, "keepalive_rtt_seconds", "server="+labelValue(s)+",", m.rtt[s])
+	}
+
+	m.writeHeader(b, "dispatch_lag_seconds", "Time packets waited in dispatch queue.", "histogram")
+	m.writeHistogram(b, "dispatch_lag_seconds", "", m.lag)
+
+	m.writeHeader(b, "dispatch_timeouts_total", "Number of handlers exceeded dispatch timeout.", "counter")
+	fmt.Fprintf(b, "%s_dispatch_timeouts_total %d\n", m.namespace, m.timeouts)
+	m.lock.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *PrometheusMetrics) writeHeader(b *strings.Builder, name, help, typ string) {
+	fmt.Fprintf(b, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", m.namespace, name, help, m.namespace, name, typ)
+}
+
+// writeHistogram writes the histogram samples, labels are prepended
+// to the le label, with trailing comma
+func (m *PrometheusMetrics) writeHistogram(b *strings.Builder, name, labels string, h *histogram) {
+	var cumulative uint64
+	for i, bucket := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_%s_bucket{%sle=\"%g\"} %d\n", m.namespace, name, labels, bucket, cumulative)
+	}
+	fmt.Fprintf(b, "%s_%s_bucket{%sle=\"+Inf\"} %d\n", m.namespace, name, labels, h.count)
+
+	if labels = strings.TrimSuffix(labels, ","); labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_%s_sum%s %g\n", m.namespace, name, labels, h.sum)
+	fmt.Fprintf(b, "%s_%s_count%s %d\n", m.namespace, name, labels, h.count)
+}
+
+func (m *PrometheusMetrics) writePackets(b *strings.Builder, name, help string, counters map[packetLabel]uint64) {
+	m.writeHeader(b, name, help, "counter")
+
+	labels := make([]packetLabel, 0, len(counters))
+	for l := range counters {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].server != labels[j].server {
+			return labels[i].server < labels[j].server
+		}
+		return labels[i].t < labels[j].t
+	})
+
+	for _, l := range labels {
+		fmt.Fprintf(b, "%s_%s{server=%s,type=%s} %d\n",
+			m.namespace, name, labelValue(l.server), labelValue(ctrlTypeName(l.t)), counters[l])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes the label value in Prometheus text format
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
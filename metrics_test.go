@@ -0,0 +1,148 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics("", 0.1, 1)
+	m.PacketSent("localhost:1883", CtrlPublish)
+	m.PacketSent("localhost:1883", CtrlPublish)
+	m.PacketReceived(`a"b`, CtrlPubAck)
+	m.Reconnect("localhost:1883")
+	m.KeepaliveRTT("localhost:1883", 50*time.Millisecond)
+	m.KeepaliveRTT("localhost:1883", 2*time.Second)
+	m.PersistError(errors.New("test"))
+	m.QueueDepth("send", 3)
+	m.InFlight(2)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Log("unexpected content type =", rec.Header().Get("Content-Type"))
+		t.Fail()
+	}
+
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE libmqtt_packets_sent_total counter",
+		`libmqtt_packets_sent_total{server="localhost:1883",type="publish"} 2`,
+		`libmqtt_packets_received_total{server="a\"b",type="puback"} 1`,
+		`libmqtt_reconnects_total{server="localhost:1883"} 1`,
+		"libmqtt_persist_errors_total 1",
+		`libmqtt_queue_depth{queue="send"} 3`,
+		"libmqtt_inflight_packets 2",
+		"# TYPE libmqtt_keepalive_rtt_seconds histogram",
+		`libmqtt_keepalive_rtt_seconds_bucket{server="localhost:1883",le="0.1"} 1`,
+		`libmqtt_keepalive_rtt_seconds_bucket{server="localhost:1883",le="1"} 1`,
+		`libmqtt_keepalive_rtt_seconds_bucket{server="localhost:1883",le="+Inf"} 2`,
+		`libmqtt_keepalive_rtt_seconds_sum{server="localhost:1883"} 2.05`,
+		`libmqtt_keepalive_rtt_seconds_count{server="localhost:1883"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Log("missing metric line =", line)
+			t.Fail()
+		}
+	}
+
+	if t.Failed() {
+		t.Log(out)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	acked := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := DecodeOnePacket(conn); err != nil {
+			return
+		}
+		testWritePacket(conn, &ConnAckPacket{})
+
+		pkt, err := DecodeOnePacket(conn)
+		if err != nil {
+			return
+		}
+		if p, ok := pkt.(*PublishPacket); ok {
+			testWritePacket(conn, &PubAckPacket{PacketID: p.PacketID})
+		}
+		<-acked
+	}()
+
+	m := NewPrometheusMetrics("")
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithMetrics(m),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	c.Connect(nil)
+	token := c.PublishContext(context.Background(), &PublishPacket{TopicName: "foo", Qos: Qos1})
+	select {
+	case <-token.Done():
+	case <-time.After(5 * time.Second):
+		t.Log("publish not acknowledged")
+		t.FailNow()
+	}
+	close(acked)
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+	server := labelValue(l.Addr().String())
+	for _, line := range []string{
+		"libmqtt_packets_sent_total{server=" + server + `,type="connect"} 1`,
+		"libmqtt_packets_sent_total{server=" + server + `,type="publish"} 1`,
+		"libmqtt_packets_received_total{server=" + server + `,type="connack"} 1`,
+		"libmqtt_packets_received_total{server=" + server + `,type="puback"} 1`,
+		"libmqtt_inflight_packets 0",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Log("missing metric line =", line)
+			t.Fail()
+		}
+	}
+
+	if t.Failed() {
+		t.Log(buf.String())
+	}
+	c.Destroy(true)
+}
@@ -0,0 +1,469 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrQueueFull is the error when offline queue is full
+	// with OverflowError policy
+	ErrQueueFull = errors.New("offline queue is full ")
+
+	// ErrPacketDropped is the error when packet dropped from offline
+	// queue with OverflowDropOldest or OverflowDropNewest policy
+	ErrPacketDropped = errors.New("packet dropped from offline queue ")
+
+	// ErrSpilledPacketLost is the error when packet spilled from offline
+	// queue can not be loaded from the PersistMethod
+	ErrSpilledPacketLost = errors.New("spilled packet lost ")
+)
+
+// OverflowPolicy defines what to do when the offline queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the publish until there is space in queue
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest packet in queue
+	OverflowDropOldest
+
+	// OverflowDropNewest drops the packet being published
+	OverflowDropNewest
+
+	// OverflowError refuses the packet being published with ErrQueueFull,
+	// and notify the PubHandler with the error
+	OverflowError
+)
+
+// offlineKeyPrefix is the key prefix of packets spilled to PersistMethod
+const offlineKeyPrefix = "Q"
+
+type offlineConfig struct {
+	memSize int
+	maxSize int
+	spill   PersistMethod
+	policy  OverflowPolicy
+}
+
+// WithOfflineQueue buffers publish packets in a queue, so publish won't
+// block when there is no connection, packets are sent in order when
+// connected
+//
+// memSize is the max count of packets held in memory, packets beyond that
+// are spilled to spill (ignored if nil), maxSize is the max count of
+// packets in queue (0 means no limit with spill, or memSize without spill),
+// policy applies when the queue is full
+//
+// packets spilled to a FilePersist (or any persist survives restart) are
+// recovered by the client created with the same spill
+func WithOfflineQueue(memSize, maxSize int, spill PersistMethod, policy OverflowPolicy) Option {
+	return func(c *client) error {
+		if memSize < 1 {
+			return fmt.Errorf("invalid offline queue memory size %d ", memSize)
+		}
+
+		if spill == nil && (maxSize < 1 || maxSize > memSize) {
+			maxSize = memSize
+		}
+
+		c.options.offline = &offlineConfig{
+			memSize: memSize,
+			maxSize: maxSize,
+			spill:   spill,
+			policy:  policy,
+		}
+		return nil
+	}
+}
+
+// offlineMsg is one publish in offline queue, pkt is nil when spilled
+// and not loaded, spilled packets are deleted from the PersistMethod
+// after delivered to send channel
+type offlineMsg struct {
+	seq     uint64
+	pkt     *PublishPacket
+	spilled bool
+	ctx     context.Context
+	t       *Token
+}
+
+// offlineQueue is the FIFO queue of publish packets, the packets
+// beyond memSize are spilled to the PersistMethod
+type offlineQueue struct {
+	parent  *client
+	config  *offlineConfig
+	lock    sync.Mutex
+	msgs    []*offlineMsg
+	inMem   int
+	nextSeq uint64
+	closed  bool          // no more packets accepted
+	changed chan struct{} // closed and renewed when queue changed
+	stopC   chan struct{} // closed to stop pump
+	exited  chan struct{} // closed when pump returned
+}
+
+func newOfflineQueue(c *client, config *offlineConfig) *offlineQueue {
+	q := &offlineQueue{
+		parent:  c,
+		config:  config,
+		changed: make(chan struct{}),
+		stopC:   make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+
+	if config.spill != nil {
+		// recover spilled packets
+		config.spill.Range(func(key string, p Packet) bool {
+			if seq, ok := parseOfflineKey(key); ok {
+				if _, isPub := p.(*PublishPacket); isPub {
+					q.msgs = append(q.msgs, &offlineMsg{seq: seq, spilled: true, ctx: context.Background()})
+				}
+			}
+			return true
+		})
+		sort.Slice(q.msgs, func(i, j int) bool { return q.msgs[i].seq < q.msgs[j].seq })
+		if n := len(q.msgs); n > 0 {
+			q.nextSeq = q.msgs[n-1].seq + 1
+		}
+	}
+	return q
+}
+
+func offlineKey(seq uint64) string {
+	return offlineKeyPrefix + strconv.FormatUint(seq, 10)
+}
+
+func parseOfflineKey(key string) (uint64, bool) {
+	if !strings.HasPrefix(key, offlineKeyPrefix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(key[len(offlineKeyPrefix):], 10, 64)
+	return seq, err == nil
+}
+
+// len returns the count of packets in queue
+func (q *offlineQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.msgs)
+}
+
+// signal the waiters, must be called with lock held
+func (q *offlineQueue) signal() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+	q.parent.metrics.QueueDepth("offline", len(q.msgs))
+}
+
+// full reports whether queue is full, must be called with lock held
+func (q *offlineQueue) full() bool {
+	return q.config.maxSize > 0 && len(q.msgs) >= q.config.maxSize
+}
+
+// push the packet to the end of queue, overflow policy applies when full
+func (q *offlineQueue) push(ctx context.Context, p *PublishPacket, t *Token) {
+	q.lock.Lock()
+	for !q.closed && q.full() && q.config.policy == OverflowBlock {
+		changed := q.changed
+		q.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			q.complete(t, p, ctx.Err())
+			return
+		}
+		q.lock.Lock()
+	}
+
+	if q.closed {
+		q.lock.Unlock()
+		q.complete(t, p, ErrClientClosed)
+		return
+	}
+
+	var dropped *offlineMsg
+	if q.full() {
+		switch q.config.policy {
+		case OverflowDropNewest:
+			q.lock.Unlock()
+			q.complete(t, p, ErrPacketDropped)
+			return
+		case OverflowError:
+			q.lock.Unlock()
+			q.complete(t, p, ErrQueueFull)
+			q.parent.notify(newPubMsg(p.TopicName, ErrQueueFull))
+			return
+		default:
+			dropped = q.remove()
+		}
+	}
+
+	m := &offlineMsg{seq: q.nextSeq, pkt: p, ctx: ctx, t: t}
+	q.nextSeq++
+
+	var spillErr error
+	if q.inMem < q.config.memSize || q.config.spill == nil {
+		q.inMem++
+	} else if spillErr = q.config.spill.Store(offlineKey(m.seq), p); spillErr != nil {
+		// keep it in memory
+		q.inMem++
+	} else {
+		m.pkt = nil
+		m.spilled = true
+	}
+	q.msgs = append(q.msgs, m)
+	q.signal()
+	q.lock.Unlock()
+
+	if spillErr != nil {
+		q.parent.log.w("CLIENT spill packet failed", "topic", p.TopicName, "err", spillErr)
+		q.parent.notify(newPersistMsg(spillErr))
+	}
+
+	if dropped != nil {
+		q.unspill(dropped)
+		q.complete(dropped.t, dropped.pkt, ErrPacketDropped)
+	}
+
+	if t != nil && ctx.Done() != nil {
+		// complete the token once ctx done, even if still in queue
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.complete(nil, ctx.Err())
+			case <-t.done:
+			}
+		}()
+	}
+}
+
+// remove the head of queue, spilled packet is loaded but kept in the
+// PersistMethod, must be called with lock held
+func (q *offlineQueue) remove() *offlineMsg {
+	m := q.msgs[0]
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+
+	if !m.spilled {
+		q.inMem--
+		return m
+	}
+
+	if m.pkt == nil {
+		if p, ok := q.config.spill.Load(offlineKey(m.seq)); ok {
+			m.pkt, _ = p.(*PublishPacket)
+		}
+	}
+	return m
+}
+
+// unspill deletes the spilled packet from the PersistMethod
+func (q *offlineQueue) unspill(m *offlineMsg) {
+	if !m.spilled {
+		return
+	}
+	m.spilled = false
+
+	key := offlineKey(m.seq)
+	if err := q.config.spill.Delete(key); err != nil {
+		q.parent.log.w("CLIENT delete spilled packet failed", "key", key, "err", err)
+	}
+}
+
+// pop the head of queue, blocks until there is a packet or stopped
+func (q *offlineQueue) pop() (*offlineMsg, bool) {
+	q.lock.Lock()
+	for {
+		select {
+		case <-q.stopC:
+			q.lock.Unlock()
+			return nil, false
+		default:
+		}
+
+		if len(q.msgs) == 0 {
+			changed := q.changed
+			q.lock.Unlock()
+			select {
+			case <-changed:
+			case <-q.stopC:
+			}
+			q.lock.Lock()
+			continue
+		}
+
+		m := q.remove()
+		q.signal()
+		if m.pkt != nil {
+			q.lock.Unlock()
+			return m, true
+		}
+
+		// complete and notify without lock, notify blocks until handled
+		q.unspill(m)
+		q.lock.Unlock()
+		q.parent.log.w("CLIENT load spilled packet failed", "key", offlineKey(m.seq))
+		q.complete(m.t, nil, ErrSpilledPacketLost)
+		q.parent.notify(newPersistMsg(ErrSpilledPacketLost))
+		q.lock.Lock()
+	}
+}
+
+// pushFront put back the packet popped
+func (q *offlineQueue) pushFront(m *offlineMsg) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.msgs = append([]*offlineMsg{m}, q.msgs...)
+	if !m.spilled {
+		q.inMem++
+	}
+	q.signal()
+}
+
+// close the queue, no more packets accepted
+func (q *offlineQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.signal()
+}
+
+// stop the pump and wait for it returned, returns the packets in queue,
+// spilled packets are loaded but kept in the PersistMethod
+func (q *offlineQueue) stop() []Packet {
+	close(q.stopC)
+	<-q.exited
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	pkts := make([]Packet, 0, len(q.msgs))
+	for _, m := range q.msgs {
+		if m.pkt != nil {
+			pkts = append(pkts, m.pkt)
+			q.complete(m.t, m.pkt, ErrClientClosed)
+		} else if p, ok := q.config.spill.Load(offlineKey(m.seq)); ok {
+			pkts = append(pkts, p)
+		}
+	}
+	return pkts
+}
+
+// complete the token of packet not sent
+func (q *offlineQueue) complete(t *Token, p *PublishPacket, err error) {
+	if p != nil {
+		q.parent.log.d("CLIENT packet not sent from offline queue", "topic", p.TopicName, "err", err)
+	}
+	if t != nil {
+		t.complete(nil, err)
+	}
+}
+
+// waitConnected blocks until any server connected,
+// returns false if stopped
+func (q *offlineQueue) waitConnected() bool {
+	for {
+		connected, changed := q.parent.states.connected()
+		if connected {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-q.stopC:
+			return false
+		}
+	}
+}
+
+// pump the packets from offline queue to send channel when connected
+func (q *offlineQueue) pump() {
+	defer close(q.exited)
+
+	c := q.parent
+	for {
+		if !q.waitConnected() {
+			return
+		}
+
+		m, ok := q.pop()
+		if !ok {
+			return
+		}
+
+		p := m.pkt
+		if err := m.ctx.Err(); err != nil {
+			q.unspill(m)
+			q.complete(m.t, p, err)
+			continue
+		}
+
+		key, assigned, err := c.prepare(m.ctx, q.stopC, p)
+		if err == ErrClientClosed {
+			// stopped when in-flight window is full
+			q.pushFront(m)
+			return
+		} else if err != nil {
+			q.unspill(m)
+			c.reject(m.t, newPubMsg(p.TopicName, err))
+			continue
+		}
+
+		if m.t != nil {
+			c.addToken(m.ctx, key, m.t)
+		}
+		id, hasID := key.(uint16)
+		if hasID {
+			c.queued.Store(id, true)
+		}
+
+		select {
+		case c.sendC <- p:
+			c.metrics.QueueDepth("send", len(c.sendC))
+			q.unspill(m)
+		case <-m.ctx.Done():
+			q.unspill(m)
+			c.release(key, p, m.ctx.Err())
+		case <-q.stopC:
+			// put it back, it's reported as queued
+			c.tokens.Delete(key)
+			if hasID {
+				c.queued.Delete(id)
+				if assigned {
+					c.idGen.free(id)
+					if err := c.persist.Delete(sendKey(id)); err != nil {
+						c.notify(newPersistMsg(err))
+					}
+					p.PacketID = 0
+				}
+			}
+			q.pushFront(m)
+			return
+		}
+	}
+}
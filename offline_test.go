@@ -0,0 +1,279 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testOfflineQueue(memSize, maxSize int, spill PersistMethod, policy OverflowPolicy) *offlineQueue {
+	c := defaultClient()
+	// drop handler messages
+	close(c.closedC)
+	return newOfflineQueue(c, &offlineConfig{memSize: memSize, maxSize: maxSize, spill: spill, policy: policy})
+}
+
+func testOfflinePush(q *offlineQueue, n int) []*Token {
+	tokens := make([]*Token, 0, n)
+	for i := 1; i <= n; i++ {
+		t := newToken()
+		q.push(context.Background(), &PublishPacket{TopicName: strconv.Itoa(i), Qos: Qos1}, t)
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+func testOfflinePop(t *testing.T, q *offlineQueue, expected ...string) {
+	for _, topic := range expected {
+		m, ok := q.pop()
+		if !ok || m.pkt.TopicName != topic {
+			t.Log("unexpected packet popped, expected =", topic)
+			t.FailNow()
+		}
+		// delivered to send channel
+		q.unspill(m)
+	}
+
+	if n := q.len(); n != 0 {
+		t.Log("unexpected packets left in queue", n)
+		t.Fail()
+	}
+}
+
+func TestOfflineQueue_Overflow(t *testing.T) {
+	for _, v := range []struct {
+		policy  OverflowPolicy
+		dropped int
+		err     error
+		popped  []string
+	}{
+		{OverflowDropOldest, 0, ErrPacketDropped, []string{"2", "3"}},
+		{OverflowDropNewest, 2, ErrPacketDropped, []string{"1", "2"}},
+		{OverflowError, 2, ErrQueueFull, []string{"1", "2"}},
+	} {
+		q := testOfflineQueue(2, 2, nil, v.policy)
+		tokens := testOfflinePush(q, 3)
+		for i, token := range tokens {
+			if err := token.Err(); (i == v.dropped) != (err == v.err) {
+				t.Log("unexpected result of", v.policy, "packet", i, "err =", err)
+				t.Fail()
+			}
+		}
+		testOfflinePop(t, q, v.popped...)
+	}
+
+	q := testOfflineQueue(2, 2, nil, OverflowBlock)
+	testOfflinePush(q, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	token := newToken()
+	q.push(ctx, &PublishPacket{TopicName: "3"}, token)
+	if token.Err() != context.DeadlineExceeded {
+		t.Log("push not blocked, err =", token.Err())
+		t.Fail()
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.pop()
+	}()
+	testOfflinePush(q, 1)
+	testOfflinePop(t, q, "2", "1")
+}
+
+func TestOfflineQueue_Spill(t *testing.T) {
+	spill := NewMemPersist(nil)
+	spilled := func() int {
+		n := 0
+		spill.Range(func(key string, p Packet) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	q := testOfflineQueue(1, 0, spill, OverflowBlock)
+	testOfflinePush(q, 3)
+	if n := spilled(); n != 2 {
+		t.Log("unexpected spilled packets", n)
+		t.Fail()
+	}
+	testOfflinePop(t, q, "1", "2", "3")
+	if n := spilled(); n != 0 {
+		t.Log("spilled packets not deleted", n)
+		t.Fail()
+	}
+
+	// spilled packets are kept until delivered
+	testOfflinePush(q, 2)
+	if m, ok := q.pop(); !ok || m.pkt.TopicName != "1" {
+		t.Log("unexpected packet popped")
+		t.FailNow()
+	}
+	m, ok := q.pop()
+	if !ok || m.pkt.TopicName != "2" || spilled() != 1 {
+		t.Log("spilled packet deleted before delivered")
+		t.Fail()
+	}
+	q.unspill(m)
+
+	// spilled packets are recovered in order
+	testOfflinePush(q, 12)
+	testOfflinePop(t, testOfflineQueue(1, 0, spill, OverflowBlock),
+		"2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12")
+
+	// spilled packets lost are completed with error
+	spill = NewMemPersist(nil)
+	q = testOfflineQueue(1, 0, spill, OverflowBlock)
+	tokens := testOfflinePush(q, 2)
+	spill.Delete(offlineKey(1))
+	testOfflinePush(q, 1)
+	testOfflinePop(t, q, "1", "1")
+	if err := tokens[1].Err(); err != ErrSpilledPacketLost {
+		t.Log("token of lost packet not completed, err =", err)
+		t.Fail()
+	}
+}
+
+func TestOfflineQueue_Reconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c, err := NewClient(
+		WithServer(addr),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithSendBuf(1),
+		WithBackoffStrategy(10*time.Millisecond, 10*time.Millisecond, 2),
+		WithOfflineQueue(2, 0, NewMemPersist(nil), OverflowBlock),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+	c.Connect(nil)
+
+	// not blocked while disconnected
+	tokens := make([]*Token, 0)
+	for i := 0; i < 10; i++ {
+		tokens = append(tokens, c.PublishContext(context.Background(),
+			&PublishPacket{TopicName: strconv.Itoa(i), Qos: Qos1}))
+	}
+
+	// kept in offline queue until connected
+	time.Sleep(50 * time.Millisecond)
+	if n := len(c.(*client).sendC); n != 0 {
+		t.Log("packets pumped to send channel while disconnected", n)
+		t.Fail()
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	topics := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil || !testConnAck(conn) {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			pkt, err := DecodeOnePacket(conn)
+			if err != nil {
+				return
+			}
+			if p, ok := pkt.(*PublishPacket); ok {
+				topics <- p.TopicName
+				testWritePacket(conn, &PubAckPacket{PacketID: p.PacketID})
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case topic := <-topics:
+			if topic != strconv.Itoa(i) {
+				t.Log("unexpected packet order at", i, "topic =", topic)
+				t.FailNow()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("packet not sent after reconnected", i)
+			t.FailNow()
+		}
+	}
+
+	for i, token := range tokens {
+		if err := token.Wait(context.Background()); err != nil {
+			t.Log("publish", i, "failed, err =", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestOfflineQueue_LostNotify(t *testing.T) {
+	c := defaultClient()
+	c.msgC = make(chan *message)
+	defer close(c.closedC)
+	spill := NewMemPersist(nil)
+	q := newOfflineQueue(c, &offlineConfig{memSize: 1, spill: spill, policy: OverflowBlock})
+
+	testOfflinePush(q, 3)
+	spill.Delete(offlineKey(1))
+	q.pop()
+
+	// notify of lost packet blocks until handled
+	popped := make(chan *offlineMsg, 1)
+	go func() {
+		m, _ := q.pop()
+		popped <- m
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		q.len()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Log("queue locked while notifying lost packet")
+		t.FailNow()
+	}
+
+	if m := <-c.msgC; m.what != persistMsg || m.err != ErrSpilledPacketLost {
+		t.Log("unexpected message", m.what, m.err)
+		t.Fail()
+	}
+	if m := <-popped; m == nil || m.pkt.TopicName != "3" {
+		t.Log("unexpected packet popped after lost one")
+		t.Fail()
+	}
+}
@@ -34,6 +34,8 @@ var (
 	// PacketDroppedByStrategy used when persist store packet while strategy
 	// don't allow that persist
 	PacketDroppedByStrategy = errors.New("packet persist dropped by strategy ")
+
+	errStopRange = errors.New("range stopped")
 )
 
 // PersistStrategy defines the details to be complied in persist methods
@@ -189,7 +191,9 @@ func (m *MemPersist) Delete(key string) error {
 		return nil
 	}
 
-	m.data.Delete(key)
+	if _, loaded := m.data.LoadAndDelete(key); loaded {
+		atomic.AddUint32(&m.n, ^uint32(0))
+	}
 	return nil
 }
 
@@ -225,7 +229,15 @@ func NewFilePersist(dirPath string, strategy *PersistStrategy) *FilePersist {
 
 	// init file packet size
 	filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+		if err != nil {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() {
+			// only walk through files in dirPath
+			if path == dirPath {
+				return nil
+			}
 			return filepath.SkipDir
 		}
 
@@ -272,14 +284,12 @@ func (m *FilePersist) Store(key string, p Packet) error {
 	if !m.exists(key) || m.strategy.DuplicateReplace {
 		if m.strategy.Interval > 0 {
 			// has persist interval
-			if atomic.LoadUint32(&m.inMemSize) == 0 {
+			if _, loaded := m.inMemBuf.LoadOrStore(key, p); loaded {
+				m.inMemBuf.Store(key, p)
+			} else if atomic.AddUint32(&m.inMemSize, 1) == 1 {
 				// schedule a file save action according to the strategy
-				defer func() {
-					go m.worker()
-				}()
+				go m.worker()
 			}
-			m.inMemBuf.Store(key, p)
-			atomic.AddUint32(&m.inMemSize, 1)
 		} else {
 			// persist every time
 			return m.store(key, p)
@@ -295,6 +305,10 @@ func (m *FilePersist) Load(key string) (Packet, bool) {
 		return nil, false
 	}
 
+	if p, ok := m.inMemBuf.Load(key); ok {
+		return p.(Packet), true
+	}
+
 	packet, err := m.getPacketFromFile(m.getFilename(key))
 	if err != nil {
 		return nil, false
@@ -303,15 +317,40 @@ func (m *FilePersist) Load(key string) (Packet, bool) {
 	return packet, true
 }
 
-// Range over all packet persisted
+// Range over all packet persisted, including those not yet written to file
 func (m *FilePersist) Range(ranger func(key string, p Packet) bool) {
 	if m == nil || ranger == nil {
 		return
 	}
 
+	ranged := make(map[string]bool)
+	stopped := false
+	m.inMemBuf.Range(func(key, value interface{}) bool {
+		k := key.(string)
+		p, ok := value.(Packet)
+		if !ok {
+			return true
+		}
+
+		ranged[k] = true
+		stopped = !ranger(k, p)
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+
 	filepath.Walk(m.dirPath, func(path string, info os.FileInfo, err error) error {
-		// error happened or is dir
-		if err != nil || info.IsDir() {
+		// error happened
+		if err != nil {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() {
+			// only walk through files in dirPath
+			if path == m.dirPath {
+				return nil
+			}
 			return filepath.SkipDir
 		}
 
@@ -320,13 +359,20 @@ func (m *FilePersist) Range(ranger func(key string, p Packet) bool) {
 			return nil
 		}
 
+		key := strings.TrimSuffix(info.Name(), fileSuffix)
+		if ranged[key] {
+			return nil
+		}
+
 		// decode packet
 		pkt, err := m.getPacketFromFile(path)
 		if err != nil {
 			return nil
 		}
 
-		ranger(strings.TrimSuffix(info.Name(), fileSuffix), pkt)
+		if !ranger(key, pkt) {
+			return errStopRange
+		}
 
 		return nil
 	})
@@ -338,7 +384,20 @@ func (m *FilePersist) Delete(key string) error {
 		return nil
 	}
 
-	return os.Remove(path.Join(m.dirPath, key))
+	if _, loaded := m.inMemBuf.LoadAndDelete(key); loaded {
+		atomic.AddUint32(&m.inMemSize, ^uint32(0))
+	}
+
+	err := os.Remove(m.getFilename(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	atomic.AddUint32(&m.n, ^uint32(0))
+	return nil
 }
 
 // Destroy persist storage
@@ -365,7 +424,11 @@ func (m *FilePersist) getPacketFromFile(path string) (Packet, error) {
 }
 
 func (m *FilePersist) exists(key string) bool {
-	_, err := os.Open(m.getFilename(key))
+	if _, ok := m.inMemBuf.Load(key); ok {
+		return true
+	}
+
+	_, err := os.Stat(m.getFilename(key))
 	if err != nil && os.IsNotExist(err) {
 		// no such packet file
 		return false
@@ -374,6 +437,8 @@ func (m *FilePersist) exists(key string) bool {
 }
 
 func (m *FilePersist) store(key string, p Packet) error {
+	_, err := os.Stat(m.getFilename(key))
+	existed := err == nil
 	f, err := os.Create(m.getFilename(key))
 	if err != nil {
 		return err
@@ -393,8 +458,9 @@ func (m *FilePersist) store(key string, p Packet) error {
 		return err
 	}
 
-	atomic.AddUint32(&m.n, 1)
-	atomic.StoreUint32(&m.inMemSize, atomic.LoadUint32(&m.inMemSize)-1)
+	if !existed {
+		atomic.AddUint32(&m.n, 1)
+	}
 	return nil
 }
 
@@ -403,19 +469,18 @@ func (m *FilePersist) worker() {
 
 	persistedKeys := make([]string, 0)
 	m.inMemBuf.Range(func(key, value interface{}) bool {
-		k := key.(string)
-		p, ok := value.(Packet)
-		if !ok {
-			return true
-		}
-
-		m.store(k, p)
-		persistedKeys = append(persistedKeys, k)
+		persistedKeys = append(persistedKeys, key.(string))
 		return true
 	})
 
 	for _, k := range persistedKeys {
-		m.inMemBuf.Delete(k)
+		if p, ok := m.inMemBuf.Load(k); ok {
+			m.store(k, p.(Packet))
+			// deleted or replaced while storing
+			if m.inMemBuf.CompareAndDelete(k, p) {
+				atomic.AddUint32(&m.inMemSize, ^uint32(0))
+			}
+		}
 	}
 
 	if atomic.LoadUint32(&m.inMemSize) > 0 {
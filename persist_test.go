@@ -17,7 +17,11 @@
 package libmqtt
 
 import (
+	"context"
+	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -84,6 +88,28 @@ func TestMemPersist(t *testing.T) {
 	testPersist(p, t)
 }
 
+func TestMemPersist_ConcurrentDelete(t *testing.T) {
+	p := NewMemPersist(nil)
+	for i := 0; i < 1000; i++ {
+		p.Store("key", PingReqPacket)
+
+		wg := &sync.WaitGroup{}
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.Delete("key")
+			}()
+		}
+		wg.Wait()
+
+		if n := atomic.LoadUint32(&p.n); n != 0 {
+			t.Log("unexpected count after deleted =", n)
+			t.FailNow()
+		}
+	}
+}
+
 func TestFilePersist(t *testing.T) {
 	dirPath := "test-file-persist"
 	err := os.MkdirAll(dirPath, 0755)
@@ -127,3 +153,238 @@ func TestFilePersist(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestFilePersist_Range(t *testing.T) {
+	dirPath := "test-file-persist-range"
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dirPath)
+
+	p := NewFilePersist(dirPath, &PersistStrategy{DuplicateReplace: true})
+	for _, id := range []uint16{1, 2} {
+		if err := p.Store(sendKey(id), &PublishPacket{TopicName: "test", Qos: Qos1, PacketID: id}); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	// load from files
+	count := 0
+	NewFilePersist(dirPath, nil).Range(func(key string, pkt Packet) bool {
+		if _, id, ok := parsePersistKey(key); !ok || pkt.(*PublishPacket).PacketID != id {
+			t.Log("unexpected persisted packet, key =", key)
+			t.Fail()
+		}
+		count++
+		return true
+	})
+	if count != 2 {
+		t.Log("range count =", count)
+		t.Fail()
+	}
+
+	if err := p.Delete(sendKey(1)); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, ok := p.Load(sendKey(1)); ok || p.n != 1 {
+		t.Log("persisted packet not deleted, count =", p.n)
+		t.Fail()
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	resent := make(chan *PublishPacket, 1)
+	// a server drops the connection before acknowledge the publish
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			if _, err := DecodeOnePacket(conn); err != nil {
+				conn.Close()
+				return
+			}
+			testWritePacket(conn, &ConnAckPacket{Present: i > 0})
+
+			pkt, err := DecodeOnePacket(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			if i > 0 {
+				p, _ := pkt.(*PublishPacket)
+				if p != nil {
+					testWritePacket(conn, &PubAckPacket{PacketID: p.PacketID})
+				}
+				resent <- p
+			}
+			conn.Close()
+		}
+	}()
+
+	persist := NewMemPersist(nil)
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithPersist(persist),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 2),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	c.Connect(nil)
+	c.Publish(&PublishPacket{TopicName: "test", Qos: Qos1, Payload: []byte("test")})
+
+	select {
+	case p := <-resent:
+		if p == nil || !p.IsDup || p.TopicName != "test" || p.PacketID != 1 {
+			t.Log("unexpected resent packet =", p)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("publish packet not resent")
+		t.Fail()
+	}
+
+	c.Destroy(true)
+}
+
+func TestResume_InFlightOwner(t *testing.T) {
+	c := defaultClient()
+	for _, to := range []ConnState{StateDialing, StateConnecting, StateConnected} {
+		c.states.set("a", to, nil)
+	}
+
+	c.sentThrough(1, "a")
+	if c.claimResend(1, "b") {
+		t.Log("packet in-flight in live connection claimed by another one")
+		t.Fail()
+	}
+
+	c.states.set("a", StateDisconnected, nil)
+	if !c.claimResend(1, "b") || !c.claimResend(2, "b") {
+		t.Log("packet of lost connection or unknown owner not claimed")
+		t.Fail()
+	}
+
+	if !c.claimResend(1, "a") {
+		t.Log("packet not claimed back by reconnected server")
+		t.Fail()
+	}
+}
+
+func TestResume_SessionDiscarded(t *testing.T) {
+	c := defaultClient()
+	c.persist = NewMemPersist(nil)
+	conn := &connImpl{parent: c, name: "a"}
+
+	rel := &PubRelPacket{PacketID: 1}
+	c.persist.Store(sendKey(1), rel)
+	c.idGen.use(1, rel)
+
+	token := newToken()
+	c.addToken(context.Background(), uint16(1), token)
+
+	conn.resume(false)
+	if err := token.Err(); err != ErrSessionDiscarded {
+		t.Log("token not completed after session discarded, err =", err)
+		t.Fail()
+	}
+
+	if _, ok := c.idGen.getExtra(1); ok {
+		t.Log("packet id not freed")
+		t.Fail()
+	}
+}
+
+func TestResume_PubRel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	resent := make(chan Packet, 1)
+	// a server drops the connection after PUBREL received
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			if _, err := DecodeOnePacket(conn); err != nil {
+				conn.Close()
+				return
+			}
+			testWritePacket(conn, &ConnAckPacket{Present: i > 0})
+
+			pkt, err := DecodeOnePacket(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			if i == 0 {
+				if p, ok := pkt.(*PublishPacket); ok {
+					testWritePacket(conn, &PubRecvPacket{PacketID: p.PacketID})
+					DecodeOnePacket(conn)
+				}
+			} else {
+				if p, ok := pkt.(*PubRelPacket); ok {
+					testWritePacket(conn, &PubCompPacket{PacketID: p.PacketID})
+				}
+				resent <- pkt
+			}
+			conn.Close()
+		}
+	}()
+
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 2),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+
+	c.Connect(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	token := c.PublishContext(ctx, &PublishPacket{TopicName: "test", Qos: Qos2})
+
+	select {
+	case pkt := <-resent:
+		if p, ok := pkt.(*PubRelPacket); !ok || p.PacketID != 1 {
+			t.Log("unexpected resent packet =", pkt)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("packet not resent")
+		t.FailNow()
+	}
+
+	if err := token.Wait(ctx); err != nil {
+		t.Log("publish not completed, err =", err)
+		t.Fail()
+	}
+}
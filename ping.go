@@ -26,9 +26,9 @@ var (
 // pingReqPacket is sent from a Client to the Server.
 //
 // It can be used to:
-// 		1. Indicate to the Server that the Client is alive in the absence of any other Control Packets being sent from the Client to the Server.
-// 		2. Request that the Server responds to confirm that it is alive.
-// 		3. Exercise the network to indicate that the Network Connection is active.
+//  1. Indicate to the Server that the Client is alive in the absence of any other Control Packets being sent from the Client to the Server.
+//  2. Request that the Server responds to confirm that it is alive.
+//  3. Exercise the network to indicate that the Network Connection is active.
 //
 // This Packet is used in Keep Alive processing
 type pingReqPacket struct {
@@ -38,6 +38,11 @@ func (s *pingReqPacket) Type() CtrlType {
 	return CtrlPingReq
 }
 
+// Version of pingReqPacket is V311, it's the same in all versions
+func (s *pingReqPacket) Version() ProtocolLevel {
+	return V311
+}
+
 func (s *pingReqPacket) WriteTo(w BufferWriter) error {
 	if w == nil || s == nil {
 		return nil
@@ -57,6 +62,11 @@ func (s *pingRespPacket) Type() CtrlType {
 	return CtrlPingResp
 }
 
+// Version of pingRespPacket is V311, it's the same in all versions
+func (s *pingRespPacket) Version() ProtocolLevel {
+	return V311
+}
+
 func (s *pingRespPacket) WriteTo(w BufferWriter) error {
 	if w == nil || s == nil {
 		return nil
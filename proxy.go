@@ -0,0 +1,434 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnsupportedProxy unsupported proxy url scheme
+	ErrUnsupportedProxy = errors.New("unsupported proxy scheme ")
+
+	// ErrProxyAuth proxy refused the credential or no acceptable auth method
+	ErrProxyAuth = errors.New("proxy authentication failed ")
+)
+
+// WithProxy set the proxy for all servers, proxyURL is in the form of
+// "scheme://[user:password@]host:port", supported schemes are
+// "http", "https" (HTTP CONNECT), "socks5" and "socks5h" (SOCKS5 with
+// hostname resolved by proxy), connections to unix socket are not proxied
+func WithProxy(proxyURL string) Option {
+	return func(c *client) error {
+		u, err := parseProxyURL(proxyURL)
+		if err != nil {
+			return err
+		}
+		c.options.proxy = u
+		return nil
+	}
+}
+
+// WithProxyFromEnvironment use the proxy from environment variables,
+// HTTPS_PROXY is used for TLS connections (including wss), HTTP_PROXY
+// is used for ws, ALL_PROXY is used when not set or for plain tcp,
+// hosts matched by NO_PROXY are connected directly,
+// lowercase variables are checked when uppercase ones not set
+func WithProxyFromEnvironment() Option {
+	return func(c *client) error {
+		c.options.proxyFromEnv = true
+		return nil
+	}
+}
+
+// dialFunc dials the address with network
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// netDial returns the function dials addr directly or through proxy,
+// scheme is one of "tcp", "tls", "ws" and "wss"
+func (c *client) netDial(dialer *net.Dialer, scheme, addr string) (dialFunc, error) {
+	proxy := c.options.proxy
+	if proxy == nil && c.options.proxyFromEnv {
+		var err error
+		if proxy, err = proxyFromEnv(scheme, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if proxy == nil {
+		return dialer.DialContext, nil
+	}
+	return (&proxyDialer{proxy: proxy, dialer: dialer}).DialContext, nil
+}
+
+// dialTLS dials addr and start TLS handshake over the connection
+func dialTLS(ctx context.Context, dial dialFunc, addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, ErrUnsupportedProxy
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("no proxy host in url %q", proxyURL)
+	}
+	return u, nil
+}
+
+func getEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		if v := os.Getenv(strings.ToLower(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// proxyFromEnv returns the proxy for addr from environment variables,
+// nil if no proxy should be used
+func proxyFromEnv(scheme, addr string) (*url.URL, error) {
+	var proxy string
+	switch scheme {
+	case "tls", "wss":
+		proxy = getEnv("HTTPS_PROXY", "ALL_PROXY")
+	case "ws":
+		proxy = getEnv("HTTP_PROXY", "ALL_PROXY")
+	default:
+		proxy = getEnv("ALL_PROXY")
+	}
+
+	if proxy == "" || noProxy(getEnv("NO_PROXY"), addr) {
+		return nil, nil
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return parseProxyURL(proxy)
+}
+
+// noProxy reports whether addr matches the NO_PROXY list, entries are
+// "*", hosts, domain suffixes (".example.com" or "example.com") and IPs,
+// optionally with port
+func noProxy(list, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if entry == "*" {
+			return true
+		}
+
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyDialer dials through HTTP CONNECT or SOCKS5 proxy
+type proxyDialer struct {
+	proxy  *url.URL
+	dialer *net.Dialer
+}
+
+func (p *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := p.proxy.Host
+	if p.proxy.Port() == "" {
+		switch p.proxy.Scheme {
+		case "http":
+			proxyAddr = net.JoinHostPort(p.proxy.Hostname(), "80")
+		case "https":
+			proxyAddr = net.JoinHostPort(p.proxy.Hostname(), "443")
+		default:
+			proxyAddr = net.JoinHostPort(p.proxy.Hostname(), "1080")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if p.proxy.Scheme == "https" {
+		conn, err = dialTLS(ctx, p.dialer.DialContext, proxyAddr, nil)
+	} else {
+		conn, err = p.dialer.DialContext(ctx, "tcp", proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tunnel := conn
+	switch p.proxy.Scheme {
+	case "http", "https":
+		tunnel, err = httpConnect(conn, p.proxy.User, addr)
+	default:
+		err = socks5Connect(ctx, conn, p.proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// httpConnect creates the tunnel to addr with HTTP CONNECT request
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Opaque: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       addr,
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, ErrProxyAuth
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("proxy refused connect to %s: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// server data arrived with the response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads from r before the connection
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xFF
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// socks5Connect creates the tunnel to addr with SOCKS5 CONNECT command
+func socks5Connect(ctx context.Context, conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	// auth method negotiation
+	methods := []byte{socks5AuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("bad socks version %d", buf[0])
+	}
+
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		// username/password auth (RFC 1929)
+		if proxy.User == nil {
+			return ErrProxyAuth
+		}
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return ErrProxyAuth
+		}
+
+		req := append([]byte{0x01, byte(len(username))}, username...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return ErrProxyAuth
+		}
+	default:
+		return ErrProxyAuth
+	}
+
+	// connect request
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		// resolve locally
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0].IP
+	}
+
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	case ip.To4() != nil:
+		req = append(append(req, socks5AddrIPv4), ip.To4()...)
+	default:
+		req = append(append(req, socks5AddrIPv6), ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply: version, code, reserved, bound address type
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks proxy refused connect to %s, code = %d", addr, reply[1])
+	}
+
+	var boundLen int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		boundLen = net.IPv4len
+	case socks5AddrIPv6:
+		boundLen = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		boundLen = int(buf[0])
+	default:
+		return fmt.Errorf("bad socks address type %d", reply[3])
+	}
+
+	// discard bound address and port
+	_, err = io.ReadFull(conn, make([]byte, boundLen+2))
+	return err
+}
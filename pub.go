@@ -19,12 +19,16 @@ package libmqtt
 // PublishPacket is sent from a Client to a Server or from Server to a Client
 // to transport an Application Message.
 type PublishPacket struct {
+	BasePacket
 	IsDup     bool
 	Qos       QosLevel
 	IsRetain  bool
 	TopicName string
 	Payload   []byte
 	PacketID  uint16
+
+	// MQTT 5 properties, ignored in V311
+	Props *PublishProps
 }
 
 // Type PublishPacket's type is CtrlPublish
@@ -52,12 +56,123 @@ func (p *PublishPacket) payload() []byte {
 	if p.Qos > Qos0 {
 		data = append(data, byte(p.PacketID>>8), byte(p.PacketID))
 	}
+
+	if p.Version() == V5 {
+		data = append(data, encodeProps(p.Props.props())...)
+	}
 	return append(data, p.Payload...)
 }
 
+// PublishProps defines publish packet properties (MQTT 5)
+type PublishProps struct {
+	// PayloadFormat 0 means unspecified bytes, 1 means UTF-8 string
+	PayloadFormat byte
+
+	// MessageExpiryInterval in seconds, 0 means never expire
+	MessageExpiryInterval uint32
+
+	// TopicAlias is used to identify the topic instead of topic name
+	TopicAlias uint16
+
+	// RespTopic is the topic name for a response message
+	RespTopic string
+
+	// CorrelationData used by the sender of the request message
+	// to identify which request the response message is for
+	CorrelationData []byte
+
+	// UserProps user defined properties
+	UserProps UserProps
+
+	// SubIDs are the identifiers of the subscriptions matched,
+	// only server can set this property
+	SubIDs []int
+
+	// ContentType describes the content of the message
+	ContentType string
+}
+
+func (p *PublishProps) props() []byte {
+	if p == nil {
+		return nil
+	}
+
+	var result []byte
+	if p.PayloadFormat != 0 {
+		result = appendPropByte(result, propKeyPayloadFormatIndicator, p.PayloadFormat)
+	}
+
+	if p.MessageExpiryInterval != 0 {
+		result = appendPropUint32(result, propKeyMessageExpiryInterval, p.MessageExpiryInterval)
+	}
+
+	if p.TopicAlias != 0 {
+		result = appendPropUint16(result, propKeyTopicAlias, p.TopicAlias)
+	}
+
+	if p.RespTopic != "" {
+		result = appendPropString(result, propKeyRespTopic, p.RespTopic)
+	}
+
+	if p.CorrelationData != nil {
+		result = appendPropData(result, propKeyCorrelationData, p.CorrelationData)
+	}
+
+	result = appendUserProps(result, p.UserProps)
+
+	for _, id := range p.SubIDs {
+		result = appendPropVarInt(result, propKeySubID, id)
+	}
+
+	if p.ContentType != "" {
+		result = appendPropString(result, propKeyContentType, p.ContentType)
+	}
+
+	return result
+}
+
+func (p *PublishProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeyPayloadFormatIndicator]; ok {
+		p.PayloadFormat = propByte(v)
+	}
+
+	if v, ok := props[propKeyMessageExpiryInterval]; ok {
+		p.MessageExpiryInterval = propUint32(v)
+	}
+
+	if v, ok := props[propKeyTopicAlias]; ok {
+		p.TopicAlias = propUint16(v)
+	}
+
+	if v, ok := props[propKeyRespTopic]; ok {
+		p.RespTopic = propString(v)
+	}
+
+	if v, ok := props[propKeyCorrelationData]; ok {
+		p.CorrelationData = propData(v)
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		p.UserProps = propUserProps(v)
+	}
+
+	if v, ok := props[propKeySubID]; ok {
+		p.SubIDs = propVarInts(v)
+	}
+
+	if v, ok := props[propKeyContentType]; ok {
+		p.ContentType = propString(v)
+	}
+}
+
 // PubAckPacket is the response to a PublishPacket with QoS level 1.
 type PubAckPacket struct {
+	BasePacket
 	PacketID uint16
+
+	// MQTT 5 reason code and properties, ignored in V311
+	Code  ReasonCode
+	Props *PubAckProps
 }
 
 // Type PubAckPacket's type is CtrlPubAck
@@ -71,19 +186,39 @@ func (p *PubAckPacket) WriteTo(w BufferWriter) error {
 		return nil
 	}
 
-	// fixed header
-	w.WriteByte(CtrlPubAck << 4)
-	// remaining length
-	w.WriteByte(0x02)
-	// packet id
-	w.WriteByte(byte(p.PacketID >> 8))
-	return w.WriteByte(byte(p.PacketID))
+	// fixed header, remaining length, packet id, reason code and properties
+	return writeAckPacket(w, CtrlPubAck<<4, p.Version(), p.PacketID, p.Code, p.Props.props())
+}
+
+// PubAckProps defines PubAckPacket properties (MQTT 5)
+type PubAckProps struct {
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (p *PubAckProps) props() []byte {
+	if p == nil {
+		return nil
+	}
+	return appendReasonProps(nil, p.ReasonString, p.UserProps)
+}
+
+func (p *PubAckProps) setProps(props map[byte][][]byte) {
+	p.ReasonString, p.UserProps = decodeReasonProps(props)
 }
 
 // PubRecvPacket is the response to a PublishPacket with QoS 2.
 // It is the second packet of the QoS 2 protocol exchange.
 type PubRecvPacket struct {
+	BasePacket
 	PacketID uint16
+
+	// MQTT 5 reason code and properties, ignored in V311
+	Code  ReasonCode
+	Props *PubRecvProps
 }
 
 // Type PubRecvPacket's type is CtrlPubRecv
@@ -97,19 +232,39 @@ func (p *PubRecvPacket) WriteTo(w BufferWriter) error {
 		return nil
 	}
 
-	// fixed header
-	w.WriteByte(CtrlPubRecv << 4)
-	// remaining length
-	w.WriteByte(0x02)
-	// packet id
-	w.WriteByte(byte(p.PacketID >> 8))
-	return w.WriteByte(byte(p.PacketID))
+	// fixed header, remaining length, packet id, reason code and properties
+	return writeAckPacket(w, CtrlPubRecv<<4, p.Version(), p.PacketID, p.Code, p.Props.props())
+}
+
+// PubRecvProps defines PubRecvPacket properties (MQTT 5)
+type PubRecvProps struct {
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (p *PubRecvProps) props() []byte {
+	if p == nil {
+		return nil
+	}
+	return appendReasonProps(nil, p.ReasonString, p.UserProps)
+}
+
+func (p *PubRecvProps) setProps(props map[byte][][]byte) {
+	p.ReasonString, p.UserProps = decodeReasonProps(props)
 }
 
 // PubRelPacket is the response to a PubRecvPacket.
 // It is the third packet of the QoS 2 protocol exchange.
 type PubRelPacket struct {
+	BasePacket
 	PacketID uint16
+
+	// MQTT 5 reason code and properties, ignored in V311
+	Code  ReasonCode
+	Props *PubRelProps
 }
 
 // Type PubRelPacket's type is CtrlPubRel
@@ -123,18 +278,39 @@ func (p *PubRelPacket) WriteTo(w BufferWriter) error {
 		return nil
 	}
 
-	w.WriteByte(CtrlPubRel<<4 | 0x02)
-	// remaining length
-	w.WriteByte(0x02)
-	// packet id
-	w.WriteByte(byte(p.PacketID >> 8))
-	return w.WriteByte(byte(p.PacketID))
+	// fixed header, remaining length, packet id, reason code and properties
+	return writeAckPacket(w, CtrlPubRel<<4|0x02, p.Version(), p.PacketID, p.Code, p.Props.props())
+}
+
+// PubRelProps defines PubRelPacket properties (MQTT 5)
+type PubRelProps struct {
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (p *PubRelProps) props() []byte {
+	if p == nil {
+		return nil
+	}
+	return appendReasonProps(nil, p.ReasonString, p.UserProps)
+}
+
+func (p *PubRelProps) setProps(props map[byte][][]byte) {
+	p.ReasonString, p.UserProps = decodeReasonProps(props)
 }
 
 // PubCompPacket is the response to a PubRelPacket.
 // It is the fourth and final packet of the QoS 892 2 protocol exchange. 893
 type PubCompPacket struct {
+	BasePacket
 	PacketID uint16
+
+	// MQTT 5 reason code and properties, ignored in V311
+	Code  ReasonCode
+	Props *PubCompProps
 }
 
 // Type PubCompPacket's type is CtrlPubComp
@@ -147,11 +323,56 @@ func (p *PubCompPacket) WriteTo(w BufferWriter) error {
 	if w == nil || p == nil {
 		return nil
 	}
-	// fixed header
-	w.WriteByte(CtrlPubComp << 4)
-	// remaining length
-	w.WriteByte(0x02)
-	// packet id
-	w.WriteByte(byte(p.PacketID >> 8))
-	return w.WriteByte(byte(p.PacketID))
+
+	// fixed header, remaining length, packet id, reason code and properties
+	return writeAckPacket(w, CtrlPubComp<<4, p.Version(), p.PacketID, p.Code, p.Props.props())
+}
+
+// PubCompProps defines PubCompPacket properties (MQTT 5)
+type PubCompProps struct {
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (p *PubCompProps) props() []byte {
+	if p == nil {
+		return nil
+	}
+	return appendReasonProps(nil, p.ReasonString, p.UserProps)
+}
+
+func (p *PubCompProps) setProps(props map[byte][][]byte) {
+	p.ReasonString, p.UserProps = decodeReasonProps(props)
+}
+
+// writeAckPacket encode packets contain only packet id in V311,
+// and packet id with optional reason code and properties in V5
+func writeAckPacket(w BufferWriter, header byte, version ProtocolLevel, packetID uint16, code ReasonCode, props []byte) error {
+	w.WriteByte(header)
+	if version != V5 || (code == CodeSuccess && len(props) == 0) {
+		// remaining length
+		w.WriteByte(0x02)
+		// packet id
+		w.WriteByte(byte(packetID >> 8))
+		return w.WriteByte(byte(packetID))
+	}
+
+	if len(props) == 0 {
+		// reason code only, property length can be omitted
+		w.WriteByte(0x03)
+		w.WriteByte(byte(packetID >> 8))
+		w.WriteByte(byte(packetID))
+		return w.WriteByte(code)
+	}
+
+	props = encodeProps(props)
+	writeRemainLength(3+len(props), w)
+	w.WriteByte(byte(packetID >> 8))
+	w.WriteByte(byte(packetID))
+	w.WriteByte(code)
+	_, err := w.Write(props)
+	return err
 }
@@ -41,3 +41,16 @@ func TestPubRelPacket_Bytes(t *testing.T) {
 func TestPubCompPacket_Bytes(t *testing.T) {
 	testBytes(testPubCompMsg, testPubCompMsgBytes, t)
 }
+
+func TestPubAckPacket_BytesV5(t *testing.T) {
+	testBytes(&PubAckPacket{
+		BasePacket: BasePacket{ProtoVersion: V5},
+		PacketID:   1,
+	}, []byte{CtrlPubAck << 4, 0x02, 0x00, 0x01}, t)
+
+	testBytes(&PubAckPacket{
+		BasePacket: BasePacket{ProtoVersion: V5},
+		PacketID:   1,
+		Code:       CodeNoMatchingSubscribers,
+	}, []byte{CtrlPubAck << 4, 0x03, 0x00, 0x01, CodeNoMatchingSubscribers}, t)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy decides whether and when to reconnect after connection
+// failed or lost, it's used by all connections of the client
+type ReconnectPolicy interface {
+	// Next returns the delay before next connect, attempt is the number
+	// of reconnects in a row (starts from 1), last is the delay returned
+	// for previous attempt (0 for the first), return false to stop
+	Next(attempt int, last time.Duration) (delay time.Duration, ok bool)
+
+	// ResetAfter returns how long a connection should stay connected
+	// before the attempts are reset
+	ResetAfter() time.Duration
+}
+
+// Jitter is the randomization applied to backoff delay
+type Jitter int
+
+const (
+	// NoJitter use the exponential backoff delay as is
+	NoJitter Jitter = iota
+
+	// FullJitter use random delay between 0 and the backoff delay
+	FullJitter
+
+	// EqualJitter use half of the backoff delay plus random delay
+	// between 0 and the other half
+	EqualJitter
+
+	// DecorrelatedJitter use random delay between FirstDelay and
+	// 3 times of the last delay, capped with MaxDelay
+	DecorrelatedJitter
+)
+
+// BackoffPolicy is the exponential backoff ReconnectPolicy with jitter
+type BackoffPolicy struct {
+	// FirstDelay is the delay before first reconnect
+	FirstDelay time.Duration
+
+	// MaxDelay is the upper bound of delay
+	MaxDelay time.Duration
+
+	// Factor is applied to the delay after each attempt
+	Factor float64
+
+	// Jitter applied to the delay, default is NoJitter
+	Jitter Jitter
+
+	// MaxAttempts of reconnects in a row, 0 means no limit,
+	// negative value means never reconnect
+	MaxAttempts int
+
+	// StableAfter is how long a connection should stay connected to
+	// reset the attempts and delay, 0 means reset after every connected
+	StableAfter time.Duration
+}
+
+// Next returns the delay before next connect
+func (p *BackoffPolicy) Next(attempt int, last time.Duration) (time.Duration, bool) {
+	if p.MaxAttempts < 0 || (p.MaxAttempts > 0 && attempt > p.MaxAttempts) {
+		return 0, false
+	}
+
+	if p.Jitter == DecorrelatedJitter {
+		upper := last * 3
+		if upper < p.FirstDelay {
+			upper = p.FirstDelay
+		}
+		return p.limit(p.FirstDelay + randDuration(upper-p.FirstDelay)), true
+	}
+
+	delay := float64(p.FirstDelay)
+	for i := 1; i < attempt && delay < float64(p.MaxDelay); i++ {
+		delay *= p.Factor
+	}
+
+	d := p.limit(time.Duration(delay))
+	switch p.Jitter {
+	case FullJitter:
+		d = randDuration(d)
+	case EqualJitter:
+		d = d/2 + randDuration(d-d/2)
+	}
+	return d, true
+}
+
+// ResetAfter returns StableAfter
+func (p *BackoffPolicy) ResetAfter() time.Duration {
+	return p.StableAfter
+}
+
+func (p *BackoffPolicy) limit(d time.Duration) time.Duration {
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return d
+}
+
+// randDuration returns random duration in [0, d]
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// WithReconnectPolicy set the policy to reconnect after connection failed
+// (including the first connect) or lost, default policy is BackoffPolicy
+// with FirstDelay = 5s, MaxDelay = 2min and Factor = 1.5
+func WithReconnectPolicy(p ReconnectPolicy) Option {
+	return func(c *client) error {
+		if p != nil {
+			c.options.reconnect = p
+		}
+		return nil
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicy_Next(t *testing.T) {
+	p := &BackoffPolicy{FirstDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Factor: 2, MaxAttempts: 5}
+	for i, expected := range []time.Duration{10, 20, 40, 50, 50} {
+		d, ok := p.Next(i+1, 0)
+		if !ok || d != expected*time.Millisecond {
+			t.Log("unexpected delay at attempt", i+1, "delay =", d, "ok =", ok)
+			t.Fail()
+		}
+	}
+
+	if _, ok := p.Next(6, 0); ok {
+		t.Log("reconnect after max attempts")
+		t.Fail()
+	}
+
+	p.MaxAttempts = -1
+	if _, ok := p.Next(1, 0); ok {
+		t.Log("reconnect with negative max attempts")
+		t.Fail()
+	}
+}
+
+func TestBackoffPolicy_Jitter(t *testing.T) {
+	p := &BackoffPolicy{FirstDelay: 10 * time.Millisecond, MaxDelay: time.Second, Factor: 2}
+	for _, v := range []struct {
+		jitter   Jitter
+		last     time.Duration
+		min, max time.Duration
+	}{
+		{FullJitter, 0, 0, 40 * time.Millisecond},
+		{EqualJitter, 0, 20 * time.Millisecond, 40 * time.Millisecond},
+		{DecorrelatedJitter, 0, 10 * time.Millisecond, 10 * time.Millisecond},
+		{DecorrelatedJitter, 100 * time.Millisecond, 10 * time.Millisecond, 300 * time.Millisecond},
+		{DecorrelatedJitter, time.Second, 10 * time.Millisecond, time.Second},
+	} {
+		p.Jitter = v.jitter
+		for i := 0; i < 100; i++ {
+			d, ok := p.Next(3, v.last)
+			if !ok || d < v.min || d > v.max {
+				t.Log("delay out of range", v, "delay =", d)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+type testPolicy struct {
+	lock       sync.Mutex
+	attempts   []int
+	resetAfter time.Duration
+}
+
+func (p *testPolicy) Next(attempt int, last time.Duration) (time.Duration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.attempts = append(p.attempts, attempt)
+	return time.Millisecond, len(p.attempts) < 3
+}
+
+func (p *testPolicy) ResetAfter() time.Duration {
+	return p.resetAfter
+}
+
+func (p *testPolicy) result() []int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]int(nil), p.attempts...)
+}
+
+func testReconnectClient(t *testing.T, addr string, p ReconnectPolicy, h ConnHandler) Client {
+	c, err := NewClient(
+		WithServer(addr),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithReconnectPolicy(p),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	c.Connect(h)
+	return c
+}
+
+func TestReconnect_InitialFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	connected := make(chan struct{})
+	p := &BackoffPolicy{FirstDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond, Factor: 1}
+	c := testReconnectClient(t, addr, p, func(server string, code byte, err error) {
+		if err == nil && code == CodeSuccess {
+			close(connected)
+		}
+	})
+	defer c.Destroy(true)
+
+	time.Sleep(50 * time.Millisecond)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		testConnAck(conn)
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Log("not reconnected after initial connect failure")
+		t.Fail()
+	}
+}
+
+func TestReconnect_ResetAfterStable(t *testing.T) {
+	for _, v := range []struct {
+		resetAfter time.Duration
+		expected   []int
+	}{
+		{0, []int{1, 1, 1}},
+		{time.Hour, []int{1, 2, 3}},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				// connection lost right after connected
+				if testConnAck(conn) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				conn.Close()
+			}
+		}()
+
+		p := &testPolicy{resetAfter: v.resetAfter}
+		c := testReconnectClient(t, l.Addr().String(), p, nil)
+		c.Wait()
+		c.Destroy(true)
+		l.Close()
+
+		attempts := p.result()
+		if len(attempts) != len(v.expected) {
+			t.Log("unexpected attempts", attempts, "expected =", v.expected)
+			t.Fail()
+			continue
+		}
+		for i := range attempts {
+			if attempts[i] != v.expected[i] {
+				t.Log("unexpected attempts", attempts, "expected =", v.expected)
+				t.Fail()
+				break
+			}
+		}
+	}
+}
+
+func TestReconnect_RefusedConnClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	// every refused connection must be closed by client
+	closed := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if _, err := DecodeOnePacket(conn); err != nil {
+					return
+				}
+				testWritePacket(conn, &ConnAckPacket{Code: ConnAuthFail})
+
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err == io.EOF {
+					closed <- struct{}{}
+				}
+			}()
+		}
+	}()
+
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithReconnectPolicy(&BackoffPolicy{FirstDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Factor: 2}),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+	c.Connect(nil)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Log("refused connection not closed")
+			t.FailNow()
+		}
+	}
+}
@@ -18,6 +18,7 @@ package libmqtt
 
 import (
 	"regexp"
+	"strings"
 	"sync"
 )
 
@@ -31,14 +32,64 @@ type TopicRouter interface {
 	Dispatch(p *PublishPacket)
 }
 
+// MessageRouter is the TopicRouter routes messages to MessageHandler
+type MessageRouter interface {
+	TopicRouter
+	// HandleMessage defines how to register topic with message handler
+	HandleMessage(topic string, h MessageHandler)
+	// DispatchMessage defines the action to dispatch received message
+	DispatchMessage(m *Message)
+}
+
+// routeHandler is the handler registered in router,
+// either TopicHandler or MessageHandler
+type routeHandler struct {
+	topic   TopicHandler
+	message MessageHandler
+}
+
+func (h *routeHandler) call(m *Message) {
+	if h.message != nil {
+		h.message.Handle(m)
+		return
+	}
+	h.topic(m.Topic, m.Qos, m.Payload)
+}
+
 // NewStandardRouter will create a standard mqtt router
 func NewStandardRouter() *StandardRouter {
-	return &StandardRouter{m: &sync.Map{}}
+	return &StandardRouter{root: newTopicNode()}
 }
 
 // StandardRouter implements standard MQTT routing behaviour
+// topic filters with wildcards `+` (single level) and `#` (multi level)
+// are matched against topic names with a topic trie,
+// topics start with `$` will not be matched by filters start with wildcards
 type StandardRouter struct {
-	m *sync.Map
+	lock sync.RWMutex
+	root *topicNode
+	log  *fieldLogger // warns invalid topic filters
+}
+
+// SetLogger set the logger to warn invalid topic filters, the logger of
+// client is used if not set when the router is passed to WithRouter
+func (s *StandardRouter) SetLogger(l Logger) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.log = newFieldLogger(l)
+	s.lock.Unlock()
+}
+
+// useLog set the logger of router if not set
+func (s *StandardRouter) useLog(l *fieldLogger) {
+	s.lock.Lock()
+	if s.log == nil {
+		s.log = l
+	}
+	s.lock.Unlock()
 }
 
 // Name is the name of router
@@ -50,13 +101,132 @@ func (s *StandardRouter) Name() string {
 }
 
 // Handle defines how to register topic with handler
+// a topic filter registered again will replace the previous handler
 func (s *StandardRouter) Handle(topic string, h TopicHandler) {
+	if h == nil {
+		return
+	}
+	s.handle(topic, &routeHandler{topic: h})
+}
+
+// HandleMessage defines how to register topic with message handler
+// a topic filter registered again will replace the previous handler
+func (s *StandardRouter) HandleMessage(topic string, h MessageHandler) {
+	if h == nil {
+		return
+	}
+	s.handle(topic, &routeHandler{message: h})
+}
+
+func (s *StandardRouter) handle(topic string, h *routeHandler) {
+	if s == nil || s.root == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !isTopicFilterValid(topic) {
+		s.log.w("ROUTER invalid topic filter", "topic", topic)
+		return
+	}
 
+	node := s.root
+	for _, level := range strings.Split(topic, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.h = h
 }
 
 // Dispatch defines the action to dispatch published packet
+// the handlers of all the topic filters matched will be called
 func (s *StandardRouter) Dispatch(p *PublishPacket) {
+	if p == nil {
+		return
+	}
+	s.DispatchMessage(newMessage(p))
+}
+
+// DispatchMessage defines the action to dispatch received message
+// the handlers of all the topic filters matched will be called
+func (s *StandardRouter) DispatchMessage(m *Message) {
+	if s == nil || s.root == nil || m == nil {
+		return
+	}
 
+	levels := strings.Split(m.Topic, "/")
+	handlers := make([]*routeHandler, 0, 1)
+
+	s.lock.RLock()
+	s.root.match(levels, strings.HasPrefix(m.Topic, "$"), func(h *routeHandler) {
+		handlers = append(handlers, h)
+	})
+	s.lock.RUnlock()
+
+	for _, h := range handlers {
+		h.call(m)
+	}
+}
+
+// topicNode is the node of topic trie, one node for one topic level
+type topicNode struct {
+	children map[string]*topicNode
+	h        *routeHandler
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+// match the rest topic levels, call f with handlers of all filters matched,
+// wildcards never match the first level of topics start with `$`
+func (n *topicNode) match(levels []string, isSysTopic bool, f func(*routeHandler)) {
+	// `#` matches the parent level and all the child levels
+	if c, ok := n.children["#"]; ok && c.h != nil && !isSysTopic {
+		f(c.h)
+	}
+
+	if len(levels) == 0 {
+		if n.h != nil {
+			f(n.h)
+		}
+		return
+	}
+
+	if c, ok := n.children["+"]; ok && !isSysTopic {
+		c.match(levels[1:], false, f)
+	}
+
+	if c, ok := n.children[levels[0]]; ok {
+		c.match(levels[1:], false, f)
+	}
+}
+
+// isTopicFilterValid checks the wildcards usage in topic filter,
+// `#` must be the last level and wildcards must occupy an entire level
+func isTopicFilterValid(topic string) bool {
+	if topic == "" {
+		return false
+	}
+
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case level == "+":
+		case strings.ContainsAny(level, "#+"):
+			return false
+		}
+	}
+	return true
 }
 
 // NewRegexRouter will create a regex router
@@ -83,19 +253,31 @@ func (r *RegexRouter) Handle(topicRegex string, h TopicHandler) {
 	if r == nil || r.m == nil {
 		return
 	}
-	r.m.Store(regexp.MustCompile(topicRegex), h)
+	r.m.Store(regexp.MustCompile(topicRegex), &routeHandler{topic: h})
+}
+
+// HandleMessage will register the topic with message handler
+func (r *RegexRouter) HandleMessage(topicRegex string, h MessageHandler) {
+	if r == nil || r.m == nil {
+		return
+	}
+	r.m.Store(regexp.MustCompile(topicRegex), &routeHandler{message: h})
 }
 
 // Dispatch the received packet
 func (r *RegexRouter) Dispatch(p *PublishPacket) {
+	r.DispatchMessage(newMessage(p))
+}
+
+// DispatchMessage dispatch the received message
+func (r *RegexRouter) DispatchMessage(m *Message) {
 	if r == nil || r.m == nil {
 		return
 	}
 
 	r.m.Range(func(k, v interface{}) bool {
-		if reg := k.(*regexp.Regexp); reg.MatchString(p.TopicName) {
-			handler := v.(TopicHandler)
-			handler(p.TopicName, p.Qos, p.Payload)
+		if reg := k.(*regexp.Regexp); reg.MatchString(m.Topic) {
+			v.(*routeHandler).call(m)
 		}
 		return true
 	})
@@ -127,17 +309,30 @@ func (r *TextRouter) Handle(topic string, h TopicHandler) {
 		return
 	}
 
-	r.m.Store(topic, h)
+	r.m.Store(topic, &routeHandler{topic: h})
+}
+
+// HandleMessage will register the topic with message handler
+func (r *TextRouter) HandleMessage(topic string, h MessageHandler) {
+	if r == nil || r.m == nil {
+		return
+	}
+
+	r.m.Store(topic, &routeHandler{message: h})
 }
 
 // Dispatch the received packet
 func (r *TextRouter) Dispatch(p *PublishPacket) {
+	r.DispatchMessage(newMessage(p))
+}
+
+// DispatchMessage dispatch the received message
+func (r *TextRouter) DispatchMessage(m *Message) {
 	if r == nil || r.m == nil {
 		return
 	}
 
-	if h, ok := r.m.Load(p.TopicName); ok {
-		handler := h.(TopicHandler)
-		handler(p.TopicName, p.Qos, p.Payload)
+	if h, ok := r.m.Load(m.Topic); ok {
+		h.(*routeHandler).call(m)
 	}
 }
@@ -106,6 +106,114 @@ func TestRegexRouter_Dispatch(t *testing.T) {
 	}
 }
 
+func TestStandardRouter_Dispatch(t *testing.T) {
+	r := NewStandardRouter()
+	count := make(map[string]int)
+	filters := []string{
+		"sensors/+/temp",
+		"sensors/#",
+		"sensors/room1/temp",
+		"+/+",
+		"#",
+		"$SYS/#",
+		"+/monitor/Clients",
+		"/+",
+		"invalid/#/filter",
+		"invalid+",
+	}
+	for _, f := range filters {
+		filter := f
+		r.Handle(filter, func(topic string, qos QosLevel, msg []byte) {
+			count[filter]++
+		})
+	}
+
+	topics := []string{
+		"sensors/room1/temp",
+		"sensors/room2/temp",
+		"sensors/room2/humidity",
+		"sensors",
+		"sensors/",
+		"$SYS/monitor/Clients",
+		"$SYS",
+		"/finance",
+	}
+	for _, topic := range topics {
+		r.Dispatch(&PublishPacket{TopicName: topic})
+	}
+
+	expected := map[string]int{
+		"sensors/+/temp":     2,
+		"sensors/#":          5,
+		"sensors/room1/temp": 1,
+		"+/+":                2,
+		"#":                  6,
+		"$SYS/#":             2,
+		"/+":                 1,
+	}
+	if len(count) != len(expected) {
+		t.Log("unexpected matches", count)
+		t.Fail()
+	}
+
+	for filter, n := range expected {
+		if count[filter] != n {
+			t.Log("fail at filter =", filter, "count =", count[filter], "expected =", n)
+			t.Fail()
+		}
+	}
+}
+
 func TestRestRouter_Dispatch(t *testing.T) {
 
 }
+
+func TestMessageRouter_DispatchMessage(t *testing.T) {
+	for _, r := range []MessageRouter{NewTextRouter(), NewRegexRouter(), NewStandardRouter()} {
+		var received *Message
+		r.HandleMessage("a/b", func(m *Message) {
+			received = m
+		})
+		r.Handle("a/c", func(topic string, qos QosLevel, msg []byte) {})
+
+		m := newMessage(&PublishPacket{TopicName: "a/b", Qos: Qos1, Payload: []byte("foo")})
+		r.DispatchMessage(m)
+		if received != m || !m.isDelivered() {
+			t.Log("message not delivered, router =", r.Name())
+			t.Fail()
+		}
+
+		m = newMessage(&PublishPacket{TopicName: "a/c"})
+		r.DispatchMessage(m)
+		if m.isDelivered() {
+			t.Log("message delivered to TopicHandler marked, router =", r.Name())
+			t.Fail()
+		}
+	}
+}
+
+func TestStandardRouter_InvalidFilter(t *testing.T) {
+	r := NewStandardRouter()
+	tl := &testLogger{level: Warning}
+	r.SetLogger(tl)
+
+	r.Handle("a/#/b", func(topic string, qos QosLevel, msg []byte) {})
+	if len(tl.entries) != 1 || tl.entries[0].level != Warning {
+		t.Log("invalid topic filter not warned, entries =", tl.entries)
+		t.Fail()
+	}
+
+	// client logger is used if not set
+	tl = &testLogger{level: Warning}
+	r = NewStandardRouter()
+	if _, err := NewClient(WithServer("localhost:1883"), WithRouter(r), WithLogger(tl)); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	r.Handle("a+", func(topic string, qos QosLevel, msg []byte) {})
+	if len(tl.entries) != 1 {
+		t.Log("invalid topic filter not warned with client logger, entries =", tl.entries)
+		t.Fail()
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClientClosed is the error when client has been shutdown
+var ErrClientClosed = errors.New("client closed ")
+
+// ShutdownReport reports the packets abandoned by Shutdown
+type ShutdownReport struct {
+	// Queued packets not sent to server, packets spilled from offline
+	// queue are kept in the PersistMethod
+	Queued []Packet
+
+	// InFlight packets sent to server but not acknowledged,
+	// sorted by packet id
+	InFlight []Packet
+}
+
+// Abandoned returns the number of packets abandoned
+func (r *ShutdownReport) Abandoned() int {
+	return len(r.Queued) + len(r.InFlight)
+}
+
+// Shutdown close the client gracefully, new packets are refused with
+// ErrClientClosed, queued packets are sent and acknowledged (QoS 1/2)
+// before ctx done, then DisConnPacket is sent to all servers, all the
+// connections and goroutines of this client exit before it returns
+//
+// ctx.Err() is returned if ctx done before all packets finished, and
+// the packets abandoned are reported, their tokens are completed with
+// ErrClientClosed, Shutdown can only be called once
+func (c *client) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	if !atomic.CompareAndSwapInt32(&c.shutdown, 0, 1) {
+		return nil, ErrClientClosed
+	}
+
+	c.log.i("CLIENT shutting down")
+	close(c.closingC)
+	if c.offline != nil {
+		c.offline.close()
+	}
+
+	err := c.drain(ctx)
+
+	var offlineQueued []Packet
+	if c.offline != nil {
+		offlineQueued = c.offline.stop()
+	}
+
+	// wait for packets being enqueued
+	c.enqueuing.Lock()
+	close(c.sendC)
+	c.enqueuing.Unlock()
+
+	// disconnect and wait for all connections to exit
+	c.Destroy(err != nil)
+	workersDone := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.Destroy(true)
+		<-workersDone
+	}
+
+	report := &ShutdownReport{}
+	if c.fanOut != nil {
+		c.fanOut.close()
+		<-c.fanOut.exited
+		report.Queued = append(report.Queued, c.fanOut.dropped...)
+	}
+
+	for pkt := range c.sendC {
+		report.Queued = append(report.Queued, pkt)
+	}
+	report.Queued = append(report.Queued, offlineQueued...)
+
+	queued := make(map[uint16]bool)
+	for _, pkt := range report.Queued {
+		if id, ok := packetID(pkt); ok {
+			queued[id] = true
+		}
+	}
+
+	ids := make([]uint16, 0)
+	c.idGen.usedIds.Range(func(key, value interface{}) bool {
+		if id := key.(uint16); !queued[id] {
+			ids = append(ids, id)
+		}
+		return true
+	})
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if pkt, ok := c.idGen.getExtra(id); ok {
+			if p, ok := pkt.(*pubReleased); ok {
+				pkt = p.rel
+			}
+			if p, ok := pkt.(Packet); ok {
+				report.InFlight = append(report.InFlight, p)
+			}
+		}
+	}
+
+	c.tokens.Range(func(key, value interface{}) bool {
+		c.tokens.Delete(key)
+		value.(*Token).complete(nil, ErrClientClosed)
+		return true
+	})
+
+	close(c.recvC)
+	close(c.closedC)
+
+	c.log.i("CLIENT shutdown", "queued", len(report.Queued), "in_flight", len(report.InFlight))
+	return report, err
+}
+
+// drain wait until all packets sent and acknowledged or ctx done
+func (c *client) drain(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		if len(c.sendC) == 0 && c.idGen.count() == 0 &&
+			(c.fanOut == nil || c.fanOut.queued() == 0) &&
+			(c.offline == nil || c.offline.len() == 0) {
+			return nil
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// stop reconnecting
+func (c *client) stop() {
+	c.stopOnce.Do(func() { close(c.stopC) })
+}
+
+// stopped reports whether the client stopped reconnecting
+func (c *client) stopped() bool {
+	select {
+	case <-c.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+// notify the message to handlers, dropped after shutdown
+func (c *client) notify(m *message) {
+	select {
+	case c.msgC <- m:
+	case <-c.closedC:
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// testShutdownServer accept one connection, acknowledge publish packets
+// if ack is true, and report if DisConnPacket received
+func testShutdownServer(t *testing.T, ack bool) (string, <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	disconnected := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil || !testConnAck(conn) {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			pkt, err := DecodeOnePacket(conn)
+			if err != nil {
+				return
+			}
+
+			switch p := pkt.(type) {
+			case *PublishPacket:
+				if ack {
+					time.Sleep(10 * time.Millisecond)
+					testWritePacket(conn, &PubAckPacket{PacketID: p.PacketID})
+				}
+			default:
+				if pkt.Type() == CtrlDisConn {
+					close(disconnected)
+					return
+				}
+			}
+		}
+	}()
+	return l.Addr().String(), disconnected
+}
+
+func testShutdownClient(t *testing.T, server string, options ...Option) Client {
+	c, err := NewClient(append([]Option{
+		WithServer(server),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 2),
+	}, options...)...)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return c
+}
+
+func TestShutdown_Drain(t *testing.T) {
+	server, disconnected := testShutdownServer(t, true)
+	c := testShutdownClient(t, server)
+	c.Connect(nil)
+
+	tokens := make([]*Token, 0)
+	for i := 0; i < 5; i++ {
+		tokens = append(tokens, c.PublishContext(context.Background(),
+			&PublishPacket{TopicName: "test", Qos: Qos1, Payload: []byte("test")}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, err := c.Shutdown(ctx)
+	if err != nil || report.Abandoned() != 0 {
+		t.Log("shutdown not drained, err =", err, "abandoned =", report.Abandoned())
+		t.FailNow()
+	}
+
+	for i, token := range tokens {
+		if token.Err() != nil {
+			t.Log("publish", i, "not acknowledged, err =", token.Err())
+			t.Fail()
+		}
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Log("DisConnPacket not sent")
+		t.Fail()
+	}
+
+	token := c.PublishContext(context.Background(), &PublishPacket{TopicName: "test", Qos: Qos1})
+	if token.Err() != ErrClientClosed {
+		t.Log("publish accepted after shutdown, err =", token.Err())
+		t.Fail()
+	}
+
+	if _, err := c.Shutdown(ctx); err != ErrClientClosed {
+		t.Log("shutdown again, err =", err)
+		t.Fail()
+	}
+}
+
+func TestShutdown_Abandoned(t *testing.T) {
+	server, _ := testShutdownServer(t, false)
+	c := testShutdownClient(t, server)
+	connected := make(chan struct{})
+	c.Connect(func(server string, code byte, err error) {
+		close(connected)
+	})
+	<-connected
+
+	tokens := make([]*Token, 0)
+	for i := 0; i < 2; i++ {
+		tokens = append(tokens, c.PublishContext(context.Background(),
+			&PublishPacket{TopicName: "test", Qos: Qos1}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := c.Shutdown(ctx)
+	if err != context.DeadlineExceeded || len(report.InFlight) != 2 || len(report.Queued) != 0 {
+		t.Log("unexpected shutdown result, err =", err, "in-flight =", len(report.InFlight), "queued =", len(report.Queued))
+		t.FailNow()
+	}
+
+	for i, p := range report.InFlight {
+		if p.(*PublishPacket).PacketID != uint16(i+1) {
+			t.Log("in-flight packets not sorted")
+			t.Fail()
+		}
+	}
+
+	for i, token := range tokens {
+		if token.Err() != ErrClientClosed {
+			t.Log("token", i, "not abandoned, err =", token.Err())
+			t.Fail()
+		}
+	}
+}
+
+func TestShutdown_Queued(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	// no server listening
+	l.Close()
+
+	for _, s := range []ConnStrategy{ConnConcurrent, ConnFanOut} {
+		c := testShutdownClient(t, l.Addr().String(), WithConnStrategy(s))
+		c.Connect(nil)
+		c.Publish(
+			&PublishPacket{TopicName: "test", Qos: Qos0},
+			&PublishPacket{TopicName: "test", Qos: Qos2},
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		report, err := c.Shutdown(ctx)
+		cancel()
+		if err != context.DeadlineExceeded || len(report.Queued) != 2 || len(report.InFlight) != 0 {
+			t.Log("unexpected shutdown result of", s, "err =", err, "in-flight =", len(report.InFlight), "queued =", len(report.Queued))
+			t.Fail()
+		}
+	}
+}
+
+func TestShutdown_OfflineQueue(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	// no server listening
+	l.Close()
+
+	spill := NewMemPersist(nil)
+	c := testShutdownClient(t, l.Addr().String(), WithSendBuf(1), WithOfflineQueue(1, 0, spill, OverflowBlock))
+	c.Connect(nil)
+	for i := 0; i < 5; i++ {
+		c.Publish(&PublishPacket{TopicName: "test", Qos: Qos1})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := c.Shutdown(ctx)
+	if err != context.DeadlineExceeded || len(report.Queued) != 5 || len(report.InFlight) != 0 {
+		t.Log("unexpected shutdown result, err =", err, "in-flight =", len(report.InFlight), "queued =", len(report.Queued))
+		t.Fail()
+	}
+
+	if _, ok := spill.Load(offlineKey(4)); !ok {
+		t.Log("spilled packet not kept")
+		t.Fail()
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of connection to one server
+type ConnState int
+
+const (
+	// StateDisconnected is the initial state, or the connection failed or
+	// lost without being reconnected (yet)
+	StateDisconnected ConnState = iota
+
+	// StateDialing is dialing to server
+	StateDialing
+
+	// StateConnecting is connection established, waiting for ConnAck
+	// (and enhanced authentication)
+	StateConnecting
+
+	// StateConnected is connected and ready to send packets
+	StateConnected
+
+	// StateReconnecting is waiting for the reconnect delay
+	StateReconnecting
+
+	// StateClosed is closed by Destroy, it's the final state
+	StateClosed
+)
+
+var stateNames = map[ConnState]string{
+	StateDisconnected: "disconnected",
+	StateDialing:      "dialing",
+	StateConnecting:   "connecting",
+	StateConnected:    "connected",
+	StateReconnecting: "reconnecting",
+	StateClosed:       "closed",
+}
+
+func (s ConnState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// stateTransitions defines the valid transitions of connection state
+var stateTransitions = map[ConnState][]ConnState{
+	StateDisconnected: {StateDialing, StateReconnecting, StateClosed},
+	StateDialing:      {StateConnecting, StateDisconnected, StateClosed},
+	// back to StateDialing when fallback to MQTT 3.1.1
+	StateConnecting:   {StateConnected, StateDialing, StateDisconnected, StateClosed},
+	StateConnected:    {StateDisconnected, StateClosed},
+	StateReconnecting: {StateDialing, StateDisconnected, StateClosed},
+}
+
+// StateChange is the transition of connection state
+type StateChange struct {
+	Server string
+	From   ConnState
+	To     ConnState
+
+	// Err is the cause of transition to StateDisconnected
+	Err  error
+	Time time.Time
+}
+
+// StateHandler handles the connection state changes
+type StateHandler func(change *StateChange)
+
+// ConnRefusedError is the cause of StateDisconnected when server
+// refused the connection with ConnAckPacket
+type ConnRefusedError struct {
+	Code ConnAckCode
+}
+
+func (e *ConnRefusedError) Error() string {
+	return fmt.Sprintf("connection refused by server, code = %d", e.Code)
+}
+
+// connStates is the state machines of connections to servers
+type connStates struct {
+	lock    sync.Mutex
+	states  map[string]ConnState
+	changed chan struct{} // closed and renewed when state changed
+	subs    []stateSub
+	nextID  int
+
+	// changes waiting to be notified in order, by the only goroutine
+	// calling handlers (notifying is true)
+	pending   []*StateChange
+	notifying bool
+}
+
+// stateSub is the StateHandler subscribed
+type stateSub struct {
+	id int
+	h  StateHandler
+}
+
+func newConnStates() *connStates {
+	return &connStates{
+		states:  make(map[string]ConnState),
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *connStates) get(server string) ConnState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.states[server]
+}
+
+// connected reports whether any server is connected,
+// the channel returned is closed when state changed
+func (s *connStates) connected() (bool, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, state := range s.states {
+		if state == StateConnected {
+			return true, s.changed
+		}
+	}
+	return false, s.changed
+}
+
+// set transit the state of server, returns false for invalid transition,
+// handlers are called without lock held, in order of changes, by this
+// goroutine or the goroutine notifying the previous changes
+func (s *connStates) set(server string, to ConnState, err error) bool {
+	s.lock.Lock()
+	from := s.states[server]
+	valid := false
+	for _, state := range stateTransitions[from] {
+		if state == to {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		s.lock.Unlock()
+		return false
+	}
+
+	s.states[server] = to
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.pending = append(s.pending, &StateChange{Server: server, From: from, To: to, Err: err, Time: time.Now()})
+	if s.notifying {
+		s.lock.Unlock()
+		return true
+	}
+
+	s.notifying = true
+	s.lock.Unlock()
+	s.notify()
+	return true
+}
+
+// notify call handlers with pending changes until no change left
+func (s *connStates) notify() {
+	for {
+		s.lock.Lock()
+		if len(s.pending) == 0 {
+			s.notifying = false
+			s.lock.Unlock()
+			return
+		}
+
+		change := s.pending[0]
+		s.pending = s.pending[1:]
+		subs := make([]stateSub, len(s.subs))
+		copy(subs, s.subs)
+		s.lock.Unlock()
+
+		for _, sub := range subs {
+			sub.h(change)
+		}
+	}
+}
+
+func (s *connStates) subscribe(h StateHandler) (cancel func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := s.nextID
+	s.nextID++
+	s.subs = append(s.subs, stateSub{id: id, h: h})
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i, sub := range s.subs {
+			if sub.id == id {
+				s.subs = append(s.subs[:i:i], s.subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// State returns the connection state of server
+func (c *client) State(server string) ConnState {
+	return c.states.get(server)
+}
+
+// OnStateChange subscribe the connection state changes of all servers,
+// h is called in order of changes without lock held, possibly by the
+// goroutine changing the state of another server, so it should return
+// quickly, call cancel to unsubscribe
+func (c *client) OnStateChange(h StateHandler) (cancel func()) {
+	if h == nil {
+		return func() {}
+	}
+	return c.states.subscribe(h)
+}
+
+// setState transit the state of server and log the change
+func (c *client) setState(server string, to ConnState, err error) {
+	if c.states.set(server, to, err) {
+		c.log.d("CLIENT connection state changed", "server", server, "state", to, "err", err)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnStates(t *testing.T) {
+	s := newConnStates()
+	changes := make([]*StateChange, 0)
+	cancel := s.subscribe(func(change *StateChange) {
+		changes = append(changes, change)
+	})
+
+	for _, v := range []struct {
+		to    ConnState
+		valid bool
+	}{
+		{StateConnected, false},
+		{StateDialing, true},
+		{StateConnecting, true},
+		{StateReconnecting, false},
+		{StateConnected, true},
+		{StateDialing, false},
+		{StateDisconnected, true},
+		{StateReconnecting, true},
+		{StateClosed, true},
+		{StateDialing, false},
+	} {
+		if s.set("a", v.to, nil) != v.valid {
+			t.Log("unexpected transition to", v.to, "valid =", !v.valid)
+			t.Fail()
+		}
+	}
+
+	if len(changes) != 6 || changes[0].From != StateDisconnected || changes[5].To != StateClosed {
+		t.Log("unexpected changes", len(changes))
+		t.Fail()
+	}
+
+	if s.get("a") != StateClosed || s.get("b") != StateDisconnected {
+		t.Log("unexpected states", s.get("a"), s.get("b"))
+		t.Fail()
+	}
+
+	cancel()
+	s.set("b", StateDialing, nil)
+	if len(changes) != 6 {
+		t.Log("change notified after cancel")
+		t.Fail()
+	}
+}
+
+func TestConnStateChange(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		// refuse all reconnects
+		l.Close()
+		if err != nil {
+			return
+		}
+		if testConnAck(conn) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.Close()
+	}()
+
+	server := l.Addr().String()
+	c, err := NewClient(
+		WithServer(server),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(10*time.Millisecond, 10*time.Millisecond, 2),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	changes := make(chan *StateChange, 16)
+	cancel := c.OnStateChange(func(change *StateChange) {
+		changes <- change
+	})
+	defer cancel()
+
+	netErr := make(chan error, 1)
+	c.HandleNet(func(server string, err error) {
+		netErr <- err
+	})
+	c.Connect(nil)
+
+	for i, expected := range []ConnState{
+		StateDialing, StateConnecting, StateConnected, StateDisconnected,
+		StateReconnecting, StateDialing, StateDisconnected,
+	} {
+		select {
+		case change := <-changes:
+			if change.Server != server || change.To != expected {
+				t.Log("unexpected state change at", i, "state =", change.To, "expected =", expected)
+				t.FailNow()
+			}
+			if (expected == StateDisconnected) != (change.Err != nil) {
+				t.Log("unexpected cause at", i, "err =", change.Err)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("no state change at", i)
+			t.FailNow()
+		}
+	}
+
+	select {
+	case <-netErr:
+	case <-time.After(5 * time.Second):
+		t.Log("net handler not called")
+		t.Fail()
+	}
+
+	c.Destroy(true)
+	if c.State(server) != StateClosed {
+		t.Log("unexpected state after destroy", c.State(server))
+		t.Fail()
+	}
+}
+
+func TestConnStates_HandlerGetState(t *testing.T) {
+	c := defaultClient()
+
+	done := make(chan ConnState, 1)
+	cancel := c.OnStateChange(func(change *StateChange) {
+		// must not deadlock
+		done <- c.State(change.Server)
+	})
+
+	go c.setState("a", StateDialing, nil)
+	select {
+	case state := <-done:
+		if state != StateDialing {
+			t.Log("unexpected state in handler =", state)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("state handler blocked")
+		t.FailNow()
+	}
+
+	cancel()
+	c.setState("a", StateConnecting, nil)
+	if len(c.states.subs) != 0 || len(done) != 0 {
+		t.Log("handler called after canceled")
+		t.Fail()
+	}
+}
+
+func TestConnStates_ConcurrentHandlerGetState(t *testing.T) {
+	c := defaultClient()
+
+	var lock sync.Mutex
+	last := make(map[string]ConnState)
+	cancel := c.OnStateChange(func(change *StateChange) {
+		// must not deadlock with changes of other servers
+		time.Sleep(time.Millisecond)
+		c.State(change.Server)
+
+		lock.Lock()
+		defer lock.Unlock()
+		if last[change.Server] != change.From {
+			t.Log("change notified out of order", change.Server, change.From, "->", change.To)
+			t.Fail()
+		}
+		last[change.Server] = change.To
+	})
+
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				c.setState(server, StateDialing, nil)
+				c.setState(server, StateConnecting, nil)
+				c.setState(server, StateConnected, nil)
+				c.setState(server, StateDisconnected, nil)
+			}
+		}(strconv.Itoa(i))
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Log("state changes blocked")
+		t.FailNow()
+	}
+	cancel()
+}
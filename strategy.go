@@ -0,0 +1,320 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync"
+)
+
+// ConnStrategy defines how client connects to the servers
+type ConnStrategy int
+
+const (
+	// ConnConcurrent connects to all servers at the same time, each
+	// packet is sent through one of the connections (default)
+	ConnConcurrent ConnStrategy = iota
+
+	// ConnFailover connects to one server at a time, the first server is
+	// the primary, the others are backups tried in order when the connection
+	// failed, after a connection lost, client reconnects to the primary first
+	ConnFailover
+
+	// ConnRoundRobin connects to one server at a time, the next server
+	// is used when the connection failed or lost
+	ConnRoundRobin
+
+	// ConnFanOut connects to all servers at the same time, each packet
+	// is sent to all servers connected, packets with packet id are
+	// completed when acknowledged by all the servers they were sent to
+	ConnFanOut
+)
+
+// WithConnStrategy set the strategy to connect to multiple servers,
+// default is ConnConcurrent
+func WithConnStrategy(s ConnStrategy) Option {
+	return func(c *client) error {
+		c.options.connStrategy = s
+		return nil
+	}
+}
+
+// isSingle reports whether only one server should be connected at a time
+func (s ConnStrategy) isSingle() bool {
+	return s == ConnFailover || s == ConnRoundRobin
+}
+
+// nextServer returns the server to connect after connection to server
+// failed or lost, and whether all servers have been tried
+func (c *client) nextServer(server string, lost bool) (string, bool) {
+	servers := c.options.servers
+	if !c.options.connStrategy.isSingle() || len(servers) < 2 {
+		return server, true
+	}
+
+	if lost && c.options.connStrategy == ConnFailover {
+		return servers[0], true
+	}
+
+	i := 0
+	for ; i < len(servers); i++ {
+		if servers[i] == server {
+			break
+		}
+	}
+	next := (i + 1) % len(servers)
+	return servers[next], next == 0
+}
+
+// fanOut tracks connections and acknowledgements for ConnFanOut
+type fanOut struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	conns   map[string]*connImpl      // server -> live connection
+	pending map[uint16]*fanOutPending // packet id -> acknowledgements
+	closed  bool                      // client shutdown, stop waiting for connections
+	dropped []Packet                  // packets not dispatched before closed
+	exited  chan struct{}             // closed when dispatch returned
+}
+
+// fanOutPending tracks the acknowledgements of one packet
+type fanOutPending struct {
+	servers map[string]struct{} // servers not acknowledged
+	acked   int                 // number of servers acknowledged
+}
+
+// fanOutPacket is the copy of client packet sent to one connection,
+// tokens are completed with the origin packet
+type fanOutPacket struct {
+	Packet
+	origin Packet
+}
+
+func newFanOut() *fanOut {
+	f := &fanOut{
+		conns:   make(map[string]*connImpl),
+		pending: make(map[uint16]*fanOutPending),
+		exited:  make(chan struct{}),
+	}
+	f.changed = sync.NewCond(&f.lock)
+	return f
+}
+
+// add the connection ready to send packets
+func (f *fanOut) add(c *connImpl) {
+	f.lock.Lock()
+	f.conns[c.name] = c
+	f.lock.Unlock()
+	f.changed.Broadcast()
+}
+
+// remove the connection lost, the server is no longer waited for the
+// acknowledgements, returns ids of packets acknowledged by all the other
+// servers
+func (f *fanOut) remove(c *connImpl) []uint16 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.conns[c.name] == c {
+		delete(f.conns, c.name)
+	}
+
+	var acked []uint16
+	for id, p := range f.pending {
+		if _, ok := p.servers[c.name]; !ok {
+			continue
+		}
+
+		delete(p.servers, c.name)
+		if len(p.servers) > 0 {
+			continue
+		}
+
+		// not acknowledged by any server is resent after reconnected
+		delete(f.pending, id)
+		if p.acked > 0 {
+			acked = append(acked, id)
+		}
+	}
+	return acked
+}
+
+// dispatch packets from client to all the connections,
+// wait until at least one connection is ready
+func (f *fanOut) dispatch(sendC <-chan Packet, queued *sync.Map) {
+	defer close(f.exited)
+	for pkt := range sendC {
+		id, hasID := packetID(pkt)
+		if hasID {
+			queued.Delete(id)
+		}
+
+		f.lock.Lock()
+		for len(f.conns) == 0 && !f.closed {
+			f.changed.Wait()
+		}
+
+		if len(f.conns) == 0 {
+			f.dropped = append(f.dropped, pkt)
+			f.lock.Unlock()
+			continue
+		}
+
+		conns := make([]*connImpl, 0, len(f.conns))
+		servers := make(map[string]struct{}, len(f.conns))
+		for server, conn := range f.conns {
+			conns = append(conns, conn)
+			servers[server] = struct{}{}
+		}
+		if hasID {
+			f.pending[id] = &fanOutPending{servers: servers}
+		}
+		f.lock.Unlock()
+
+		for _, conn := range conns {
+			// connections encode packets concurrently with their own version
+			select {
+			case conn.clientSendC <- &fanOutPacket{Packet: shallowCopy(pkt), origin: pkt}:
+			case <-conn.exitC:
+			}
+		}
+	}
+}
+
+// close stop waiting for connections, packets not dispatched are dropped
+func (f *fanOut) close() {
+	f.lock.Lock()
+	f.closed = true
+	f.lock.Unlock()
+	f.changed.Broadcast()
+}
+
+// queued returns the number of packets waiting in the connections
+func (f *fanOut) queued() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n := 0
+	for _, conn := range f.conns {
+		n += len(conn.clientSendC)
+	}
+	return n
+}
+
+// acked reports whether the packet with id has been acknowledged by
+// all servers it was sent to, after server acknowledged it
+func (f *fanOut) acked(id uint16, server string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	p, ok := f.pending[id]
+	if !ok {
+		return true
+	}
+
+	if _, ok := p.servers[server]; !ok {
+		// duplicated acknowledgement of resent packet
+		return false
+	}
+
+	delete(p.servers, server)
+	p.acked++
+	if len(p.servers) > 0 {
+		return false
+	}
+	delete(f.pending, id)
+	return true
+}
+
+// waiting reports whether the packet with id is waiting for the
+// acknowledgement of server, true if not dispatched by fan-out
+func (f *fanOut) waiting(id uint16, server string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	p, ok := f.pending[id]
+	if !ok {
+		return true
+	}
+
+	_, ok = p.servers[server]
+	return ok
+}
+
+// packetID returns the packet id of client packets
+func packetID(pkt Packet) (uint16, bool) {
+	switch p := pkt.(type) {
+	case *PublishPacket:
+		return p.PacketID, p.Qos > Qos0
+	case *SubscribePacket:
+		return p.PacketID, true
+	case *UnSubPacket:
+		return p.PacketID, true
+	}
+	return 0, false
+}
+
+// shallowCopy copies packets sent by client, topics of SubscribePacket and
+// UnSubPacket are copied, other fields like payload and props are shared
+func shallowCopy(pkt Packet) Packet {
+	switch p := pkt.(type) {
+	case *PublishPacket:
+		cp := *p
+		return &cp
+	case *SubscribePacket:
+		cp := *p
+		cp.Topics = make([]*Topic, len(p.Topics))
+		for i, t := range p.Topics {
+			if t != nil {
+				topic := *t
+				cp.Topics[i] = &topic
+			}
+		}
+		return &cp
+	case *UnSubPacket:
+		cp := *p
+		cp.TopicNames = append([]string(nil), p.TopicNames...)
+		return &cp
+	case *PubRelPacket:
+		cp := *p
+		return &cp
+	case *ConnPacket:
+		cp := *p
+		return &cp
+	case *ConnAckPacket:
+		cp := *p
+		return &cp
+	case *PubAckPacket:
+		cp := *p
+		return &cp
+	case *PubRecvPacket:
+		cp := *p
+		return &cp
+	case *PubCompPacket:
+		cp := *p
+		return &cp
+	case *SubAckPacket:
+		cp := *p
+		return &cp
+	case *UnSubAckPacket:
+		cp := *p
+		return &cp
+	case *AuthPacket:
+		cp := *p
+		return &cp
+	}
+	return pkt
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// testStrategyServer reports name to ch on every connection accepted,
+// then serves the connection with serve
+func testStrategyServer(t *testing.T, name string, ch chan<- string, serve func(conn net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			ch <- name
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func testStrategyClient(t *testing.T, s ConnStrategy, servers ...string) Client {
+	c, err := NewClient(
+		WithServer(servers...),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 2),
+		WithConnStrategy(s),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return c
+}
+
+func testConnOrder(t *testing.T, ch <-chan string, expected ...string) {
+	for i, name := range expected {
+		select {
+		case n := <-ch:
+			if n != name {
+				t.Log("unexpected server at", i, "server =", n, "expected =", name)
+				t.Fail()
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("no connection at", i)
+			t.Fail()
+			return
+		}
+	}
+}
+
+func TestNextServer(t *testing.T) {
+	c := defaultClient()
+	c.options.servers = []string{"a", "b", "c"}
+
+	for _, v := range []struct {
+		strategy ConnStrategy
+		server   string
+		lost     bool
+		next     string
+		tried    bool
+	}{
+		{ConnConcurrent, "b", false, "b", true},
+		{ConnFanOut, "b", true, "b", true},
+		{ConnFailover, "a", false, "b", false},
+		{ConnFailover, "c", false, "a", true},
+		{ConnFailover, "c", true, "a", true},
+		{ConnRoundRobin, "b", true, "c", false},
+		{ConnRoundRobin, "c", true, "a", true},
+	} {
+		c.options.connStrategy = v.strategy
+		if next, tried := c.nextServer(v.server, v.lost); next != v.next || tried != v.tried {
+			t.Log("unexpected next server for", v, "next =", next, "tried =", tried)
+			t.Fail()
+		}
+	}
+}
+
+func TestConnFailover(t *testing.T) {
+	ch := make(chan string, 16)
+	// primary refuses all connections
+	primary := testStrategyServer(t, "primary", ch, func(conn net.Conn) {})
+	defer primary.Close()
+	// backup accepts, then drops the connection
+	backup := testStrategyServer(t, "backup", ch, func(conn net.Conn) {
+		if testConnAck(conn) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	defer backup.Close()
+
+	c := testStrategyClient(t, ConnFailover, primary.Addr().String(), backup.Addr().String())
+	c.Connect(nil)
+	testConnOrder(t, ch, "primary", "backup", "primary", "backup")
+	c.Destroy(true)
+}
+
+func TestConnRoundRobin(t *testing.T) {
+	ch := make(chan string, 16)
+	serve := func(conn net.Conn) {
+		if testConnAck(conn) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	a := testStrategyServer(t, "a", ch, serve)
+	defer a.Close()
+	b := testStrategyServer(t, "b", ch, serve)
+	defer b.Close()
+
+	c := testStrategyClient(t, ConnRoundRobin, a.Addr().String(), b.Addr().String())
+	c.Connect(nil)
+	testConnOrder(t, ch, "a", "b", "a", "b")
+	c.Destroy(true)
+}
+
+func TestConnFanOut(t *testing.T) {
+	ch := make(chan string, 16)
+	published := make(chan string, 4)
+	ackB := make(chan struct{})
+	serve := func(name string, wait <-chan struct{}) func(conn net.Conn) {
+		return func(conn net.Conn) {
+			if !testConnAck(conn) {
+				return
+			}
+
+			for {
+				pkt, err := DecodeOnePacket(conn)
+				if err != nil {
+					return
+				}
+
+				if p, ok := pkt.(*PublishPacket); ok {
+					published <- name
+					<-wait
+					testWritePacket(conn, &PubAckPacket{PacketID: p.PacketID})
+				}
+			}
+		}
+	}
+
+	ackA := make(chan struct{})
+	close(ackA)
+	a := testStrategyServer(t, "a", ch, serve("a", ackA))
+	defer a.Close()
+	b := testStrategyServer(t, "b", ch, serve("b", ackB))
+	defer b.Close()
+
+	c := testStrategyClient(t, ConnFanOut, a.Addr().String(), b.Addr().String())
+	c.Connect(nil)
+	<-ch
+	<-ch
+	// wait for both connections ready
+	time.Sleep(100 * time.Millisecond)
+
+	token := c.PublishContext(context.Background(), &PublishPacket{TopicName: "foo", Qos: Qos1})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-published:
+		case <-time.After(5 * time.Second):
+			t.Log("publish not sent to all servers")
+			t.FailNow()
+		}
+	}
+
+	select {
+	case <-token.Done():
+		t.Log("publish completed before acknowledged by all servers")
+		t.Fail()
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(ackB)
+	select {
+	case <-token.Done():
+		if token.Err() != nil {
+			t.Log(token.Err())
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("publish not completed")
+		t.Fail()
+	}
+	c.Destroy(true)
+}
+
+func TestConnFanOut_Qos0Token(t *testing.T) {
+	ch := make(chan string, 16)
+	serve := func(conn net.Conn) {
+		if !testConnAck(conn) {
+			return
+		}
+		for {
+			if _, err := DecodeOnePacket(conn); err != nil {
+				return
+			}
+		}
+	}
+
+	a := testStrategyServer(t, "a", ch, serve)
+	defer a.Close()
+	b := testStrategyServer(t, "b", ch, serve)
+	defer b.Close()
+
+	c := testStrategyClient(t, ConnFanOut, a.Addr().String(), b.Addr().String())
+	defer c.Destroy(true)
+	c.Connect(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.PublishContext(ctx, &PublishPacket{TopicName: "foo", Qos: Qos0}).Wait(ctx); err != nil {
+		t.Log("QoS 0 publish not completed, err =", err)
+		t.Fail()
+	}
+}
+
+func TestFanOut_Remove(t *testing.T) {
+	f := newFanOut()
+	a, b := &connImpl{name: "a"}, &connImpl{name: "b"}
+	f.add(a)
+	f.add(b)
+
+	for _, id := range []uint16{1, 2} {
+		f.pending[id] = &fanOutPending{servers: map[string]struct{}{"a": {}, "b": {}}}
+	}
+
+	if f.acked(1, "a") {
+		t.Log("completed before acknowledged by all servers")
+		t.Fail()
+	}
+
+	if acked := f.remove(b); len(acked) != 1 || acked[0] != 1 {
+		t.Log("packet acknowledged by the other servers not completed, acked =", acked)
+		t.Fail()
+	}
+
+	// packet 2 is not acknowledged by any server, left to resend
+	if acked := f.remove(a); len(acked) != 0 || len(f.pending) != 0 || !f.waiting(2, "a") {
+		t.Log("unexpected pending after all servers removed, acked =", acked, ", pending =", f.pending)
+		t.Fail()
+	}
+}
@@ -25,8 +25,12 @@ package libmqtt
 // The SubscribePacket also specifies (for each Subscription)
 // the maximum QoS with which the Server can send Application Messages to the Client
 type SubscribePacket struct {
+	BasePacket
 	PacketID uint16
 	Topics   []*Topic
+
+	// MQTT 5 properties, ignored in V311
+	Props *SubProps
 }
 
 // Type SubscribePacket'strategy type is CtrlSubscribe
@@ -42,12 +46,18 @@ func (s *SubscribePacket) WriteTo(w BufferWriter) error {
 
 	// fixed header
 	w.WriteByte(CtrlSubscribe<<4 | 0x02)
+	var props []byte
+	if s.Version() == V5 {
+		props = encodeProps(s.Props.props())
+	}
 	payload := s.payload()
 	// remaining length
-	writeRemainLength(2+len(payload), w)
+	writeRemainLength(2+len(props)+len(payload), w)
 	// packet id
 	w.WriteByte(byte(s.PacketID >> 8))
 	w.WriteByte(byte(s.PacketID))
+	// properties (MQTT 5 only)
+	w.Write(props)
 
 	_, err := w.Write(payload)
 	return err
@@ -58,21 +68,67 @@ func (s *SubscribePacket) payload() []byte {
 	if s.Topics != nil {
 		for _, t := range s.Topics {
 			result = append(result, encodeDataWithLen([]byte(t.Name))...)
-			result = append(result, t.Qos)
+			if s.Version() == V5 {
+				// subscription options
+				result = append(result, t.Qos|
+					boolToByte(t.NoLocal)<<2|
+					boolToByte(t.RetainAsPublished)<<3|
+					(t.RetainHandling&0x03)<<4)
+			} else {
+				result = append(result, t.Qos)
+			}
 		}
 	}
 	return result
 }
 
+// SubProps defines subscribe packet properties (MQTT 5)
+type SubProps struct {
+	// SubID identifies the subscription, it will be sent back
+	// in the PublishPacket matches this subscription, 0 means none
+	SubID int
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (s *SubProps) props() []byte {
+	if s == nil {
+		return nil
+	}
+
+	var result []byte
+	if s.SubID != 0 {
+		result = appendPropVarInt(result, propKeySubID, s.SubID)
+	}
+	return appendUserProps(result, s.UserProps)
+}
+
+func (s *SubProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeySubID]; ok {
+		s.SubID = propVarInts(v)[0]
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		s.UserProps = propUserProps(v)
+	}
+}
+
 // SubAckPacket is sent by the Server to the Client
 // to confirm receipt and processing of a SubscribePacket.
 //
 // SubAckPacket contains a list of return codes,
 // that specify the maximum QoS level that was granted in
 // each Subscription that was requested by the SubscribePacket.
+//
+// In MQTT 5, the codes are reason codes
 type SubAckPacket struct {
+	BasePacket
 	PacketID uint16
 	Codes    []SubAckCode
+
+	// MQTT 5 properties, ignored in V311
+	Props *SubAckProps
 }
 
 // Type SubAckPacket'strategy type is CtrlSubAck
@@ -88,11 +144,17 @@ func (s *SubAckPacket) WriteTo(w BufferWriter) error {
 	// fixed header
 	w.WriteByte(CtrlSubAck << 4)
 	// remaining length
+	var props []byte
+	if s.Version() == V5 {
+		props = encodeProps(s.Props.props())
+	}
 	payload := s.payload()
-	writeRemainLength(2+len(payload), w)
+	writeRemainLength(2+len(props)+len(payload), w)
 	// packet id
 	w.WriteByte(byte(s.PacketID >> 8))
 	w.WriteByte(byte(s.PacketID))
+	// properties (MQTT 5 only)
+	w.Write(props)
 	// payload
 	_, err := w.Write(payload)
 	return err
@@ -102,11 +164,35 @@ func (s *SubAckPacket) payload() []byte {
 	return s.Codes
 }
 
+// SubAckProps defines subscribe acknowledge properties (MQTT 5)
+type SubAckProps struct {
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (s *SubAckProps) props() []byte {
+	if s == nil {
+		return nil
+	}
+	return appendReasonProps(nil, s.ReasonString, s.UserProps)
+}
+
+func (s *SubAckProps) setProps(props map[byte][][]byte) {
+	s.ReasonString, s.UserProps = decodeReasonProps(props)
+}
+
 // UnSubPacket is sent by the Client to the Server,
 // to unsubscribe from topics.
 type UnSubPacket struct {
+	BasePacket
 	PacketID   uint16
 	TopicNames []string
+
+	// MQTT 5 properties, ignored in V311
+	Props *UnSubProps
 }
 
 // Type UnSubPacket'strategy type is CtrlUnSub
@@ -122,12 +208,18 @@ func (s *UnSubPacket) WriteTo(w BufferWriter) error {
 
 	// fixed header
 	w.WriteByte(CtrlUnSub<<4 | 0x02)
+	var props []byte
+	if s.Version() == V5 {
+		props = encodeProps(s.Props.props())
+	}
 	payload := s.payload()
 	// remaining length
-	writeRemainLength(2+len(payload), w)
+	writeRemainLength(2+len(props)+len(payload), w)
 	// packet id
 	w.WriteByte(byte(s.PacketID >> 8))
 	w.WriteByte(byte(s.PacketID))
+	// properties (MQTT 5 only)
+	w.Write(props)
 
 	_, err := w.Write(payload)
 	return err
@@ -143,10 +235,34 @@ func (s *UnSubPacket) payload() []byte {
 	return result
 }
 
+// UnSubProps defines unsubscribe packet properties (MQTT 5)
+type UnSubProps struct {
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (s *UnSubProps) props() []byte {
+	if s == nil {
+		return nil
+	}
+	return appendUserProps(nil, s.UserProps)
+}
+
+func (s *UnSubProps) setProps(props map[byte][][]byte) {
+	if v, ok := props[propKeyUserProps]; ok {
+		s.UserProps = propUserProps(v)
+	}
+}
+
 // UnSubAckPacket is sent by the Server to the Client to confirm
 // receipt of an UnSubPacket
 type UnSubAckPacket struct {
+	BasePacket
 	PacketID uint16
+
+	// MQTT 5 reason codes (one per topic) and properties, ignored in V311
+	Codes []ReasonCode
+	Props *UnSubAckProps
 }
 
 // Type UnSubAckPacket'strategy type is CtrlUnSubAck
@@ -162,9 +278,43 @@ func (s *UnSubAckPacket) WriteTo(w BufferWriter) error {
 
 	// fixed header
 	w.WriteByte(CtrlUnSubAck << 4)
+	if s.Version() == V5 {
+		props := encodeProps(s.Props.props())
+		// remaining length
+		writeRemainLength(2+len(props)+len(s.Codes), w)
+		// packet id
+		w.WriteByte(byte(s.PacketID >> 8))
+		w.WriteByte(byte(s.PacketID))
+		// properties
+		w.Write(props)
+		// payload
+		_, err := w.Write(s.Codes)
+		return err
+	}
+
 	// remaining length
 	w.WriteByte(0x02)
 	// packet id
 	w.WriteByte(byte(s.PacketID >> 8))
 	return w.WriteByte(byte(s.PacketID))
 }
+
+// UnSubAckProps defines unsubscribe acknowledge properties (MQTT 5)
+type UnSubAckProps struct {
+	// ReasonString is the human readable reason for diagnostic
+	ReasonString string
+
+	// UserProps user defined properties
+	UserProps UserProps
+}
+
+func (s *UnSubAckProps) props() []byte {
+	if s == nil {
+		return nil
+	}
+	return appendReasonProps(nil, s.ReasonString, s.UserProps)
+}
+
+func (s *UnSubAckProps) setProps(props map[byte][][]byte) {
+	s.ReasonString, s.UserProps = decodeReasonProps(props)
+}
@@ -17,7 +17,9 @@
 package libmqtt
 
 import (
+	"net"
 	"testing"
+	"time"
 )
 
 func TestSubscribePacket_Bytes(t *testing.T) {
@@ -41,3 +43,75 @@ func TestUnSubPacket_Bytes(t *testing.T) {
 func TestUnSubAckPacket_Bytes(t *testing.T) {
 	testBytes(testUnSubAckMsg, testUnSubAckMsgBytes, t)
 }
+
+func TestResubscribe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	resubscribed := make(chan *SubscribePacket, 1)
+	// a server drops the connection and the session after subscribed
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			if _, err := DecodeOnePacket(conn); err != nil {
+				conn.Close()
+				return
+			}
+			testWritePacket(conn, &ConnAckPacket{})
+
+			pkt, err := DecodeOnePacket(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			p, _ := pkt.(*SubscribePacket)
+			if i == 0 && p != nil {
+				testWritePacket(conn, &SubAckPacket{
+					PacketID: p.PacketID,
+					Codes:    []SubAckCode{SubOkMaxQos1, SubFail},
+				})
+				// wait for client to handle SubAck
+				time.Sleep(100 * time.Millisecond)
+			} else if i > 0 {
+				resubscribed <- p
+			}
+			conn.Close()
+		}
+	}()
+
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 2),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	c.Connect(nil)
+	c.Subscribe(&Topic{Name: "foo", Qos: Qos2}, &Topic{Name: "bar", Qos: Qos1})
+
+	select {
+	case p := <-resubscribed:
+		if p == nil || len(p.Topics) != 1 ||
+			p.Topics[0].Name != "foo" || p.Topics[0].Qos != Qos1 {
+			t.Log("unexpected resubscribe packet =", p)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("topics not resubscribed")
+		t.Fail()
+	}
+
+	c.Destroy(true)
+}
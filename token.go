@@ -0,0 +1,128 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// AckError is the error when server responded with a failure reason code
+type AckError struct {
+	Code ReasonCode
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("packet refused by server, reason code = %#x ", e.Code)
+}
+
+// ackErr returns an AckError if the code is a failure reason code
+func ackErr(code ReasonCode) error {
+	if code < 0x80 {
+		return nil
+	}
+	return &AckError{Code: code}
+}
+
+// Token tracks the completion of a publish, subscribe or unsubscribe,
+// it's completed when the packet is acknowledged by server (or sent to
+// server for QoS 0 publish), or the context is done
+type Token struct {
+	done  chan struct{}
+	once  sync.Once
+	codes []ReasonCode
+	err   error
+}
+
+func newToken() *Token {
+	return &Token{done: make(chan struct{})}
+}
+
+// Done returns a channel which is closed when the token completed
+func (t *Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait blocks until the token completed or ctx done, returns the
+// result error of the token or the error of ctx
+func (t *Token) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Err returns the result error, nil if not completed or succeeded
+func (t *Token) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// Codes returns the reason codes from server, for subscribe they are
+// the granted QoS levels or failure codes of topics (in the same order),
+// for publish it's the reason code of PUBACK or PUBCOMP (or PUBREC if failed)
+func (t *Token) Codes() []ReasonCode {
+	select {
+	case <-t.done:
+		return t.codes
+	default:
+		return nil
+	}
+}
+
+// complete the token, only the first call takes effect
+func (t *Token) complete(codes []ReasonCode, err error) {
+	t.once.Do(func() {
+		t.codes = codes
+		t.err = err
+		close(t.done)
+	})
+}
+
+// addToken track the token with key until completed or ctx done,
+// the key is the packet id for packets need acknowledgement, or the
+// packet sent for QoS 0 publish, which is copied for every publish
+func (c *client) addToken(ctx context.Context, key interface{}, t *Token) {
+	c.tokens.Store(key, t)
+	if ctx.Done() == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// packet id may be reused by another token after completed
+			c.tokens.CompareAndDelete(key, t)
+			t.complete(nil, ctx.Err())
+		case <-t.done:
+		}
+	}()
+}
+
+// completeToken complete the token tracked with key if any
+func (c *client) completeToken(key interface{}, codes []ReasonCode, err error) {
+	if v, ok := c.tokens.LoadAndDelete(key); ok {
+		v.(*Token).complete(codes, err)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	token := newToken()
+	if token.Err() != nil || token.Codes() != nil {
+		t.Log("token not completed but has result")
+		t.Fail()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := token.Wait(ctx); err != context.DeadlineExceeded {
+		t.Log("wait not canceled by context, err =", err)
+		t.Fail()
+	}
+
+	token.complete([]ReasonCode{CodeNoMatchingSubscribers}, nil)
+	token.complete(nil, ErrTimeOut)
+	if err := token.Wait(context.Background()); err != nil ||
+		len(token.Codes()) != 1 || token.Codes()[0] != CodeNoMatchingSubscribers {
+		t.Log("unexpected token result, err =", err, "codes =", token.Codes())
+		t.Fail()
+	}
+
+	if err := ackErr(CodeNotAuthorized); err == nil || err.(*AckError).Code != CodeNotAuthorized {
+		t.Log("unexpected ack error =", err)
+		t.Fail()
+	}
+}
+
+func TestTokenContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	// a server acknowledges subscribe and the first publish only
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := DecodeOnePacket(conn); err != nil {
+			return
+		}
+		testWritePacket(conn, &ConnAckPacket{})
+
+		published := false
+		for {
+			pkt, err := DecodeOnePacket(conn)
+			if err != nil {
+				return
+			}
+
+			switch p := pkt.(type) {
+			case *SubscribePacket:
+				testWritePacket(conn, &SubAckPacket{
+					PacketID: p.PacketID,
+					Codes:    []SubAckCode{SubOkMaxQos1, SubFail},
+				})
+			case *PublishPacket:
+				if !published {
+					published = true
+					testWritePacket(conn, &PubAckPacket{PacketID: p.PacketID})
+				}
+			}
+		}
+	}()
+
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Second, time.Second, 1),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+	c.Connect(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	token := c.SubscribeContext(ctx, &Topic{Name: "foo", Qos: Qos1}, &Topic{Name: "bar", Qos: Qos2})
+	if err := token.Wait(ctx); err != nil {
+		t.Log("subscribe failed, err =", err)
+		t.FailNow()
+	}
+	if codes := token.Codes(); len(codes) != 2 || codes[0] != SubOkMaxQos1 || codes[1] != SubFail {
+		t.Log("unexpected subscribe codes =", codes)
+		t.Fail()
+	}
+
+	token = c.PublishContext(ctx, &PublishPacket{TopicName: "foo", Qos: Qos1})
+	if err := token.Wait(ctx); err != nil {
+		t.Log("publish failed, err =", err)
+		t.Fail()
+	}
+
+	// no acknowledgement for this one
+	pubCtx, pubCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer pubCancel()
+	token = c.PublishContext(pubCtx, &PublishPacket{TopicName: "foo", Qos: Qos1})
+	<-token.Done()
+	if token.Err() != context.DeadlineExceeded {
+		t.Log("publish not canceled by context, err =", token.Err())
+		t.Fail()
+	}
+}
+
+func TestToken_Qos0SamePacket(t *testing.T) {
+	c := defaultClient()
+	c.sendC = make(chan Packet, 2)
+
+	p := &PublishPacket{TopicName: "foo"}
+	tokens := []*Token{newToken(), newToken()}
+	for _, token := range tokens {
+		c.publish(context.Background(), p, token)
+	}
+
+	// sent by connection
+	for i := 0; i < 2; i++ {
+		c.completeToken(<-c.sendC, nil, nil)
+	}
+
+	for i, token := range tokens {
+		select {
+		case <-token.Done():
+		default:
+			t.Log("token of publish", i, "not completed")
+			t.Fail()
+		}
+	}
+}
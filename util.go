@@ -17,10 +17,14 @@
 package libmqtt
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 type BufferWriter interface {
@@ -43,29 +47,176 @@ func sendKey(packetID uint16) string {
 	return fmt.Sprintf("%s%d", "S", packetID)
 }
 
+// parsePersistKey parse the key made by sendKey or recvKey
+func parsePersistKey(key string) (isSend bool, packetID uint16, ok bool) {
+	if len(key) < 2 || (key[0] != 'S' && key[0] != 'R') {
+		return false, 0, false
+	}
+
+	id, err := strconv.ParseUint(key[1:], 10, 16)
+	if err != nil || id == 0 {
+		return false, 0, false
+	}
+	return key[0] == 'S', uint16(id), true
+}
+
+// ErrPacketIDExhausted is the error when all packet ids are in use
+var ErrPacketIDExhausted = errors.New("packet id exhausted ")
+
+// idGenerator allocates packet ids, freed ids are reused in the order
+// they were freed, ids in use by QoS 1/2 publish are limited by the
+// in-flight window
 type idGenerator struct {
 	usedIds *sync.Map
+	n       int32
+	changed func(n int) // called with the number of ids in use when changed
+
+	lock    sync.Mutex
+	freeIDs []uint16      // ids freed, reused first
+	cursor  uint16        // ids after cursor have never been allocated
+	pubs    int           // ids in use by publish
+	limit   int           // max ids in use by publish, 0 means no limit
+	freed   chan struct{} // closed and renewed when publish id freed or limit changed
 }
 
 func newIDGenerator() *idGenerator {
 	return &idGenerator{
 		usedIds: &sync.Map{},
+		freed:   make(chan struct{}),
+	}
+}
+
+// pubReleased is the in-flight entry of QoS 2 publish packet received by
+// server (PUBREC), PUBREL is resent instead of the publish packet
+type pubReleased struct {
+	rel *PubRelPacket
+	pub *PublishPacket
+}
+
+// isPubExtra reports whether the id is used by publish in-flight
+func isPubExtra(extra interface{}) bool {
+	switch extra.(type) {
+	case *PublishPacket, *PubRelPacket, *pubReleased:
+		return true
 	}
+	return false
 }
 
-func (g *idGenerator) next(extra interface{}) uint16 {
-	var i uint16
-	for i = 1; i < math.MaxUint16; i++ {
-		if _, ok := g.usedIds.Load(i); !ok {
-			g.usedIds.Store(i, extra)
-			return i
+// next allocates a free id for extra, for publish it blocks until there
+// is room in the in-flight window, ctx done or stop closed (returns
+// ErrClientClosed), returns ErrPacketIDExhausted if all ids are in use
+func (g *idGenerator) next(ctx context.Context, stop <-chan struct{}, extra interface{}) (uint16, error) {
+	pub := isPubExtra(extra)
+
+	g.lock.Lock()
+	for pub && g.limit > 0 && g.pubs >= g.limit {
+		freed := g.freed
+		g.lock.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-stop:
+			return 0, ErrClientClosed
+		}
+		g.lock.Lock()
+	}
+
+	id, ok := g.alloc(extra)
+	if ok && pub {
+		g.pubs++
+	}
+	g.lock.Unlock()
+
+	if !ok {
+		return 0, ErrPacketIDExhausted
+	}
+	g.add(1)
+	return id, nil
+}
+
+// alloc a free id, must be called with lock held
+func (g *idGenerator) alloc(extra interface{}) (uint16, bool) {
+	for len(g.freeIDs) > 0 {
+		id := g.freeIDs[0]
+		g.freeIDs = g.freeIDs[1:]
+		if _, loaded := g.usedIds.LoadOrStore(id, extra); !loaded {
+			return id, true
+		}
+	}
+
+	// ids used by use() are skipped
+	for g.cursor < math.MaxUint16 {
+		g.cursor++
+		if _, loaded := g.usedIds.LoadOrStore(g.cursor, extra); !loaded {
+			return g.cursor, true
 		}
 	}
-	return 1
+	return 0, false
+}
+
+// use marks the id as used with extra, return false if already used
+func (g *idGenerator) use(id uint16, extra interface{}) bool {
+	if _, loaded := g.usedIds.LoadOrStore(id, extra); loaded {
+		return false
+	}
+
+	if isPubExtra(extra) {
+		g.lock.Lock()
+		g.pubs++
+		g.lock.Unlock()
+	}
+	g.add(1)
+	return true
 }
 
 func (g *idGenerator) free(id uint16) {
-	g.usedIds.Delete(id)
+	extra, loaded := g.usedIds.LoadAndDelete(id)
+	if !loaded {
+		return
+	}
+
+	g.lock.Lock()
+	g.freeIDs = append(g.freeIDs, id)
+	if isPubExtra(extra) {
+		g.pubs--
+		g.signal()
+	}
+	g.lock.Unlock()
+	g.add(-1)
+}
+
+// setLimit set the in-flight window of publish, 0 means no limit
+func (g *idGenerator) setLimit(limit int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.limit = limit
+	g.signal()
+}
+
+// signal the waiters of in-flight window, must be called with lock held
+func (g *idGenerator) signal() {
+	close(g.freed)
+	g.freed = make(chan struct{})
+}
+
+// count returns the number of ids in use
+func (g *idGenerator) count() int {
+	return int(atomic.LoadInt32(&g.n))
+}
+
+func (g *idGenerator) add(delta int32) {
+	n := atomic.AddInt32(&g.n, delta)
+	if g.changed != nil {
+		g.changed(int(n))
+	}
+}
+
+// replace the extra of id in use, return false if the id is freed
+// or used by another extra
+func (g *idGenerator) replace(id uint16, old, extra interface{}) bool {
+	return g.usedIds.CompareAndSwap(id, old, extra)
 }
 
 func (g *idGenerator) getExtra(id uint16) (interface{}, bool) {
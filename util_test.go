@@ -17,7 +17,11 @@
 package libmqtt
 
 import (
+	"context"
+	"math"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestBoolToByte(t *testing.T) {
@@ -29,3 +33,199 @@ func TestBoolToByte(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestIDGenerator_Count(t *testing.T) {
+	g := newIDGenerator()
+	var changed []int
+	g.changed = func(n int) { changed = append(changed, n) }
+
+	id, _ := g.next(context.Background(), nil, nil)
+	if !g.use(id+1, nil) || g.use(id, nil) {
+		t.Log("unexpected result of use")
+		t.Fail()
+	}
+	g.free(id)
+	g.free(id)
+
+	if g.count() != 1 || len(changed) != 3 || changed[2] != 1 {
+		t.Log("count =", g.count(), "changed =", changed)
+		t.Fail()
+	}
+}
+
+func TestIDGenerator_Exhausted(t *testing.T) {
+	g := newIDGenerator()
+	ctx := context.Background()
+	g.use(2, nil)
+	for i := 1; i < math.MaxUint16; i++ {
+		if id, err := g.next(ctx, nil, nil); err != nil || id == 2 {
+			t.Log("unexpected id", id, "err =", err)
+			t.FailNow()
+		}
+	}
+
+	if _, err := g.next(ctx, nil, nil); err != ErrPacketIDExhausted {
+		t.Log("unexpected err when exhausted", err)
+		t.Fail()
+	}
+
+	// freed ids are reused in order
+	g.free(100)
+	g.free(10)
+	for _, expected := range []uint16{100, 10} {
+		if id, err := g.next(ctx, nil, nil); err != nil || id != expected {
+			t.Log("unexpected id", id, "expected =", expected, "err =", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestIDGenerator_Window(t *testing.T) {
+	g := newIDGenerator()
+	g.setLimit(2)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		g.next(ctx, nil, &PublishPacket{})
+	}
+
+	// only publish is limited
+	if _, err := g.next(ctx, nil, &SubscribePacket{}); err != nil {
+		t.Log("subscribe limited by window, err =", err)
+		t.Fail()
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.next(timeout, nil, &PublishPacket{}); err != context.DeadlineExceeded {
+		t.Log("publish not blocked, err =", err)
+		t.Fail()
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if _, err := g.next(ctx, stop, &PublishPacket{}); err != ErrClientClosed {
+		t.Log("publish not stopped, err =", err)
+		t.Fail()
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		g.free(1)
+	}()
+	if id, err := g.next(ctx, nil, &PublishPacket{}); err != nil || id != 1 {
+		t.Log("unexpected id after freed", id, "err =", err)
+		t.Fail()
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		g.setLimit(0)
+	}()
+	if _, err := g.next(ctx, nil, &PublishPacket{}); err != nil {
+		t.Log("publish not unblocked by limit changed, err =", err)
+		t.Fail()
+	}
+}
+
+func TestInFlightWindow_ReceiveMax(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	received := make(chan *PublishPacket, 3)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		decoder := &Decoder{Version: V5}
+		if _, err := decoder.Decode(conn); err != nil {
+			return
+		}
+		testWritePacket(conn, &ConnAckPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			Props:      &ConnAckProps{MaxRecv: 2},
+		})
+
+		for {
+			pkt, err := decoder.Decode(conn)
+			if err != nil {
+				return
+			}
+			if p, ok := pkt.(*PublishPacket); ok {
+				received <- p
+			}
+		}
+	}()
+
+	c, err := NewClient(
+		WithServer(l.Addr().String()),
+		WithVersion(V5, false),
+		WithKeepalive(0, 1.2),
+		WithInFlightWindow(10),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer c.Destroy(true)
+
+	connected := make(chan struct{})
+	c.Connect(func(server string, code byte, err error) {
+		close(connected)
+	})
+	<-connected
+
+	go c.Publish(
+		&PublishPacket{TopicName: "1", Qos: Qos1},
+		&PublishPacket{TopicName: "2", Qos: Qos1},
+		&PublishPacket{TopicName: "3", Qos: Qos1},
+	)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Log("publish not received", i)
+			t.FailNow()
+		}
+	}
+
+	select {
+	case p := <-received:
+		t.Log("publish exceeds receive maximum", p.TopicName)
+		t.Fail()
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInFlightWindow_Servers(t *testing.T) {
+	c := defaultClient()
+	c.options.inFlightWindow = 20
+
+	for _, v := range []struct {
+		server    string
+		window    int
+		connected bool
+		limit     int
+	}{
+		{"a", 10, true, 10},
+		{"b", 5, true, 5},
+		{"c", 20, true, 5},
+		// connected later with larger window
+		{"a", 10, true, 5},
+		{"b", 0, false, 10},
+		{"a", 0, false, 20},
+		{"c", 0, false, 20},
+	} {
+		c.setWindow(v.server, v.window, v.connected)
+		if c.idGen.limit != v.limit {
+			t.Log("unexpected limit after", v.server, "connected =", v.connected, "limit =", c.idGen.limit)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBadWebSocketHandshake server didn't accept the websocket upgrade
+	ErrBadWebSocketHandshake = errors.New("bad websocket handshake ")
+
+	// ErrBadWebSocketFrame received websocket frame can not be used for MQTT
+	ErrBadWebSocketFrame = errors.New("bad websocket frame ")
+)
+
+const (
+	wsGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsSubProtocol = "mqtt"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// dialWebSocket dial the websocket server with url u (ws or wss),
+// the returned connection reads and writes MQTT byte stream
+// with websocket binary frames
+func dialWebSocket(ctx context.Context, u *url.URL, dial dialFunc, tlsConfig *tls.Config, header http.Header) (net.Conn, error) {
+	host := wsHost(u)
+
+	var conn net.Conn
+	var err error
+	if u.Scheme == "wss" {
+		var config *tls.Config
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		} else {
+			config = &tls.Config{}
+		}
+
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		conn, err = dialTLS(ctx, dial, host, config)
+	} else {
+		conn, err = dial(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	wsConn, err := wsHandshake(conn, u, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return wsConn, nil
+}
+
+// wsHost returns the host:port of websocket url, with default port
+func wsHost(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	if u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// wsHandshake send the upgrade request and verify the response
+func wsHandshake(conn net.Conn, u *url.URL, header http.Header) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", wsSubProtocol)
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) ||
+		resp.Header.Get("Sec-WebSocket-Protocol") != wsSubProtocol {
+		return nil, ErrBadWebSocketHandshake
+	}
+
+	return newWSConn(conn, br, true), nil
+}
+
+// wsAcceptKey compute the Sec-WebSocket-Accept value of the key
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsConn wraps a websocket connection as a byte stream,
+// each Write is sent as one binary frame,
+// Read returns payload of binary (and continuation) frames
+type wsConn struct {
+	net.Conn
+	br       *bufio.Reader
+	isClient bool // client frames must be masked
+
+	readRemain uint64 // payload remaining in current frame
+	readMask   []byte // masking key of current frame, nil if not masked
+	readPos    uint64 // position in current frame, used for unmasking
+	writeLock  sync.Mutex
+	closeOnce  sync.Once
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, isClient bool) *wsConn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &wsConn{Conn: conn, br: br, isClient: isClient}
+}
+
+// Read payload of binary frames
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.readRemain == 0 {
+		opcode, length, mask, err := c.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsOpBinary, wsOpContinuation:
+			c.readRemain, c.readMask, c.readPos = length, mask, 0
+		case wsOpPing, wsOpPong, wsOpClose:
+			if length > 125 {
+				return 0, ErrBadWebSocketFrame
+			}
+
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return 0, err
+			}
+			maskBytes(mask, 0, payload)
+
+			switch opcode {
+			case wsOpPing:
+				if err := c.writeFrame(wsOpPong, payload); err != nil {
+					return 0, err
+				}
+			case wsOpClose:
+				c.closeOnce.Do(func() {
+					c.writeFrame(wsOpClose, payload)
+				})
+				return 0, io.EOF
+			}
+		default:
+			// text frame is not allowed for MQTT
+			return 0, ErrBadWebSocketFrame
+		}
+	}
+
+	if uint64(len(p)) > c.readRemain {
+		p = p[:c.readRemain]
+	}
+
+	n, err := c.br.Read(p)
+	maskBytes(c.readMask, c.readPos, p[:n])
+	c.readRemain -= uint64(n)
+	c.readPos += uint64(n)
+	return n, err
+}
+
+func (c *wsConn) readFrameHeader() (opcode byte, length uint64, mask []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.br, header); err != nil {
+		return
+	}
+
+	opcode = header[0] & 0x0F
+	length = uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.br, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.br, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(c.br, mask)
+	}
+	return
+}
+
+// Write p as one binary frame
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+
+	l := len(payload)
+	switch {
+	case l < 126:
+		frame = append(frame, maskBit|byte(l))
+	case l <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(l>>8), byte(l))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(l))
+	}
+
+	start := len(frame)
+	if c.isClient {
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		start += 4
+		frame = append(frame, payload...)
+		maskBytes(mask, 0, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close send a close frame and close the underlying connection
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsOpClose, []byte{0x03, 0xE8}) // 1000 normal closure
+	})
+	return c.Conn.Close()
+}
+
+// maskBytes apply websocket masking to data at pos of the frame payload
+func maskBytes(mask []byte, pos uint64, data []byte) {
+	if mask == nil {
+		return
+	}
+
+	for i := range data {
+		data[i] ^= mask[(pos+uint64(i))%4]
+	}
+}
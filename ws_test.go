@@ -0,0 +1,139 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSConn_ReadWrite(t *testing.T) {
+	c, s := net.Pipe()
+	client, server := newWSConn(c, nil, true), newWSConn(s, nil, false)
+
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		data := bytes.Repeat([]byte{0xA5}, size)
+		go client.Write(data)
+
+		recv := make([]byte, size)
+		if _, err := io.ReadFull(server, recv); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if !bytes.Equal(data, recv) {
+			t.Log("payload mismatch, size =", size)
+			t.Fail()
+		}
+	}
+
+	// ping should be answered with pong transparently
+	go server.writeFrame(wsOpPing, []byte("ping"))
+	go server.Write([]byte("data"))
+	go func() {
+		// consume pong frame
+		server.readFrameHeader()
+		io.ReadFull(server.br, make([]byte, 4))
+	}()
+
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(client, recv); err != nil || string(recv) != "data" {
+		t.Log(string(recv), err)
+		t.Fail()
+	}
+
+	client.Conn.Close()
+	server.Conn.Close()
+}
+
+func TestWebSocketConnect(t *testing.T) {
+	recvC := make(chan Packet, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mqtt" || r.Header.Get("X-Test") != "foo" ||
+			r.Header.Get("Sec-WebSocket-Protocol") != wsSubProtocol {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Protocol: mqtt\r\n" +
+			"Sec-WebSocket-Accept: " + wsAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		brw.Flush()
+
+		ws := newWSConn(conn, brw.Reader, false)
+		if _, err := DecodeOnePacket(ws); err != nil {
+			return
+		}
+		testWritePacket(ws, &ConnAckPacket{Code: ConnAccepted})
+
+		pkt, err := DecodeOnePacket(ws)
+		if err != nil {
+			return
+		}
+		recvC <- pkt
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(
+		WithServer(strings.Replace(srv.URL, "http://", "ws://", 1)+"/mqtt"),
+		WithWebSocketHeader(http.Header{"X-Test": {"foo"}}),
+		WithKeepalive(0, 1.2),
+		WithDialTimeout(5),
+		WithBackoffStrategy(time.Second, time.Second, 1),
+	)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	c.Connect(func(server string, code ConnAckCode, err error) {
+		if err != nil || code != ConnAccepted {
+			t.Log("connect failed, code =", code, "err =", err)
+			t.Fail()
+			return
+		}
+		c.Publish(&PublishPacket{TopicName: "foo", Payload: []byte("bar")})
+	})
+
+	select {
+	case pkt := <-recvC:
+		if p, ok := pkt.(*PublishPacket); !ok || p.TopicName != "foo" || string(p.Payload) != "bar" {
+			t.Log("unexpected packet", pkt)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("publish not received")
+		t.Fail()
+	}
+
+	c.Destroy(true)
+	c.Wait()
+}